@@ -2,10 +2,15 @@ package main
 
 import (
 	"fmt"
+	"os"
 
-	"github.com/xukonxe/revlay/internal/i18n"
+	"github.com/xukonxe/revlay/internal/cli"
+	"github.com/xukonxe/revlay/internal/color"
 )
 
 func main() {
-	fmt.Println(i18n.T().AgentRunning)
+	if err := cli.RunAgent(); err != nil {
+		fmt.Fprintln(os.Stderr, color.Red("Error: %v", err))
+		os.Exit(1)
+	}
 }
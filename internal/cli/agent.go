@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/xukonxe/revlay/internal/color"
+	"github.com/xukonxe/revlay/internal/i18n"
+)
+
+// RunAgent runs the supervisors of every registered service that sets service.restart,
+// until the agent receives SIGTERM or SIGINT. Services registered later need an agent restart.
+func RunAgent() error {
+	i18n.InitLanguage("")
+	log.Println(color.Cyan(i18n.T().AgentRunning))
+
+	configs, err := loadServiceConfigs()
+	if err != nil {
+		return err
+	}
+	supervisors := newSupervisors()
+	supervisors.reconcile(configs)
+	defer supervisors.stop()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.Print(color.Yellow(fmt.Sprintf("Received %s, no longer supervising. The services keep running.", sig)))
+	return nil
+}
@@ -22,6 +22,7 @@ func NewDeployCommand() *cobra.Command {
 			// 获取标志
 			dryRun, _ := cmd.Flags().GetBool("dry-run")
 			fromDir, _ := cmd.Flags().GetString("from-dir")
+			fromArchive, _ := cmd.Flags().GetString("from-archive")
 			beautify, _ := cmd.Flags().GetBool("beautify") // 获取美化界面标志
 
 			// 处理 --app 参数
@@ -37,6 +38,16 @@ func NewDeployCommand() *cobra.Command {
 				return
 			}
 
+			// 压缩包和源目录一样交给部署器，由它解压到版本目录
+			source := fromDir
+			if fromArchive != "" {
+				if !deployment.IsArchive(fromArchive) {
+					fmt.Println(color.Red(i18n.T().DeployInvalidArchive, fromArchive))
+					return
+				}
+				source = fromArchive
+			}
+
 			// 当用户在项目目录中直接运行 `revlay deploy` 时，
 			// 自动检查并添加服务到全局列表（如果尚未添加）
 			appID, _ := cmd.Flags().GetString("app")
@@ -93,7 +104,7 @@ func NewDeployCommand() *cobra.Command {
 			}
 
 			fmt.Println(color.Cyan(i18n.T().DeployInProgress))
-			if err := deployer.Deploy(releaseName, fromDir); err != nil {
+			if err := deployer.Deploy(releaseName, source); err != nil {
 				fmt.Println(color.Red(i18n.T().DeployFailed, err))
 				return
 			}
@@ -106,6 +117,8 @@ func NewDeployCommand() *cobra.Command {
 	// 标准的 deploy 标志
 	cmd.Flags().BoolP("dry-run", "d", false, i18n.T().DeployDryRunFlag)
 	cmd.Flags().String("from-dir", "", i18n.T().DeployFromDirFlag)
+	cmd.Flags().String("from-archive", "", i18n.T().DeployFromArchiveFlag)
+	cmd.MarkFlagsMutuallyExclusive("from-dir", "from-archive")
 	cmd.Flags().StringP("app", "a", "", "指定要部署的服务 ID（从全局服务列表中）")
 
 	// 添加美化界面选项
@@ -144,6 +157,23 @@ func runDeployDryRun(cfg *config.Config, releaseName string) error {
 			fmt.Printf("    - %s\n", hook)
 		}
 	}
+	for _, stage := range []struct {
+		name  string
+		hooks []string
+	}{
+		{"post_unpack", cfg.Hooks.PostUnpack},
+		{"after_start", cfg.Hooks.AfterStart},
+		{"before_switch", cfg.Hooks.BeforeSwitch},
+		{"after_switch", cfg.Hooks.AfterSwitch},
+		{"on_failure", cfg.Hooks.OnFailure},
+	} {
+		if len(stage.hooks) > 0 {
+			fmt.Println("  " + stage.name + ":")
+			for _, hook := range stage.hooks {
+				fmt.Printf("    - %s\n", hook)
+			}
+		}
+	}
 
 	fmt.Printf("\n" + i18n.Sprintf(i18n.T().DryRunKeepReleases, cfg.App.KeepReleases) + "\n")
 
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/xukonxe/revlay/internal/deployment"
+	"github.com/xukonxe/revlay/internal/i18n"
+)
+
+// NewHistoryCommand creates the `revlay history` command.
+func NewHistoryCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: i18n.T().HistoryShortDesc,
+		Long:  i18n.T().HistoryLongDesc,
+		Args:  cobra.NoArgs,
+		RunE:  runHistory,
+	}
+	cmd.Flags().StringP("app", "a", "", "指定要查看的服务 ID（从全局服务列表中）")
+	cmd.Flags().String("since", "", "只显示这之后的记录：时长（如 24h、7d）、日期（2006-01-02）或 RFC3339 时间")
+	cmd.Flags().String("output", "text", "输出格式 (text, json)")
+	return cmd
+}
+
+func runHistory(cmd *cobra.Command, args []string) error {
+	sinceFlag, _ := cmd.Flags().GetString("since")
+	since, err := parseSince(sinceFlag, time.Now())
+	if err != nil {
+		return err
+	}
+
+	cfgFile, err := resolveAppConfig(cmd)
+	if err != nil {
+		return err
+	}
+	cfg, err := loadConfig(cfgFile)
+	if err != nil {
+		return err
+	}
+
+	entries, err := deployment.NewLocalDeployer(cfg).History(since)
+	if err != nil {
+		return err
+	}
+
+	if outputFormat, _ := cmd.Flags().GetString("output"); outputFormat == "json" {
+		if entries == nil {
+			entries = []deployment.HistoryEntry{}
+		}
+		jsonOutput, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return fmt.Errorf("无法将历史记录转换为 JSON: %w", err)
+		}
+		fmt.Println(string(jsonOutput))
+		return nil
+	}
+
+	if len(entries) == 0 {
+		fmt.Println(i18n.T().HistoryNoEntries)
+		return nil
+	}
+
+	header := i18n.T().HistoryTableHeader
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	fmt.Fprintln(w, strings.Repeat("----\t", strings.Count(header, "\t"))+"----")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Local().Format("2006-01-02 15:04:05"), orDash(e.Actor), e.Operation,
+			orDash(e.Release), orDash(e.Live), e.Result, orDash(e.Error))
+	}
+	return w.Flush()
+}
+
+// parseSince 解析 --since：相对 now 的时长（支持 d 表示天）、本地日期或 RFC3339 时间
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf(i18n.T().HistoryInvalidSince, value)
+}
@@ -3,9 +3,18 @@ package cli
 import (
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/xukonxe/revlay/internal/color"
+	"github.com/xukonxe/revlay/internal/config"
 	"github.com/xukonxe/revlay/internal/proxy"
 )
 
@@ -13,39 +22,464 @@ import (
 func NewProxyCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "proxy",
-		Short: "Runs the built-in TCP proxy for zero-downtime deployments",
-		Long: `Runs the built-in TCP proxy.
-This command should be run as a persistent service (e.g., using systemd).
+		Short: "Runs the built-in proxy for zero-downtime deployments",
+		Long: `Runs the built-in proxy.
+This command should be run as a persistent service (e.g., using systemd,
+'revlay service install-unit' generates the unit files).
 It listens on the 'proxy_port' and forwards traffic to the active application port.
-It watches a state file for changes to perform seamless traffic switching.`,
+It watches a state file for changes to perform seamless traffic switching.
+In 'short_downtime' mode it always forwards to 'port' and, with
+'proxy.retry_window_seconds', holds clients while the service restarts.
+
+The proxy runs in 'tcp' mode by default. Set 'proxy.mode: http' in revlay.yml
+to parse HTTP requests, add X-Forwarded-* headers, write access logs and answer
+with an error page when the application is down.
+
+While running, the proxy accepts commands on a unix socket in the '.revlay'
+directory. Use the subcommands below to inspect or control it.
+
+SIGTERM or SIGINT stop accepting new connections and let open ones finish for
+up to --shutdown-timeout. SIGUSR2 (or 'revlay proxy upgrade') starts a new
+proxy process from the current revlay binary, hands it the listening sockets
+and then shuts down gracefully, so upgrading revlay does not drop traffic.
+
+With --all, one proxy process fronts every service registered with
+'revlay service add', each on its own 'proxy_port' and following its own
+state file. Services added or removed later are picked up automatically,
+along with their supervisors.
+Apps in 'http' mode may share a 'proxy_port' and are routed by 'proxy.hosts'.`,
 		RunE: runProxy,
 		Args: cobra.NoArgs,
 	}
+	cmd.PersistentFlags().StringP("app", "a", "", "指定服务 ID（从全局服务列表中）")
+	cmd.Flags().Bool("all", false, "Front every service in the global services list from one process")
+	cmd.Flags().Duration("shutdown-timeout", 30*time.Second, "How long to let open connections finish when shutting down")
+
+	cmd.AddCommand(newProxyStatusCommand())
+	cmd.AddCommand(newProxySwitchCommand())
+	cmd.AddCommand(newProxySplitCommand())
+	cmd.AddCommand(newProxyDrainCommand())
+	cmd.AddCommand(newProxyPauseCommand())
+	cmd.AddCommand(newProxyResumeCommand())
+	cmd.AddCommand(newProxyUpgradeCommand())
+	return cmd
+}
+
+func newProxyStatusCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "status",
+		Short: "Shows the target and open connections of the running proxy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newProxyControlClient(cmd)
+			if err != nil {
+				return err
+			}
+			status, err := client.Status()
+			if err != nil {
+				return fmt.Errorf("could not get proxy status: %w", err)
+			}
+			printProxyStatus(status)
+			return nil
+		},
+	}
+}
+
+func newProxySwitchCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "switch [port]",
+		Short: "Switches the running proxy to another local port",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			port, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid port '%s'", args[0])
+			}
+			client, err := newProxyControlClient(cmd)
+			if err != nil {
+				return err
+			}
+			status, err := client.Switch(port)
+			if err != nil {
+				return fmt.Errorf("could not switch proxy: %w", err)
+			}
+			fmt.Println(color.Green("Proxy now forwarding to %s", status.Target))
+			return nil
+		},
+	}
+}
+
+func newProxySplitCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "split [port=weight]...",
+		Short: "Splits new connections between several local ports by weight",
+		Long: `Splits new connections between several local ports by weight, e.g.
+
+  revlay proxy split 8080=95 8081=5
+
+The split is not persisted. 'revlay proxy switch' or a restart of the proxy
+sends all traffic to a single port again.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			targets := make([]proxy.Target, 0, len(args))
+			for _, arg := range args {
+				portStr, weightStr, ok := strings.Cut(arg, "=")
+				port, portErr := strconv.Atoi(portStr)
+				weight, weightErr := strconv.Atoi(weightStr)
+				if !ok || portErr != nil || weightErr != nil {
+					return fmt.Errorf("invalid target '%s', expected port=weight", arg)
+				}
+				targets = append(targets, proxy.LocalTarget(port, weight))
+			}
+			client, err := newProxyControlClient(cmd)
+			if err != nil {
+				return err
+			}
+			status, err := client.Split(targets)
+			if err != nil {
+				return fmt.Errorf("could not split traffic: %w", err)
+			}
+			printProxyStatus(status)
+			return nil
+		},
+	}
+}
+
+func newProxyDrainCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "drain [port]",
+		Short: "Waits until no connections are open to a local port",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			port, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("invalid port '%s'", args[0])
+			}
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			client, err := newProxyControlClient(cmd)
+			if err != nil {
+				return err
+			}
+			if _, err := client.Drain(port, timeout); err != nil {
+				return fmt.Errorf("drain of :%d did not finish: %w", port, err)
+			}
+			fmt.Println(color.Green("All connections on :%d have drained.", port))
+			return nil
+		},
+	}
+	cmd.Flags().Duration("timeout", 30*time.Second, "Maximum time to wait for connections to close")
+	return cmd
+}
+
+func newProxyPauseCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "pause",
+		Short: "Holds new connections in the running proxy until resume",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newProxyControlClient(cmd)
+			if err != nil {
+				return err
+			}
+			if _, err := client.Pause(); err != nil {
+				return fmt.Errorf("could not pause proxy: %w", err)
+			}
+			fmt.Println(color.Yellow("Proxy paused. New connections are held until 'revlay proxy resume'."))
+			return nil
+		},
+	}
+}
+
+func newProxyResumeCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "resume",
+		Short: "Releases connections held by a paused proxy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newProxyControlClient(cmd)
+			if err != nil {
+				return err
+			}
+			if _, err := client.Resume(); err != nil {
+				return fmt.Errorf("could not resume proxy: %w", err)
+			}
+			fmt.Println(color.Green("Proxy resumed."))
+			return nil
+		},
+	}
+}
+
+func newProxyUpgradeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "upgrade",
+		Short: "Restarts the running proxy from the current binary without dropping connections",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			client, err := newProxyControlClient(cmd)
+			if err != nil {
+				return err
+			}
+			status, err := client.Status()
+			if err != nil {
+				return fmt.Errorf("could not reach proxy: %w", err)
+			}
+			oldPID := status.PID
+			if err := syscall.Kill(oldPID, syscall.SIGUSR2); err != nil {
+				return fmt.Errorf("could not signal proxy process %d: %w", oldPID, err)
+			}
+
+			// The new process takes over the control socket, so its status reports a new pid.
+			deadline := time.Now().Add(timeout)
+			for time.Now().Before(deadline) {
+				time.Sleep(200 * time.Millisecond)
+				if status, err := client.Status(); err == nil && status.PID != oldPID {
+					fmt.Println(color.Green("Proxy upgraded, now running as process %d.", status.PID))
+					return nil
+				}
+			}
+			return fmt.Errorf("proxy did not report a new process within %s, check the proxy's log", timeout)
+		},
+	}
+	cmd.Flags().Duration("timeout", 30*time.Second, "Maximum time to wait for the new proxy process")
 	return cmd
 }
 
+// newProxyControlClient returns a client for the control socket of the app's proxy.
+func newProxyControlClient(cmd *cobra.Command) (*proxy.ControlClient, error) {
+	cfgFile, err := resolveAppConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadConfig(cfgFile)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.NewControlClient(cfg.GetProxySocketPath()), nil
+}
+
+func printProxyStatus(status *proxy.Status) {
+	state := color.Green("running")
+	if status.Paused {
+		state = color.Yellow("paused")
+	}
+	fmt.Printf("  - Listen: %s (%s mode)\n", status.ListenAddr, status.Mode)
+	fmt.Printf("  - State: %s\n", state)
+	if status.Split() {
+		for _, t := range status.Targets {
+			fmt.Printf("  - Target: %s (weight %d)\n", color.Cyan(t.Addr), t.Weight)
+		}
+	} else {
+		fmt.Printf("  - Target: %s\n", color.Cyan(status.Target))
+	}
+
+	addrs := make([]string, 0, len(status.Active))
+	for addr := range status.Active {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	if len(addrs) == 0 {
+		fmt.Println("  - Open connections: 0")
+	}
+	for _, addr := range addrs {
+		fmt.Printf("  - Open connections to %s: %d\n", addr, status.Active[addr])
+	}
+
+	addrs = addrs[:0]
+	for addr := range status.Stats {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		stats := status.Stats[addr]
+		fmt.Printf("  - Handled by %s: %d (%d errors)\n", addr, stats.Requests, stats.Errors)
+	}
+}
+
 func runProxy(cmd *cobra.Command, args []string) error {
-	cfgFile, _ := cmd.Flags().GetString("config")
+	if all, _ := cmd.Flags().GetBool("all"); all {
+		shutdownTimeout, _ := cmd.Flags().GetDuration("shutdown-timeout")
+		return runMultiProxy(shutdownTimeout)
+	}
+
+	cfgFile, err := resolveAppConfig(cmd)
+	if err != nil {
+		return err
+	}
 	cfg, err := loadConfig(cfgFile)
 	if err != nil {
 		return err
 	}
 
-	if cfg.Deploy.Mode != "zero_downtime" || cfg.Service.ProxyPort == 0 {
-		return fmt.Errorf("proxy command is only available for 'zero_downtime' mode with 'proxy_port' configured")
+	if cfg.Service.ProxyPort == 0 {
+		return fmt.Errorf("proxy command requires 'service.proxy_port' to be configured")
+	}
+	if cfg.Service.ProxyPort == cfg.Service.Port {
+		return fmt.Errorf("'service.proxy_port' must not be the same as 'service.port', the proxy would forward to itself")
 	}
 
 	log.Println(color.Cyan("Starting Revlay proxy..."))
 
-	stateFile := cfg.GetActivePortPath()
-	initialPort := cfg.Service.Port // Default to main port on first run
-
-	manager := proxy.NewManager(cfg.Service.ProxyPort, initialPort, stateFile)
+	spec := proxySpecFromConfig(cfg)
+	manager := proxy.NewManagerWithOptions(spec.ListenPort, spec.InitialPort, spec.StateFile, spec.Options)
+	supervisors := newSupervisors()
+	supervisors.reconcile(map[string]*config.Config{cfg.App.Name: cfg})
+	defer supervisors.stop()
+	shutdown := func(timeout time.Duration) {
+		supervisors.stop()
+		manager.Shutdown(timeout)
+	}
 
-	// This is a blocking call that runs the proxy server indefinitely.
-	if err := manager.Start(); err != nil {
+	// This is a blocking call that runs the proxy server until it is signalled to stop.
+	shutdownTimeout, _ := cmd.Flags().GetDuration("shutdown-timeout")
+	if err := serveProxy(manager.Start, manager.Ready(), shutdown, shutdownTimeout); err != nil {
 		return fmt.Errorf("failed to start proxy manager: %w", err)
 	}
 
 	return nil
 }
+
+// runMultiProxy fronts every service in the global services list from one process.
+func runMultiProxy(shutdownTimeout time.Duration) error {
+	log.Println(color.Cyan("Starting Revlay proxy for all registered services..."))
+
+	// Supervisors follow the services file like the proxies, on every reload.
+	supervisors := newSupervisors()
+	defer supervisors.stop()
+	load := func() (map[string]proxy.AppSpec, error) {
+		configs, err := loadServiceConfigs()
+		if err != nil {
+			return nil, err
+		}
+		supervisors.reconcile(configs)
+		return proxyApps(configs), nil
+	}
+	manager := proxy.NewMultiManager(load, config.GetServicesConfigPath(), shutdownTimeout)
+	shutdown := func(timeout time.Duration) {
+		supervisors.stop()
+		manager.Shutdown(timeout)
+	}
+
+	// This is a blocking call that runs the proxies until they are signalled to stop.
+	if err := serveProxy(manager.Start, manager.Ready(), shutdown, shutdownTimeout); err != nil {
+		return fmt.Errorf("failed to start proxy manager: %w", err)
+	}
+	return nil
+}
+
+// proxyHandoffTimeout bounds how long an upgraded proxy process may take to serve the handed over listeners.
+const proxyHandoffTimeout = 30 * time.Second
+
+// serveProxy runs start until it fails or a signal ends it. SIGTERM and SIGINT shut
+// the proxy down gracefully. SIGUSR2 first hands the listeners to a new proxy
+// process started from the current binary, then shuts down the same way.
+func serveProxy(start func() error, ready <-chan struct{}, shutdown func(time.Duration), shutdownTimeout time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+
+	// If this process was started by an upgrade, tell the old one when we serve everything.
+	go func() {
+		<-ready
+		proxy.NotifyReady()
+	}()
+
+	errs := make(chan error, 1)
+	go func() { errs <- start() }()
+
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGUSR2 {
+				log.Println(color.Cyan("Upgrading: handing listeners over to a new proxy process..."))
+				process, err := proxy.Handoff(proxyHandoffTimeout)
+				if err != nil {
+					log.Print(color.Red(fmt.Sprintf("Upgrade failed, this process keeps serving: %v", err)))
+					continue
+				}
+				log.Print(color.Green(fmt.Sprintf("New proxy process %d took over the listeners.", process.Pid)))
+			} else {
+				log.Print(color.Yellow(fmt.Sprintf("Received %s, shutting down...", sig)))
+			}
+			shutdown(shutdownTimeout)
+			return <-errs
+		}
+	}
+}
+
+// proxyApps returns the proxy spec of every service in configs that uses the proxy.
+func proxyApps(configs map[string]*config.Config) map[string]proxy.AppSpec {
+	specs := make(map[string]proxy.AppSpec)
+	for id, cfg := range configs {
+		if cfg.Service.ProxyPort == 0 {
+			continue
+		}
+		if cfg.Service.ProxyPort == cfg.Service.Port {
+			log.Print(color.Red(fmt.Sprintf("[%s] Skipping app, its proxy_port is the same as its port", id)))
+			continue
+		}
+		spec := proxySpecFromConfig(cfg)
+		spec.Options.Name = id
+		specs[id] = spec
+	}
+	return specs
+}
+
+// proxySpecFromConfig maps an app's revlay.yml to the settings of its proxy.
+func proxySpecFromConfig(cfg *config.Config) proxy.AppSpec {
+	opts := proxy.Options{
+		Mode:        proxy.Mode(cfg.Proxy.Mode),
+		Hosts:       cfg.Proxy.Hosts,
+		Name:        cfg.App.Name,
+		RetryWindow: time.Duration(cfg.Proxy.RetryWindow) * time.Second,
+		MetricsAddr: cfg.Proxy.MetricsAddr,
+	}
+	if cfg.Proxy.AccessLog != "" {
+		opts.AccessLog = resolveRootPath(cfg, cfg.Proxy.AccessLog)
+	}
+	if cfg.Proxy.HealthCheck.Interval > 0 {
+		opts.Health = &proxy.HealthOptions{
+			Path:               proxyHealthPath(cfg),
+			Interval:           time.Duration(cfg.Proxy.HealthCheck.Interval) * time.Second,
+			Timeout:            time.Duration(cfg.Service.HealthCheckTimeout) * time.Second,
+			UnhealthyThreshold: cfg.Proxy.HealthCheck.UnhealthyThreshold,
+		}
+		// Only blue/green deployments leave a second colour running to fail over to.
+		if cfg.Deploy.Mode == config.ZeroDowntimeMode && cfg.Service.AltPort > 0 {
+			opts.Health.FailoverPorts = []int{cfg.Service.Port, cfg.Service.AltPort}
+		}
+	}
+	for _, cert := range cfg.Proxy.TLS.Certificates {
+		opts.Certificates = append(opts.Certificates, proxy.CertificateFiles{
+			CertFile: resolveRootPath(cfg, cert.CertFile),
+			KeyFile:  resolveRootPath(cfg, cert.KeyFile),
+		})
+	}
+
+	return proxy.AppSpec{
+		ListenPort:  cfg.Service.ProxyPort,
+		InitialPort: cfg.Service.Port, // Default to main port on first run
+		StateFile:   cfg.GetActivePortPath(),
+		Options:     opts,
+	}
+}
+
+// proxyHealthPath returns the path the proxy probes on the backend. The proxy only speaks
+// plain HTTP, for other health checks it checks that the backend accepts connections.
+func proxyHealthPath(cfg *config.Config) string {
+	check := cfg.Service.HealthCheck
+	if check.Kind() != config.HTTPHealthCheck || check.HTTPS {
+		return ""
+	}
+	return check.Path
+}
+
+// resolveRootPath makes a path from revlay.yml absolute, relative to the app's root.
+func resolveRootPath(cfg *config.Config, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(cfg.RootPath, path)
+}
@@ -1,10 +1,15 @@
 package cli
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
-	"github.com/xukonxe/revlay/internal/color"
 	"github.com/xukonxe/revlay/internal/deployment"
 	"github.com/xukonxe/revlay/internal/i18n"
 )
@@ -18,6 +23,7 @@ func NewReleasesCommand() *cobra.Command {
 		RunE:  runReleases,
 	}
 	cmd.Flags().StringP("app", "a", "", "指定要查看的服务 ID（从全局服务列表中）")
+	cmd.Flags().String("output", "text", "输出格式 (text, json)")
 	return cmd
 }
 
@@ -39,21 +45,85 @@ func runReleases(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf(i18n.T().ErrorReleasesList, err)
 	}
 
-	if len(releases) == 0 {
+	outputFormat, _ := cmd.Flags().GetString("output")
+	if len(releases) == 0 && outputFormat != "json" {
 		fmt.Println(i18n.T().ReleasesNoReleases)
 		return nil
 	}
 
 	currentRelease, _ := deployer.GetCurrentRelease()
 
-	fmt.Println(i18n.T().ReleasesListHeader)
+	manifests := []*deployment.ReleaseManifest{}
 	for _, release := range releases {
-		if release == currentRelease {
-			fmt.Printf("  - %s%s\n", color.Green(release), color.Yellow(i18n.T().ReleasesCurrent))
-		} else {
-			fmt.Printf("  - %s\n", release)
+		manifest, err := deployer.ReleaseManifest(release)
+		if err != nil {
+			return err
 		}
+		manifests = append(manifests, manifest)
 	}
 
-	return nil
+	if outputFormat == "json" {
+		jsonOutput, err := json.MarshalIndent(manifests, "", "  ")
+		if err != nil {
+			return fmt.Errorf("无法将版本列表转换为 JSON: %w", err)
+		}
+		fmt.Println(string(jsonOutput))
+		return nil
+	}
+
+	// 使用 tabwriter 格式化输出，没有元数据的旧版本只显示名称
+	header := i18n.T().ReleasesTableHeader
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	fmt.Fprintln(w, strings.Repeat("----\t", strings.Count(header, "\t"))+"----")
+	for _, m := range manifests {
+		name := m.Name
+		if name == currentRelease {
+			name += i18n.T().ReleasesCurrent
+		}
+		deployed, size, duration, port := "-", "-", "-", "-"
+		if !m.StartedAt.IsZero() {
+			deployed = m.StartedAt.Local().Format("2006-01-02 15:04:05")
+			size = formatSize(m.SourceSize)
+		}
+		if !m.FinishedAt.IsZero() {
+			duration = (time.Duration(m.Duration * float64(time.Second))).Round(time.Second).String()
+		}
+		if m.Port != 0 {
+			port = strconv.Itoa(m.Port)
+		}
+		git := m.GitCommit
+		if len(git) > 8 {
+			git = git[:8]
+		}
+		if m.GitBranch != "" {
+			git = fmt.Sprintf("%s (%s)", git, m.GitBranch)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			name, orDash(string(m.Status)), deployed, orDash(m.DeployedBy), orDash(m.Host), orDash(git),
+			orDash(string(m.Mode)), port, size, duration, orDash(m.Error))
+	}
+	return w.Flush()
+}
+
+// orDash 把空值显示为 "-"
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatSize 以适合阅读的单位显示字节数
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
@@ -15,9 +15,13 @@ func NewRollbackCommand() *cobra.Command {
 		Use:   "rollback [release-name]",
 		Short: i18n.T().RollbackShortDesc,
 		Long:  i18n.T().RollbackLongDesc,
+		Args:  cobra.MaximumNArgs(1),
 		RunE:  runRollback,
 	}
 	cmd.Flags().StringP("app", "a", "", "指定要回滚的服务 ID（从全局服务列表中）")
+	cmd.Flags().Int("steps", 1, "按上线顺序往回退的版本数")
+	cmd.Flags().Bool("to-previous-live", false, "回滚到最近一个上线过且没有失败的版本")
+	cmd.MarkFlagsMutuallyExclusive("steps", "to-previous-live")
 	return cmd
 }
 
@@ -40,16 +44,17 @@ func runRollback(cmd *cobra.Command, args []string) error {
 		releaseName = args[0]
 	}
 
-	// If no release name is given, rollback to the previous one
+	// If no release name is given, go back through the releases in the order they were live
+	steps, _ := cmd.Flags().GetInt("steps")
+	toPreviousLive, _ := cmd.Flags().GetBool("to-previous-live")
+	if releaseName != "" && (cmd.Flags().Changed("steps") || toPreviousLive) {
+		return fmt.Errorf("a release name cannot be combined with --steps or --to-previous-live")
+	}
 	if releaseName == "" {
-		releases, err := deployer.ListReleases()
+		releaseName, err = deployer.RollbackTarget(steps, toPreviousLive)
 		if err != nil {
-			return fmt.Errorf(i18n.T().RollbackFailed, fmt.Sprintf("could not list releases to determine previous version: %v", err))
-		}
-		if len(releases) < 2 {
-			return fmt.Errorf(i18n.T().RollbackFailed, i18n.T().RollbackNoReleases)
+			return fmt.Errorf(i18n.T().RollbackFailed, err)
 		}
-		releaseName = releases[len(releases)-2] // The second to last one
 	}
 
 	fmt.Printf(i18n.T().RollbackToRelease, color.Yellow(releaseName))
@@ -60,6 +60,7 @@ func newRootCmd() *cobra.Command {
 	cmd.AddCommand(NewDeployCommand())
 	cmd.AddCommand(NewRollbackCommand())
 	cmd.AddCommand(NewReleasesCommand())
+	cmd.AddCommand(NewHistoryCommand())
 	cmd.AddCommand(NewStatusCommand())
 	cmd.AddCommand(NewPushCommand())
 	cmd.AddCommand(NewProxyCommand())   // Add the new proxy command
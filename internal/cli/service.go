@@ -16,6 +16,7 @@ import (
 	"github.com/xukonxe/revlay/internal/config"
 	"github.com/xukonxe/revlay/internal/deployment"
 	"github.com/xukonxe/revlay/internal/i18n"
+	"github.com/xukonxe/revlay/internal/supervisor"
 )
 
 // NewServiceCommand 创建服务管理命令
@@ -32,6 +33,8 @@ func NewServiceCommand() *cobra.Command {
 	cmd.AddCommand(newServiceListCommand())
 	cmd.AddCommand(NewServiceStartCommand())
 	cmd.AddCommand(NewServiceStopCommand())
+	cmd.AddCommand(newServiceInstallUnitCommand())
+	cmd.AddCommand(newServiceUninstallUnitCommand())
 
 	return cmd
 }
@@ -147,14 +150,15 @@ func newServiceListCommand() *cobra.Command {
 
 			// 使用 tabwriter 格式化输出
 			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-			fmt.Fprintln(w, "ID\t名称\t路径\t当前版本")
-			fmt.Fprintln(w, "----\t----\t----\t----")
+			fmt.Fprintln(w, "ID\t名称\t路径\t当前版本\t进程\t重启次数\t上次退出码")
+			fmt.Fprintln(w, "----\t----\t----\t----\t----\t----\t----")
 
 			for _, id := range serviceIDs {
 				service := services[id]
 
 				// 尝试获取当前版本
 				currentVersion := "未部署"
+				processes, restarts, lastExit := "-", "-", "-"
 				cfg, err := config.LoadConfig(filepath.Join(service.Root, "revlay.yml"))
 				if err == nil {
 					cfg.RootPath = service.Root
@@ -162,9 +166,12 @@ func newServiceListCommand() *cobra.Command {
 					if release, err := deployer.GetCurrentRelease(); err == nil && release != "" {
 						currentVersion = release
 					}
+					if statuses, err := supervisor.ReadState(cfg.GetSupervisorStatePath()); err == nil && len(statuses) > 0 {
+						processes, restarts, lastExit = summarizeProcesses(statuses)
+					}
 				}
 
-				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", id, service.Name, service.Root, currentVersion)
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", id, service.Name, service.Root, currentVersion, processes, restarts, lastExit)
 			}
 			w.Flush()
 
@@ -177,6 +184,34 @@ func newServiceListCommand() *cobra.Command {
 	return cmd
 }
 
+// summarizeProcesses 汇总 supervisor 记录的进程：各端口的状态、重启总次数和最近一次退出码
+func summarizeProcesses(statuses []supervisor.ProcessStatus) (string, string, string) {
+	var states []string
+	var restarts int
+	var lastExit *supervisor.ProcessStatus
+	for i, p := range statuses {
+		state := p.State
+		switch {
+		case p.State == supervisor.StateRunning && p.Alive():
+			state = fmt.Sprintf("%s (%d)", p.State, p.PID)
+		case p.State == supervisor.StateRunning:
+			// 记录中的进程已经不存在，说明 supervisor 没有在运行
+			state = "dead"
+		}
+		states = append(states, fmt.Sprintf(":%d %s", p.Port, state))
+		restarts += p.Restarts
+		if !p.ExitedAt.IsZero() && (lastExit == nil || p.ExitedAt.After(lastExit.ExitedAt)) {
+			lastExit = &statuses[i]
+		}
+	}
+
+	exit := "-"
+	if lastExit != nil {
+		exit = strconv.Itoa(lastExit.ExitCode)
+	}
+	return strings.Join(states, ", "), strconv.Itoa(restarts), exit
+}
+
 // NewServiceStartCommand 创建启动服务的命令
 func NewServiceStartCommand() *cobra.Command {
 	cmd := &cobra.Command{
@@ -227,24 +262,12 @@ func NewServiceStartCommand() *cobra.Command {
 			}
 
 			// 获取进程ID
-			pidPath := filepath.Join(cfg.RootPath, "pids", cfg.App.Name+".pid")
-			pidData, err := os.ReadFile(pidPath)
-			if err != nil {
+			record, err := deployer.ServiceProcess(cfg.Service.Port)
+			if err != nil || record == nil {
 				fmt.Println(color.Green(i18n.Sprintf("服务 '%s' 已启动，但无法读取进程ID。", id)))
 				return nil
 			}
-
-			parts := strings.Split(strings.TrimSpace(string(pidData)), ":")
-			if len(parts) != 2 {
-				fmt.Println(color.Green(i18n.Sprintf("服务 '%s' 已启动，但PID文件格式无效。", id)))
-				return nil
-			}
-
-			pid, err := strconv.Atoi(parts[0])
-			if err != nil {
-				fmt.Println(color.Green(i18n.Sprintf("服务 '%s' 已启动，但无法解析进程ID。", id)))
-				return nil
-			}
+			pid := record.PID
 
 			fmt.Println(color.Green(i18n.Sprintf(i18n.T().ServiceStartSuccess, id, pid)))
 			return nil
@@ -288,9 +311,8 @@ func NewServiceStopCommand() *cobra.Command {
 			// 停止服务
 			fmt.Println(color.Cyan(i18n.Sprintf(i18n.T().ServiceStopping, id)))
 
-			// 检查PID文件是否存在
-			pidPath := filepath.Join(cfg.RootPath, "pids", cfg.App.Name+".pid")
-			if _, err := os.Stat(pidPath); os.IsNotExist(err) {
+			// 检查服务进程是否在运行，配置了 stop_command 时即使找不到进程也交给它停止
+			if record, err := deployer.ServiceProcess(0); err == nil && record == nil && cfg.Service.StopCommand == "" {
 				fmt.Println(color.Yellow(i18n.Sprintf(i18n.T().ServiceStopNotRunning, id)))
 				return nil
 			}
@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/xukonxe/revlay/internal/color"
+	"github.com/xukonxe/revlay/internal/config"
+	"github.com/xukonxe/revlay/internal/systemd"
+)
+
+// newServiceInstallUnitCommand 创建为服务生成 systemd unit 文件的命令
+func newServiceInstallUnitCommand() *cobra.Command {
+	var runAs string
+	var printOnly bool
+
+	cmd := &cobra.Command{
+		Use:   "install-unit [id]",
+		Short: "为服务生成并安装 systemd unit 文件",
+		Long: `根据服务的 revlay.yml 生成 systemd unit 文件：
+  revlay-<id>.service        从 current 目录运行 start_command，重启策略取自 service.restart
+  revlay-<id>-proxy.service  运行 revlay proxy（仅在配置了 service.proxy_port 时生成）
+
+安装后执行 'systemctl daemon-reload'，再用 'systemctl enable --now <unit>' 启用。`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id := args[0]
+			cfg, err := loadServiceConfig(id)
+			if err != nil {
+				return err
+			}
+
+			binary, err := os.Executable()
+			if err != nil {
+				return fmt.Errorf("无法确定 revlay 可执行文件的路径: %w", err)
+			}
+			if resolved, err := filepath.EvalSymlinks(binary); err == nil {
+				binary = resolved
+			}
+			userUnit, _ := cmd.Flags().GetBool("user")
+			units := systemd.Units(cfg, id, systemd.Options{Binary: binary, RunAs: runAs, UserUnit: userUnit})
+
+			if printOnly {
+				for _, unit := range units {
+					fmt.Printf("# %s\n%s\n", unit.Name, unit.Content)
+				}
+				return nil
+			}
+
+			dir, err := unitDir(cmd)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("创建目录 '%s' 失败: %w", dir, err)
+			}
+			for _, unit := range units {
+				path := filepath.Join(dir, unit.Name)
+				if err := os.WriteFile(path, []byte(unit.Content), 0644); err != nil {
+					return fmt.Errorf("写入 unit 文件失败: %w", err)
+				}
+				fmt.Println(color.Green("✅ 已写入 %s", path))
+			}
+
+			systemctl(userUnit, "daemon-reload")
+			for _, unit := range units {
+				fmt.Printf("使用 'systemctl%s enable --now %s' 启用并启动。\n", userFlag(userUnit), unit.Name)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("user", false, "安装为当前用户的 systemd unit（~/.config/systemd/user）")
+	cmd.Flags().String("dir", "", "unit 文件的安装目录（默认 /etc/systemd/system）")
+	cmd.Flags().StringVar(&runAs, "run-as", "", "以指定用户运行服务（设置 User=）")
+	cmd.Flags().BoolVar(&printOnly, "print", false, "只打印 unit 文件内容，不安装")
+
+	return cmd
+}
+
+// newServiceUninstallUnitCommand 创建删除服务 systemd unit 文件的命令
+func newServiceUninstallUnitCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "uninstall-unit [id]",
+		Short: "停用并删除服务的 systemd unit 文件",
+		Long:  "停用并停止 install-unit 安装的 unit，然后删除 unit 文件。",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			id := args[0]
+			dir, err := unitDir(cmd)
+			if err != nil {
+				return err
+			}
+			userUnit, _ := cmd.Flags().GetBool("user")
+
+			removed := 0
+			for _, name := range []string{systemd.ProxyUnitName(id), systemd.AppUnitName(id)} {
+				path := filepath.Join(dir, name)
+				if _, err := os.Stat(path); os.IsNotExist(err) {
+					continue
+				}
+				systemctl(userUnit, "disable", "--now", name)
+				if err := os.Remove(path); err != nil {
+					return fmt.Errorf("删除 unit 文件失败: %w", err)
+				}
+				fmt.Println(color.Green("✅ 已删除 %s", path))
+				removed++
+			}
+			if removed == 0 {
+				fmt.Println(color.Yellow("⚠️ 在 '%s' 中没有找到服务 '%s' 的 unit 文件。", dir, id))
+				return nil
+			}
+
+			systemctl(userUnit, "daemon-reload")
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("user", false, "删除当前用户的 systemd unit（~/.config/systemd/user）")
+	cmd.Flags().String("dir", "", "unit 文件的安装目录（默认 /etc/systemd/system）")
+
+	return cmd
+}
+
+// loadServiceConfig 加载全局服务列表中指定服务的配置
+func loadServiceConfig(id string) (*config.Config, error) {
+	service, err := config.GetService(id)
+	if err != nil {
+		return nil, fmt.Errorf("获取服务失败: %w", err)
+	}
+	cfg, err := config.LoadConfig(filepath.Join(service.Root, "revlay.yml"))
+	if err != nil {
+		return nil, fmt.Errorf("加载服务配置失败: %w", err)
+	}
+	cfg.RootPath = service.Root
+	return cfg, nil
+}
+
+// unitDir 返回 unit 文件的安装目录
+func unitDir(cmd *cobra.Command) (string, error) {
+	if dir, _ := cmd.Flags().GetString("dir"); dir != "" {
+		return dir, nil
+	}
+	if userUnit, _ := cmd.Flags().GetBool("user"); userUnit {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("无法确定用户配置目录: %w", err)
+		}
+		return filepath.Join(configDir, "systemd", "user"), nil
+	}
+	return "/etc/systemd/system", nil
+}
+
+// systemctl 运行 systemctl 命令，失败时只给出警告，没有 systemd 的环境下也能安装 unit 文件
+func systemctl(userUnit bool, args ...string) {
+	if userUnit {
+		args = append([]string{"--user"}, args...)
+	}
+	if output, err := exec.Command("systemctl", args...).CombinedOutput(); err != nil {
+		fmt.Println(color.Yellow("⚠️ systemctl %s 失败: %v %s", strings.Join(args, " "), err, strings.TrimSpace(string(output))))
+	}
+}
+
+func userFlag(userUnit bool) string {
+	if userUnit {
+		return " --user"
+	}
+	return ""
+}
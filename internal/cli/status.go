@@ -3,11 +3,14 @@ package cli
 import (
 	"fmt"
 	"os/exec"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/xukonxe/revlay/internal/color"
+	"github.com/xukonxe/revlay/internal/config"
 	"github.com/xukonxe/revlay/internal/deployment"
 	"github.com/xukonxe/revlay/internal/i18n"
+	"github.com/xukonxe/revlay/internal/proxy"
 )
 
 // NewStatusCommand creates the `revlay status` command.
@@ -48,6 +51,27 @@ func runStatus(cmd *cobra.Command, args []string) error {
 		fmt.Printf("  - Status: %s\n", color.Green(i18n.T().StatusActive))
 		fmt.Printf(i18n.T().StatusCurrentRelease+"\n", color.Cyan(currentRelease))
 	}
+	ports := []int{cfg.Service.Port}
+	if cfg.Deploy.Mode == config.ZeroDowntimeMode {
+		ports = append(ports, cfg.Service.AltPort)
+	}
+	for _, port := range ports {
+		record, err := deployer.ServiceProcess(port)
+		if err != nil || record == nil {
+			fmt.Printf(i18n.T().StatusNoProcess+"\n", port)
+			continue
+		}
+		release := record.Release
+		if release == "" {
+			release = "-"
+		}
+		fmt.Printf(i18n.T().StatusProcess+"\n", port, record.PID, release, record.Source)
+	}
+	// The record is removed by the next deployment that switches traffic.
+	if failover, err := proxy.ReadFailoverRecord(cfg.GetFailoverPath()); err == nil {
+		fmt.Println(color.Red(fmt.Sprintf(i18n.T().StatusFailover, failover.Time.Format(time.RFC3339), failover.FromPort, failover.ToPort)))
+		fmt.Printf(i18n.T().StatusFailoverReason+"\n", failover.Reason)
+	}
 
 	fmt.Println("\n" + i18n.T().StatusDirectoryDetails)
 	lsCmd := exec.Command("ls", "-l", cfg.RootPath)
@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/color"
+	"github.com/xukonxe/revlay/internal/config"
+	"github.com/xukonxe/revlay/internal/proxy"
+	"github.com/xukonxe/revlay/internal/supervisor"
+)
+
+// loadServiceConfigs loads the revlay.yml of every registered service, keyed by service ID.
+func loadServiceConfigs() (map[string]*config.Config, error) {
+	services, err := config.ListServices()
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make(map[string]*config.Config)
+	for id, service := range services {
+		cfg, err := config.LoadConfig(filepath.Join(service.Root, "revlay.yml"))
+		if err != nil {
+			log.Print(color.Yellow(fmt.Sprintf("[%s] Skipping app, could not load its config: %v", id, err)))
+			continue
+		}
+		cfg.RootPath = service.Root
+		configs[id] = cfg
+	}
+	return configs, nil
+}
+
+// supervisors runs a supervisor for every app that sets service.restart, serving
+// its socket in the app's .revlay directory. Stopping a supervisor leaves its app
+// running, the app is adopted by the next supervisor for it.
+type supervisors struct {
+	mu      sync.Mutex
+	running map[string]*runningSupervisor
+	stopped bool
+}
+
+type runningSupervisor struct {
+	socketPath string
+	stateFile  string
+	opts       supervisor.Options
+	close      func()
+}
+
+func newSupervisors() *supervisors {
+	return &supervisors{running: make(map[string]*runningSupervisor)}
+}
+
+// reconcile makes the running supervisors match apps: apps that are new or set
+// service.restart get a supervisor, removed apps and apps without a restart policy
+// lose theirs, and apps whose restart settings changed get a new one.
+func (s *supervisors) reconcile(apps map[string]*config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+
+	for id, running := range s.running {
+		cfg, ok := apps[id]
+		if ok && cfg.Service.Restart != "" && running.socketPath == cfg.GetSupervisorSocketPath() &&
+			running.stateFile == cfg.GetSupervisorStatePath() && running.opts == supervisorOptions(cfg) {
+			continue
+		}
+		if ok && cfg.Service.Restart != "" {
+			log.Print(color.Cyan(fmt.Sprintf("[%s] Restart settings changed, restarting the app's supervisor", id)))
+		} else {
+			log.Print(color.Yellow(fmt.Sprintf("[%s] No longer supervising the app, it keeps running", id)))
+		}
+		running.close()
+		delete(s.running, id)
+	}
+
+	ids := make([]string, 0, len(apps))
+	for id := range apps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		cfg := apps[id]
+		if _, ok := s.running[id]; ok || cfg.Service.Restart == "" {
+			continue
+		}
+		if err := os.MkdirAll(cfg.GetStatePath(), 0755); err != nil {
+			log.Print(color.Yellow(fmt.Sprintf("[%s] Not supervising the app: %v", id, err)))
+			continue
+		}
+		// The socket is handed over with the proxy's listeners on upgrade.
+		listener, err := proxy.ListenUnix(cfg.GetSupervisorSocketPath())
+		if err != nil {
+			log.Print(color.Yellow(fmt.Sprintf("[%s] Not supervising the app: %v", id, err)))
+			continue
+		}
+		opts := supervisorOptions(cfg)
+		sv := supervisor.New(cfg.GetSupervisorStatePath(), opts)
+		go sv.Serve(listener)
+		log.Print(color.Cyan(fmt.Sprintf("[%s] Supervising the app with restart policy '%s'", id, cfg.Service.Restart)))
+		s.running[id] = &runningSupervisor{
+			socketPath: cfg.GetSupervisorSocketPath(),
+			stateFile:  cfg.GetSupervisorStatePath(),
+			opts:       opts,
+			close: func() {
+				listener.Close()
+				sv.Close()
+			},
+		}
+	}
+}
+
+// stop stops every supervisor, later calls to reconcile do nothing. It may be called more than once.
+func (s *supervisors) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for id, running := range s.running {
+		running.close()
+		delete(s.running, id)
+	}
+}
+
+// supervisorOptions maps an app's revlay.yml to the settings of its supervisor.
+func supervisorOptions(cfg *config.Config) supervisor.Options {
+	return supervisor.Options{
+		Restart:       supervisor.Policy(cfg.Service.Restart),
+		MaxRestarts:   cfg.Service.MaxRestarts,
+		RestartWindow: time.Duration(cfg.Service.RestartWindow) * time.Second,
+		StopTimeout:   time.Duration(cfg.Service.GracefulTimeout) * time.Second,
+	}
+}
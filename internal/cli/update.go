@@ -10,6 +10,7 @@ import (
 	"github.com/rhysd/go-github-selfupdate/selfupdate"
 	"github.com/spf13/cobra"
 	"github.com/xukonxe/revlay/internal/color"
+	"github.com/xukonxe/revlay/internal/deployment"
 )
 
 // version 变量将由 GoReleaser 注入。
@@ -18,6 +19,7 @@ var version string
 // SetVersion 允许 main 包设置版本号。
 func SetVersion(v string) {
 	version = v
+	deployment.SetVersion(v)
 }
 
 // GetVersion 返回当前应用程序的版本号。
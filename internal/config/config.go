@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 
 	"gopkg.in/yaml.v3"
 )
@@ -18,6 +19,113 @@ const (
 	ShortDowntimeMode DeploymentMode = "short_downtime"
 )
 
+// ProxyMode represents how the built-in proxy handles traffic
+type ProxyMode string
+
+const (
+	// TCPProxyMode splices raw TCP streams between client and backend
+	TCPProxyMode ProxyMode = "tcp"
+	// HTTPProxyMode parses HTTP requests, adds forwarding headers and writes access logs
+	HTTPProxyMode ProxyMode = "http"
+)
+
+// TLSCertificate is a PEM encoded certificate and private key used by the proxy
+type TLSCertificate struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// HealthCheckType selects how a started service is checked before it receives traffic
+type HealthCheckType string
+
+const (
+	// HTTPHealthCheck sends a request to the service and checks the response
+	HTTPHealthCheck HealthCheckType = "http"
+	// TCPHealthCheck only checks that the service accepts connections on its port
+	TCPHealthCheck HealthCheckType = "tcp"
+	// ExecHealthCheck runs a command, the service is healthy when it exits with status 0
+	ExecHealthCheck HealthCheckType = "exec"
+	// NoHealthCheck considers the service healthy as soon as it is started
+	NoHealthCheck HealthCheckType = "none"
+)
+
+// HealthCheck describes how a service is checked. In revlay.yml it is either a block
+// with a type or, as before, just the path of an http health check.
+type HealthCheck struct {
+	// Type is http (default), tcp, exec or none
+	Type HealthCheckType `yaml:"type,omitempty"`
+	// Path requested by the http check, e.g. /health
+	Path string `yaml:"path,omitempty"`
+	// Method of the http request, default GET
+	Method string `yaml:"method,omitempty"`
+	// HTTPS sends the request over TLS without verifying the certificate
+	HTTPS bool `yaml:"https,omitempty"`
+	// Headers added to the http request
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// ExpectedStatus lists the accepted status codes, empty accepts any 2xx or 3xx
+	ExpectedStatus []int `yaml:"expected_status,omitempty"`
+	// BodyContains must be part of the response body
+	BodyContains string `yaml:"body_contains,omitempty"`
+	// BodyRegex must match the response body
+	BodyRegex string `yaml:"body_regex,omitempty"`
+	// Command run by the exec check with sh -c, PORT is set to the port being checked
+	Command string `yaml:"command,omitempty"`
+}
+
+// healthCheckFields has the fields of HealthCheck without its YAML methods
+type healthCheckFields HealthCheck
+
+// UnmarshalYAML accepts a plain path as an http health check
+func (h *HealthCheck) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*h = HealthCheck{Type: HTTPHealthCheck, Path: value.Value}
+		return nil
+	}
+	return value.Decode((*healthCheckFields)(h))
+}
+
+// MarshalYAML writes an http health check with only a path in the short form
+func (h HealthCheck) MarshalYAML() (interface{}, error) {
+	if h.Kind() == HTTPHealthCheck && h.Method == "" && !h.HTTPS && len(h.Headers) == 0 &&
+		len(h.ExpectedStatus) == 0 && h.BodyContains == "" && h.BodyRegex == "" && h.Command == "" {
+		return h.Path, nil
+	}
+	return healthCheckFields(h), nil
+}
+
+// Kind returns the type of the health check, http when it is not set
+func (h HealthCheck) Kind() HealthCheckType {
+	if h.Type == "" {
+		return HTTPHealthCheck
+	}
+	return h.Type
+}
+
+// Validate checks the health check configuration
+func (h HealthCheck) Validate() error {
+	switch h.Kind() {
+	case HTTPHealthCheck:
+		for _, code := range h.ExpectedStatus {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("service.health_check.expected_status contains invalid status code %d", code)
+			}
+		}
+		if h.BodyRegex != "" {
+			if _, err := regexp.Compile(h.BodyRegex); err != nil {
+				return fmt.Errorf("invalid service.health_check.body_regex: %w", err)
+			}
+		}
+	case ExecHealthCheck:
+		if h.Command == "" {
+			return fmt.Errorf("service.health_check.command is required for the exec health check")
+		}
+	case TCPHealthCheck, NoHealthCheck:
+	default:
+		return fmt.Errorf("invalid service.health_check.type '%s', must be 'http', 'tcp', 'exec' or 'none'", h.Type)
+	}
+	return nil
+}
+
 // Config represents the main configuration structure for revlay.yml
 type Config struct {
 	// RootPath is the directory containing the revlay.yml file. It's set at runtime.
@@ -35,6 +143,28 @@ type Config struct {
 		Mode        DeploymentMode    `yaml:"mode"`
 		SharedFiles []string          `yaml:"shared_files"`
 		SharedDirs  []string          `yaml:"shared_dirs"`
+		// Hardlink files that are unchanged since the current release instead of copying them.
+		// Linked files are shared by both releases, so they must not be modified in place
+		HardlinkUnchanged bool `yaml:"hardlink_unchanged"`
+		// Progressive traffic shifting for zero_downtime mode, disabled when steps is empty
+		Canary struct {
+			// Percentages of traffic sent to the new release, e.g. [5, 25, 50, 100]
+			Steps []int `yaml:"steps"`
+			// How long each step is observed before moving on, in seconds
+			StepInterval int `yaml:"step_interval_seconds"`
+			// Error rate of the new release, in percent, that rolls the deployment back
+			MaxErrorRate float64 `yaml:"max_error_rate"`
+		} `yaml:"canary"`
+		// Observation of the new release after traffic is switched in zero_downtime mode.
+		// The old release keeps running meanwhile and gets the traffic back if the new one fails
+		Verify struct {
+			// How long the new release is observed, in seconds, 0 disables verification
+			Duration int `yaml:"duration_seconds"`
+			// Seconds between health checks, default service.health_check_interval_seconds
+			Interval int `yaml:"interval_seconds"`
+			// Consecutive failed health checks that fail verification, default 3
+			FailureThreshold int `yaml:"failure_threshold"`
+		} `yaml:"verify"`
 	} `yaml:"deploy"`
 
 	// Service management configuration
@@ -49,8 +179,8 @@ type Config struct {
 		AltPort int `yaml:"alt_port"`
 		// Proxy port that listens to public traffic
 		ProxyPort int `yaml:"proxy_port"`
-		// Health check URL path
-		HealthCheck string `yaml:"health_check"`
+		// Health check run before the service receives traffic
+		HealthCheck HealthCheck `yaml:"health_check"`
 		// Graceful shutdown timeout in seconds
 		GracefulTimeout int `yaml:"graceful_timeout"`
 		// Startup confirmation delay in seconds
@@ -67,14 +197,62 @@ type Config struct {
 		StdoutLog string `yaml:"stdout_log"`
 		// Stderr log path
 		StderrLog string `yaml:"stderr_log"`
+		// Restart policy under a supervisor: always, on-failure or never, empty runs the service unsupervised
+		Restart string `yaml:"restart"`
+		// Restarts within restart_window_seconds after which a crash looping service is given up
+		MaxRestarts int `yaml:"max_restarts"`
+		// Window in seconds in which restarts are counted
+		RestartWindow int `yaml:"restart_window_seconds"`
 	} `yaml:"service"`
 
-	// Hooks configuration
+	// Built-in proxy configuration
+	Proxy struct {
+		// Proxy mode, 'tcp' or 'http'
+		Mode ProxyMode `yaml:"mode"`
+		// Access log path for http mode, empty logs to stdout
+		AccessLog string `yaml:"access_log"`
+		// Host names served in http mode, empty accepts any host
+		Hosts []string `yaml:"hosts"`
+		// Seconds new connections are held while the backend cannot be reached, 0 fails them at once
+		RetryWindow int `yaml:"retry_window_seconds"`
+		// Address serving Prometheus metrics at /metrics, e.g. 127.0.0.1:9101, empty disables it
+		MetricsAddr string `yaml:"metrics_addr"`
+		// Active health checking of the backend with service.health_check,
+		// failing over to the other colour in zero_downtime mode
+		HealthCheck struct {
+			// Seconds between probes, 0 disables active health checking
+			Interval int `yaml:"interval_seconds"`
+			// Failed probes in a row before the backend counts as down
+			UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+		} `yaml:"health_check"`
+		// TLS termination on proxy_port, disabled when no certificates are set
+		TLS struct {
+			// Certificates selected by SNI, the first one also serves clients without SNI
+			Certificates []TLSCertificate `yaml:"certificates"`
+		} `yaml:"tls"`
+	} `yaml:"proxy"`
+
+	// Hooks configuration, every hook is run with sh -c
 	Hooks struct {
 		PreDeploy    []string `yaml:"pre_deploy"`
 		PostDeploy   []string `yaml:"post_deploy"`
 		PreRollback  []string `yaml:"pre_rollback"`
 		PostRollback []string `yaml:"post_rollback"`
+		// After the release is unpacked and shared paths are linked, before it is started
+		PostUnpack []string `yaml:"post_unpack"`
+		// After the new release is started and has passed its health check,
+		// in zero_downtime mode before it receives traffic
+		AfterStart []string `yaml:"after_start"`
+		// Right before traffic or the current symlink is switched to the new release
+		BeforeSwitch []string `yaml:"before_switch"`
+		// Right after traffic or the current symlink is switched
+		AfterSwitch []string `yaml:"after_switch"`
+		// When a deployment or rollback fails, REVLAY_ERROR holds the reason
+		OnFailure []string `yaml:"on_failure"`
+		// Seconds each hook may run before it is killed
+		Timeout int `yaml:"timeout_seconds"`
+		// Working directory of the hooks relative to the new release, empty runs them in the release
+		WorkingDir string `yaml:"working_dir"`
 	} `yaml:"hooks"`
 }
 
@@ -89,10 +267,21 @@ func DefaultConfig() *Config {
 			KeepReleases: 5,
 		},
 		Deploy: struct {
-			Environment map[string]string `yaml:"environment"`
-			Mode        DeploymentMode    `yaml:"mode"`
-			SharedFiles []string          `yaml:"shared_files"`
-			SharedDirs  []string          `yaml:"shared_dirs"`
+			Environment       map[string]string `yaml:"environment"`
+			Mode              DeploymentMode    `yaml:"mode"`
+			SharedFiles       []string          `yaml:"shared_files"`
+			SharedDirs        []string          `yaml:"shared_dirs"`
+			HardlinkUnchanged bool              `yaml:"hardlink_unchanged"`
+			Canary            struct {
+				Steps        []int   `yaml:"steps"`
+				StepInterval int     `yaml:"step_interval_seconds"`
+				MaxErrorRate float64 `yaml:"max_error_rate"`
+			} `yaml:"canary"`
+			Verify struct {
+				Duration         int `yaml:"duration_seconds"`
+				Interval         int `yaml:"interval_seconds"`
+				FailureThreshold int `yaml:"failure_threshold"`
+			} `yaml:"verify"`
 		}{
 			Environment: map[string]string{
 				"NODE_ENV": "production",
@@ -102,27 +291,30 @@ func DefaultConfig() *Config {
 			SharedDirs:  []string{},
 		},
 		Service: struct {
-			StartCommand        string `yaml:"start_command"`
-			StopCommand         string `yaml:"stop_command"`
-			Port                int    `yaml:"port"`
-			AltPort             int    `yaml:"alt_port"`
-			ProxyPort           int    `yaml:"proxy_port"`
-			HealthCheck         string `yaml:"health_check"`
-			GracefulTimeout     int    `yaml:"graceful_timeout"`
-			StartupDelay        int    `yaml:"startup_delay"`
-			HealthCheckRetries  int    `yaml:"health_check_retries"`
-			HealthCheckTimeout  int    `yaml:"health_check_timeout_seconds"`
-			HealthCheckInterval int    `yaml:"health_check_interval_seconds"`
-			PidFile             string `yaml:"pid_file"`
-			StdoutLog           string `yaml:"stdout_log"`
-			StderrLog           string `yaml:"stderr_log"`
+			StartCommand        string      `yaml:"start_command"`
+			StopCommand         string      `yaml:"stop_command"`
+			Port                int         `yaml:"port"`
+			AltPort             int         `yaml:"alt_port"`
+			ProxyPort           int         `yaml:"proxy_port"`
+			HealthCheck         HealthCheck `yaml:"health_check"`
+			GracefulTimeout     int         `yaml:"graceful_timeout"`
+			StartupDelay        int         `yaml:"startup_delay"`
+			HealthCheckRetries  int         `yaml:"health_check_retries"`
+			HealthCheckTimeout  int         `yaml:"health_check_timeout_seconds"`
+			HealthCheckInterval int         `yaml:"health_check_interval_seconds"`
+			PidFile             string      `yaml:"pid_file"`
+			StdoutLog           string      `yaml:"stdout_log"`
+			StderrLog           string      `yaml:"stderr_log"`
+			Restart             string      `yaml:"restart"`
+			MaxRestarts         int         `yaml:"max_restarts"`
+			RestartWindow       int         `yaml:"restart_window_seconds"`
 		}{
 			StartCommand:        "",
 			StopCommand:         "",
 			Port:                8080,
 			AltPort:             8081,
 			ProxyPort:           80,
-			HealthCheck:         "/health",
+			HealthCheck:         HealthCheck{Type: HTTPHealthCheck, Path: "/health"},
 			GracefulTimeout:     30,
 			StartupDelay:        10,
 			HealthCheckRetries:  15,
@@ -131,17 +323,52 @@ func DefaultConfig() *Config {
 			PidFile:             "pids/{{.AppName}}.pid",
 			StdoutLog:           "logs/{{.AppName}}-output.log",
 			StderrLog:           "logs/{{.AppName}}-error.log",
+			MaxRestarts:         5,
+			RestartWindow:       300,
+		},
+		Proxy: struct {
+			Mode        ProxyMode `yaml:"mode"`
+			AccessLog   string    `yaml:"access_log"`
+			Hosts       []string  `yaml:"hosts"`
+			RetryWindow int       `yaml:"retry_window_seconds"`
+			MetricsAddr string    `yaml:"metrics_addr"`
+			HealthCheck struct {
+				Interval           int `yaml:"interval_seconds"`
+				UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+			} `yaml:"health_check"`
+			TLS struct {
+				Certificates []TLSCertificate `yaml:"certificates"`
+			} `yaml:"tls"`
+		}{
+			Mode:      TCPProxyMode,
+			AccessLog: "logs/access.log",
+			Hosts:     []string{},
+			HealthCheck: struct {
+				Interval           int `yaml:"interval_seconds"`
+				UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+			}{
+				Interval:           10,
+				UnhealthyThreshold: 3,
+			},
 		},
 		Hooks: struct {
 			PreDeploy    []string `yaml:"pre_deploy"`
 			PostDeploy   []string `yaml:"post_deploy"`
 			PreRollback  []string `yaml:"pre_rollback"`
 			PostRollback []string `yaml:"post_rollback"`
+			PostUnpack   []string `yaml:"post_unpack"`
+			AfterStart   []string `yaml:"after_start"`
+			BeforeSwitch []string `yaml:"before_switch"`
+			AfterSwitch  []string `yaml:"after_switch"`
+			OnFailure    []string `yaml:"on_failure"`
+			Timeout      int      `yaml:"timeout_seconds"`
+			WorkingDir   string   `yaml:"working_dir"`
 		}{
 			PreDeploy:    []string{},
 			PostDeploy:   []string{"systemctl reload nginx"},
 			PreRollback:  []string{},
 			PostRollback: []string{"systemctl reload nginx"},
+			Timeout:      300,
 		},
 	}
 }
@@ -202,6 +429,55 @@ func (c *Config) Validate() error {
 		c.Deploy.Mode = ZeroDowntimeMode
 	}
 
+	prevStep := 0
+	for _, step := range c.Deploy.Canary.Steps {
+		if step <= prevStep || step > 100 {
+			return fmt.Errorf("deploy.canary.steps must be increasing percentages between 1 and 100")
+		}
+		prevStep = step
+	}
+	if c.Deploy.Canary.StepInterval < 0 || c.Deploy.Canary.MaxErrorRate < 0 {
+		return fmt.Errorf("deploy.canary.step_interval_seconds and max_error_rate must not be negative")
+	}
+	if c.Hooks.Timeout < 0 {
+		return fmt.Errorf("hooks.timeout_seconds must not be negative")
+	}
+	if filepath.IsAbs(c.Hooks.WorkingDir) {
+		return fmt.Errorf("hooks.working_dir must be relative to the release")
+	}
+	if c.Deploy.Verify.Duration < 0 || c.Deploy.Verify.Interval < 0 || c.Deploy.Verify.FailureThreshold < 0 {
+		return fmt.Errorf("deploy.verify.duration_seconds, interval_seconds and failure_threshold must not be negative")
+	}
+
+	if c.Proxy.Mode != "" && c.Proxy.Mode != TCPProxyMode && c.Proxy.Mode != HTTPProxyMode {
+		return fmt.Errorf("proxy.mode must be 'tcp' or 'http'")
+	}
+	if c.Proxy.Mode == "" {
+		c.Proxy.Mode = TCPProxyMode
+	}
+	switch c.Service.Restart {
+	case "", "always", "on-failure", "never":
+	default:
+		return fmt.Errorf("invalid service.restart '%s', must be 'always', 'on-failure' or 'never'", c.Service.Restart)
+	}
+	if err := c.Service.HealthCheck.Validate(); err != nil {
+		return err
+	}
+	if c.Service.MaxRestarts < 0 || c.Service.RestartWindow < 0 {
+		return fmt.Errorf("service.max_restarts and service.restart_window_seconds must not be negative")
+	}
+	if c.Proxy.RetryWindow < 0 {
+		return fmt.Errorf("proxy.retry_window_seconds must not be negative")
+	}
+	if c.Proxy.HealthCheck.Interval < 0 || c.Proxy.HealthCheck.UnhealthyThreshold < 0 {
+		return fmt.Errorf("proxy.health_check interval_seconds and unhealthy_threshold must not be negative")
+	}
+	for i, cert := range c.Proxy.TLS.Certificates {
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			return fmt.Errorf("proxy.tls.certificates[%d] requires both cert_file and key_file", i)
+		}
+	}
+
 	// Validate service configuration for zero downtime mode
 	if c.Deploy.Mode == ZeroDowntimeMode {
 		if c.Service.Port <= 0 || c.Service.Port > 65535 {
@@ -234,6 +510,36 @@ func (c *Config) GetActivePortPath() string {
 	return filepath.Join(c.GetStatePath(), "active_port")
 }
 
+// GetHistoryPath returns the path to the append-only log of deployments, rollbacks and service starts/stops
+func (c *Config) GetHistoryPath() string {
+	return filepath.Join(c.GetStatePath(), "history.jsonl")
+}
+
+// GetDrainStatePath returns the path to the file where the proxy publishes open connections per backend
+func (c *Config) GetDrainStatePath() string {
+	return filepath.Join(c.GetStatePath(), "connections.json")
+}
+
+// GetFailoverPath returns the path to the file where the proxy records its last automatic failover
+func (c *Config) GetFailoverPath() string {
+	return filepath.Join(c.GetStatePath(), "failover.json")
+}
+
+// GetSupervisorSocketPath returns the path to the socket of the supervisor running the service
+func (c *Config) GetSupervisorSocketPath() string {
+	return filepath.Join(c.GetStatePath(), "supervisor.sock")
+}
+
+// GetSupervisorStatePath returns the path to the file where the supervisor records its processes
+func (c *Config) GetSupervisorStatePath() string {
+	return filepath.Join(c.GetStatePath(), "supervisor.json")
+}
+
+// GetProxySocketPath returns the path to the proxy's control socket
+func (c *Config) GetProxySocketPath() string {
+	return filepath.Join(c.GetStatePath(), "proxy.sock")
+}
+
 // GetReleasesPath returns the path to the releases directory
 func (c *Config) GetReleasesPath() string {
 	return filepath.Join(c.RootPath, "releases")
@@ -249,6 +555,11 @@ func (c *Config) GetPidsPath() string {
 	return filepath.Join(c.RootPath, "pids")
 }
 
+// GetProcessRecordPath returns the path to the record of the process revlay started on port
+func (c *Config) GetProcessRecordPath(port int) string {
+	return filepath.Join(c.GetPidsPath(), fmt.Sprintf("%s-%d.json", c.App.Name, port))
+}
+
 // GetLogsPath returns the path to the logs directory
 func (c *Config) GetLogsPath() string {
 	return filepath.Join(c.RootPath, "logs")
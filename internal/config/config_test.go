@@ -5,6 +5,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -87,6 +89,24 @@ func TestConfigValidation(t *testing.T) {
 		cfg.Service.StartCommand = ""
 		assert.Error(t, cfg.Validate())
 	})
+
+	t.Run("canary steps validation", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.Service.StartCommand = "./app --port=${PORT}"
+
+		cfg.Deploy.Canary.Steps = []int{5, 25, 50, 100}
+		assert.NoError(t, cfg.Validate())
+
+		// Steps must increase
+		cfg.Deploy.Canary.Steps = []int{25, 5}
+		assert.Error(t, cfg.Validate())
+
+		// Steps are percentages
+		cfg.Deploy.Canary.Steps = []int{0, 50}
+		assert.Error(t, cfg.Validate())
+		cfg.Deploy.Canary.Steps = []int{50, 150}
+		assert.Error(t, cfg.Validate())
+	})
 }
 
 func TestPathGetters(t *testing.T) {
@@ -98,3 +118,53 @@ func TestPathGetters(t *testing.T) {
 	assert.Equal(t, "/tmp/my-app/.revlay/active_port", cfg.GetActivePortPath())
 	assert.Equal(t, "/tmp/my-app/releases/v1", cfg.GetReleasePathByName("v1"))
 }
+
+func TestHealthCheckYAML(t *testing.T) {
+	var parsed struct {
+		Simple     HealthCheck `yaml:"simple"`
+		Structured HealthCheck `yaml:"structured"`
+	}
+	err := yaml.Unmarshal([]byte(`
+simple: /health
+structured:
+  type: http
+  path: /ready
+  method: HEAD
+  https: true
+  headers:
+    Host: example.com
+  expected_status: [200, 204]
+  body_regex: "ok|ready"
+`), &parsed)
+	require.NoError(t, err)
+
+	// A plain path keeps working as an http health check.
+	assert.Equal(t, HealthCheck{Type: HTTPHealthCheck, Path: "/health"}, parsed.Simple)
+	assert.Equal(t, HealthCheck{
+		Type:           HTTPHealthCheck,
+		Path:           "/ready",
+		Method:         "HEAD",
+		HTTPS:          true,
+		Headers:        map[string]string{"Host": "example.com"},
+		ExpectedStatus: []int{200, 204},
+		BodyRegex:      "ok|ready",
+	}, parsed.Structured)
+
+	// Health checks with only a path are written back in the short form.
+	out, err := yaml.Marshal(parsed)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "simple: /health\n")
+	assert.Contains(t, string(out), "expected_status:")
+}
+
+func TestHealthCheckValidation(t *testing.T) {
+	assert.NoError(t, HealthCheck{}.Validate())
+	assert.NoError(t, HealthCheck{Type: TCPHealthCheck}.Validate())
+	assert.NoError(t, HealthCheck{Type: NoHealthCheck}.Validate())
+	assert.NoError(t, HealthCheck{Type: ExecHealthCheck, Command: "./healthz"}.Validate())
+
+	assert.Error(t, HealthCheck{Type: "grpc"}.Validate())
+	assert.Error(t, HealthCheck{Type: ExecHealthCheck}.Validate())
+	assert.Error(t, HealthCheck{ExpectedStatus: []int{42}}.Validate())
+	assert.Error(t, HealthCheck{BodyRegex: "("}.Validate())
+}
@@ -3,6 +3,9 @@ package core
 import (
 	"encoding/json"
 	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
 	"strings"
 
 	"github.com/blang/semver"
@@ -86,7 +89,7 @@ func (p *Pusher) syncAndDeploy() error {
 	}
 
 	// Execute remote deploy
-	deployCommand := fmt.Sprintf("revlay deploy --from-dir %s --app %s", remoteTempDir, p.Opts.AppName)
+	deployCommand := fmt.Sprintf("%srevlay deploy --from-dir %s --app %s", p.deployEnv(), remoteTempDir, p.Opts.AppName)
 	if err := p.client.RunCommandStream(deployCommand); err != nil {
 		return fmt.Errorf("remote deployment failed: %w", err)
 	}
@@ -94,6 +97,48 @@ func (p *Pusher) syncAndDeploy() error {
 	return nil
 }
 
+// deployEnv returns environment assignments for the remote deploy command, so that the
+// release manifest records who pushed it, from which host and at which git commit.
+func (p *Pusher) deployEnv() string {
+	vars := [][2]string{{"REVLAY_DEPLOYER", localUser()}}
+	if host, err := os.Hostname(); err == nil {
+		vars = append(vars, [2]string{"REVLAY_SOURCE_HOST", host})
+	}
+	git := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"-C", p.Opts.SourceDir}, args...)...).Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if commit := git("rev-parse", "HEAD"); commit != "" {
+		vars = append(vars, [2]string{"REVLAY_GIT_COMMIT", commit})
+		if branch := git("rev-parse", "--abbrev-ref", "HEAD"); branch != "" && branch != "HEAD" {
+			vars = append(vars, [2]string{"REVLAY_GIT_BRANCH", branch})
+		}
+	}
+
+	var env strings.Builder
+	for _, v := range vars {
+		if v[1] != "" {
+			fmt.Fprintf(&env, "%s=%s ", v[0], shellQuote(v[1]))
+		}
+	}
+	return env.String()
+}
+
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// shellQuote quotes s for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 func (p *Pusher) checkRemoteRevlay() (string, error) {
 	if _, err := p.client.RunCommand("command -v revlay"); err != nil {
 		return "", fmt.Errorf("revlay not found on the remote server")
@@ -0,0 +1,297 @@
+package deployment
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveFormat 返回按扩展名识别的压缩包格式，不是支持的压缩包时返回空
+func archiveFormat(path string) string {
+	name := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return "tar.zst"
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	}
+	return ""
+}
+
+// IsArchive reports whether path is a file in one of the archive formats deploy can extract:
+// .tar.gz (.tgz), .tar.zst (.tzst) or .zip.
+func IsArchive(path string) bool {
+	if archiveFormat(path) == "" {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// extractArchive extracts the archive into dest, which is created. Tarballs are extracted
+// while they are decompressed, without temporary files. Entries that would end up outside
+// dest, through their name, a symlink target or a symlink in their path, are rejected.
+// On failure dest is removed again.
+func extractArchive(archivePath, dest string) (err error) {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dest)
+		}
+	}()
+
+	if archiveFormat(archivePath) == "zip" {
+		return extractZip(archivePath, dest)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader
+	switch archiveFormat(archivePath) {
+	case "tar.gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", archivePath, err)
+		}
+		defer gz.Close()
+		r = gz
+	case "tar.zst":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", archivePath, err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return fmt.Errorf("unsupported archive %s: expected .tar.gz, .tar.zst or .zip", archivePath)
+	}
+	return extractTar(r, dest)
+}
+
+func extractTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read archive: %w", err)
+		}
+
+		target, err := archiveEntryPath(dest, header.Name)
+		if err != nil {
+			return err
+		}
+		if target == dest {
+			continue // "./"
+		}
+		mode := os.FileMode(header.Mode) & os.ModePerm
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeArchiveFile(target, tr, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := writeArchiveSymlink(dest, target, header.Linkname); err != nil {
+				return err
+			}
+			continue // 符号链接的时间不能用 Chtimes 设置
+		case tar.TypeLink:
+			source, err := archiveEntryPath(dest, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := removeExisting(target); err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+			continue
+		default:
+			// 设备文件、FIFO 等不属于应用的发布内容
+			continue
+		}
+		// 保留修改时间，以便和之前的版本比较文件是否变化
+		os.Chtimes(target, header.ModTime, header.ModTime)
+	}
+}
+
+func extractZip(archivePath, dest string) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %w", archivePath, err)
+	}
+	defer zr.Close()
+
+	for _, file := range zr.File {
+		target, err := archiveEntryPath(dest, file.Name)
+		if err != nil {
+			return err
+		}
+		if target == dest {
+			continue
+		}
+		info := file.FileInfo()
+		mode := info.Mode()
+
+		rc, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("could not read %s from archive: %w", file.Name, err)
+		}
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(target, mode.Perm()|0700)
+		case mode&os.ModeSymlink != 0:
+			var linkname []byte
+			if linkname, err = io.ReadAll(io.LimitReader(rc, 4096)); err == nil {
+				err = writeArchiveSymlink(dest, target, string(linkname))
+			}
+		case mode.IsRegular():
+			err = writeArchiveFile(target, rc, mode.Perm())
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if mode.IsDir() || mode.IsRegular() {
+			os.Chtimes(target, file.Modified, file.Modified)
+		}
+	}
+	return nil
+}
+
+// archiveEntryPath returns where the entry name is extracted to in dest. Absolute names,
+// names that leave dest through "..", and names below a symlink are rejected.
+func archiveEntryPath(dest, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(name, "./")))
+	if !filepath.IsLocal(clean) {
+		return "", fmt.Errorf("archive entry %q points outside the release directory", name)
+	}
+	if clean == "." {
+		return dest, nil
+	}
+
+	// 前面解出的符号链接指向发布目录内，但写入链接下的路径仍然可能被链接到其它地方
+	dir := dest
+	parts := strings.Split(clean, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("archive entry %q is below the symlink %s", name, dir)
+		}
+	}
+	return filepath.Join(dest, clean), nil
+}
+
+// writeArchiveSymlink creates a symlink at target, whose linkname must stay inside dest.
+func writeArchiveSymlink(dest, target, linkname string) error {
+	if filepath.IsAbs(linkname) {
+		return fmt.Errorf("archive symlink %s points to the absolute path %s", target, linkname)
+	}
+	if !archiveLinkInside(dest, target, linkname) {
+		return fmt.Errorf("archive symlink %s points outside the release directory: %s", target, linkname)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := removeExisting(target); err != nil {
+		return err
+	}
+	return os.Symlink(linkname, target)
+}
+
+// archiveLinkInside reports whether the symlink target -> linkname resolves inside dest.
+// Checking the joined path lexically is not enough: "u/.." leaves whatever u points to,
+// not u's parent. So ".." may only step out of a directory that was already extracted as
+// a real directory. After a symlink, or a path that does not exist yet and may become a
+// symlink later, it is rejected. Directories are never replaced during extraction.
+func archiveLinkInside(dest, target, linkname string) bool {
+	rel, err := filepath.Rel(dest, filepath.Dir(target))
+	if err != nil || !filepath.IsLocal(rel) {
+		return false
+	}
+	var stack []string
+	if rel != "." {
+		stack = strings.Split(rel, string(filepath.Separator))
+	}
+	for _, part := range strings.Split(filepath.FromSlash(linkname), string(filepath.Separator)) {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(stack) == 0 {
+				return false
+			}
+			info, err := os.Lstat(filepath.Join(dest, filepath.Join(stack...)))
+			if err != nil || !info.IsDir() {
+				return false
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			stack = append(stack, part)
+		}
+	}
+	return true
+}
+
+func writeArchiveFile(target string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	// 同名的条目可能出现多次，不能通过已存在的符号链接写入
+	if err := removeExisting(target); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("could not extract %s: %w", target, err)
+	}
+	return f.Close()
+}
+
+// removeExisting removes a file or symlink at path, directories are kept.
+func removeExisting(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("archive entry %s conflicts with a directory", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,122 @@
+package deployment
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/i18n"
+	"github.com/xukonxe/revlay/internal/proxy"
+)
+
+const (
+	// canaryDefaultStepInterval 是每个步骤默认的观察时间
+	canaryDefaultStepInterval = 60 * time.Second
+	// canaryDefaultMaxErrorRate 是默认允许的新版本错误率（百分比）
+	canaryDefaultMaxErrorRate = 5.0
+	// canaryMinRequests 是计算错误率所需的最少请求数，避免少量请求造成误判
+	canaryMinRequests = 20
+)
+
+// shiftTrafficGradually 按 deploy.canary.steps 逐步把流量从旧端口转移到新端口
+// 每个步骤都会观察新版本的健康检查和错误率，任何异常都会把流量全部切回旧端口并返回错误
+// 最后的 100% 切换由 switchTraffic 完成，这样状态文件和 current 链接只在全部成功后才更新
+func (d *LocalDeployer) shiftTrafficGradually(oldPort, newPort int, processDone <-chan error, logger *stepLogger) error {
+	canary := d.config.Deploy.Canary
+	client := proxy.NewControlClient(d.config.GetProxySocketPath())
+	if _, err := client.Status(); err != nil {
+		if errors.Is(err, proxy.ErrProxyNotRunning) {
+			logger.Warn(i18n.T().DeployCanaryNoProxy)
+			return nil
+		}
+		return err
+	}
+
+	interval := time.Duration(canary.StepInterval) * time.Second
+	if interval <= 0 {
+		interval = canaryDefaultStepInterval
+	}
+	logger.Print(fmt.Sprintf(i18n.T().DeployCanaryStart, newPort, fmt.Sprint(canary.Steps)))
+
+	for _, weight := range canary.Steps {
+		if weight >= 100 {
+			break
+		}
+		logger.Print(fmt.Sprintf(i18n.T().DeployCanaryStep, weight, interval))
+		status, err := client.Split([]proxy.Target{
+			proxy.LocalTarget(oldPort, 100-weight),
+			proxy.LocalTarget(newPort, weight),
+		})
+		if err != nil {
+			return d.abortCanary(client, oldPort, fmt.Errorf(i18n.T().DeployCanarySplitFailed, err), logger)
+		}
+
+		stats, err := d.observeCanary(client, status, newPort, interval, processDone)
+		if err != nil {
+			return d.abortCanary(client, oldPort, err, logger)
+		}
+		logger.Success(fmt.Sprintf(i18n.T().DeployCanaryStepPassed, weight, stats.Requests, stats.Errors))
+	}
+	return nil
+}
+
+// observeCanary 在一个步骤的观察时间内定期检查新版本，返回该步骤内新版本处理的请求统计
+func (d *LocalDeployer) observeCanary(client *proxy.ControlClient, start *proxy.Status, newPort int, window time.Duration, processDone <-chan error) (proxy.TargetStats, error) {
+	newTarget := proxy.LocalTarget(newPort, 0).Addr
+	baseline := start.Stats[newTarget]
+
+	maxErrorRate := d.config.Deploy.Canary.MaxErrorRate
+	if maxErrorRate <= 0 {
+		maxErrorRate = canaryDefaultMaxErrorRate
+	}
+	checkInterval := time.Duration(d.config.Service.HealthCheckInterval) * time.Second
+	if checkInterval <= 0 {
+		checkInterval = 2 * time.Second
+	}
+	timeout := time.Duration(d.config.Service.HealthCheckTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	var stats proxy.TargetStats
+	deadline := time.Now().Add(window)
+	for {
+		select {
+		case <-processDone:
+			return stats, errors.New(i18n.T().DeployCanaryProcessExited)
+		case <-time.After(min(checkInterval, time.Until(deadline))):
+		}
+
+		if err := d.probeHealth(newPort, timeout); err != nil {
+			return stats, fmt.Errorf(i18n.T().DeployCanaryHealthFailed, err)
+		}
+
+		status, err := client.Status()
+		if err != nil {
+			return stats, err
+		}
+		current := status.Stats[newTarget]
+		stats = proxy.TargetStats{
+			Requests: current.Requests - baseline.Requests,
+			Errors:   current.Errors - baseline.Errors,
+		}
+		if stats.Requests >= canaryMinRequests {
+			rate := float64(stats.Errors) * 100 / float64(stats.Requests)
+			if rate > maxErrorRate {
+				return stats, fmt.Errorf(i18n.T().DeployCanaryErrorRate, rate, stats.Errors, stats.Requests, maxErrorRate)
+			}
+		}
+
+		if !time.Now().Before(deadline) {
+			return stats, nil
+		}
+	}
+}
+
+// abortCanary 把流量全部切回旧端口，并返回说明回滚原因的错误
+func (d *LocalDeployer) abortCanary(client *proxy.ControlClient, oldPort int, cause error, logger *stepLogger) error {
+	if _, err := client.Switch(oldPort); err != nil {
+		logger.Warn(fmt.Sprintf(i18n.T().DeployCanaryRollbackFailed, oldPort, err))
+	}
+	return fmt.Errorf(i18n.T().DeployCanaryRolledBack, cause)
+}
@@ -3,7 +3,6 @@ package deployment
 import (
 	"bufio"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -15,7 +14,6 @@ import (
 	"github.com/xukonxe/revlay/internal/color"
 	"github.com/xukonxe/revlay/internal/config"
 	"github.com/xukonxe/revlay/internal/i18n"
-	"github.com/xukonxe/revlay/internal/ui"
 )
 
 // ServiceAlreadyRunningError is returned when a service is already running.
@@ -33,9 +31,14 @@ type Deployer interface {
 	Rollback(releaseName string) error
 	ListReleases() ([]string, error)
 	GetCurrentRelease() (string, error)
+	ReleaseFailure(releaseName string) (string, bool)
+	ReleaseManifest(releaseName string) (*ReleaseManifest, error)
+	History(since time.Time) ([]HistoryEntry, error)
+	RollbackTarget(steps int, toPreviousLive bool) (string, error)
 	Prune(logger *stepLogger) error
 	StartService(releaseName string) error
 	StopService() error
+	ServiceProcess(port int) (*ProcessRecord, error)
 }
 
 // Release represents a deployment release.
@@ -80,31 +83,40 @@ func (d *LocalDeployer) Deploy(releaseName string, sourceDir string) error {
 	defer fileLock.Unlock()
 
 	// Run pre-deployment hooks
-	if err := d.runHooks(d.config.Hooks.PreDeploy, "pre-deploy"); err != nil {
+	hooks := d.newHookContext(releaseName)
+	manifest := d.newReleaseManifest(releaseName, sourceDir, hooks.Port)
+	if err := d.runHooks(d.config.Hooks.PreDeploy, "pre-deploy", hooks, nil); err != nil {
 		return fmt.Errorf("pre-deploy hook failed: %w", err)
 	}
 
 	var deployErr error
 	switch d.config.Deploy.Mode {
 	case config.ZeroDowntimeMode:
-		deployErr = d.deployZeroDowntime(releaseName, sourceDir)
+		deployErr = d.deployZeroDowntime(releaseName, sourceDir, hooks, manifest)
 	case config.ShortDowntimeMode:
-		deployErr = d.deployShortDowntime(releaseName, sourceDir)
+		deployErr = d.deployShortDowntime(releaseName, sourceDir, hooks, manifest)
 	default:
 		log.Printf("Unknown deployment mode '%s', falling back to short_downtime.", d.config.Deploy.Mode)
-		deployErr = d.deployShortDowntime(releaseName, sourceDir)
+		deployErr = d.deployShortDowntime(releaseName, sourceDir, hooks, manifest)
 	}
 
+	// 记录部署结果，元数据写入失败不影响部署本身
+	if err := d.finishReleaseManifest(manifest, deployErr); err != nil {
+		log.Printf("Could not write the release manifest: %v", err)
+	}
+	d.recordHistory(OpDeploy, releaseName, deployErr)
+
 	if deployErr != nil {
+		d.runFailureHooks(hooks, deployErr)
 		// Run post-deployment hooks even if deploy failed (for cleanup)
-		if err := d.runHooks(d.config.Hooks.PostDeploy, "post-deploy"); err != nil {
+		if err := d.runHooks(d.config.Hooks.PostDeploy, "post-deploy", hooks, nil); err != nil {
 			log.Printf("post-deploy hook failed after a failed deployment: %v", err)
 		}
 		return deployErr
 	}
 
 	// Run post-deployment hooks
-	if err := d.runHooks(d.config.Hooks.PostDeploy, "post-deploy"); err != nil {
+	if err := d.runHooks(d.config.Hooks.PostDeploy, "post-deploy", hooks, nil); err != nil {
 		return fmt.Errorf("post-deploy hook failed: %w", err)
 	}
 
@@ -129,23 +141,44 @@ func (d *LocalDeployer) Rollback(releaseName string) error {
 	if !found {
 		return fmt.Errorf(i18n.T().ErrorReleaseNotFound, releaseName)
 	}
+	if current, _ := d.GetCurrentRelease(); current == releaseName {
+		return fmt.Errorf(i18n.T().RollbackIsCurrent, releaseName)
+	}
+	if reason, failed := d.ReleaseFailure(releaseName); failed {
+		return fmt.Errorf(i18n.T().RollbackReleaseFailed, releaseName, reason)
+	}
 
-	// 2. Stop current service
-	fmt.Println("  -> Stopping current service...")
-	if err := d.stopService(nil); err != nil {
-		fmt.Printf(color.Yellow(i18n.T().DeployStopServiceFailed, err))
+	// 2. Run pre-rollback hooks, a failure aborts the rollback
+	hooks := d.newHookContext(releaseName)
+	if err := d.runHooks(d.config.Hooks.PreRollback, "pre-rollback", hooks, nil); err != nil {
+		return fmt.Errorf("pre-rollback hook failed: %w", err)
 	}
 
-	// 3. Switch symlink
-	fmt.Println("  -> Activating rollback release...")
-	if err := d.switchSymlink(releaseName, nil); err != nil {
+	// 3. Follow the deployment mode, zero_downtime rolls back on the idle colour
+	if d.config.Deploy.Mode == config.ZeroDowntimeMode {
+		err = d.rollbackZeroDowntime(releaseName)
+	} else {
+		err = d.rollbackShortDowntime(releaseName)
+	}
+	d.recordHistory(OpRollback, releaseName, err)
+	if err != nil {
+		d.runFailureHooks(hooks, err)
 		return err
 	}
 
-	// 4. Start service
-	fmt.Println("  -> Starting service...")
-	if err := d.startService(releaseName, nil); err != nil {
-		return err
+	// 回滚离开的版本标记为已回滚，回滚到的版本重新上线
+	if hooks.PreviousRelease != "" && hooks.PreviousRelease != releaseName {
+		if err := d.setReleaseStatus(hooks.PreviousRelease, ReleaseRolledBack, ""); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	if err := d.setReleaseStatus(releaseName, ReleaseLive, ""); err != nil {
+		log.Printf("%v", err)
+	}
+
+	// 4. Run post-rollback hooks, the rollback itself has already succeeded
+	if err := d.runHooks(d.config.Hooks.PostRollback, "post-rollback", hooks, nil); err != nil {
+		return fmt.Errorf("post-rollback hook failed: %w", err)
 	}
 
 	fmt.Println(color.Green(i18n.T().RollbackSuccess, releaseName))
@@ -156,32 +189,6 @@ func GenerateReleaseTimestamp() string {
 	return time.Now().UTC().Format("20060102150405")
 }
 
-func (d *LocalDeployer) runHooks(hooks []string, hookType string) error {
-	if len(hooks) == 0 {
-		return nil
-	}
-	fmt.Println(color.Cyan("  -> Running %s hooks...", hookType))
-	currentPath := d.config.GetCurrentPath()
-
-	for _, hook := range hooks {
-		resolvedHook, err := d.resolveTemplate(hook, "") // releaseName is not relevant for all hooks
-		if err != nil {
-			return fmt.Errorf("could not resolve hook template '%s': %w", hook, err)
-		}
-		parts := strings.Fields(resolvedHook)
-		if len(parts) == 0 {
-			continue
-		}
-		cmd := exec.Command(parts[0], parts[1:]...)
-		cmd.Dir = currentPath // Run hook in the context of the current code
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("hook '%s' failed: %s", resolvedHook, output)
-		}
-	}
-	return nil
-}
-
 func (d *LocalDeployer) runCommandAttachedAsync(releaseName, command string, env map[string]string) (*exec.Cmd, <-chan error, error) {
 	cmdStr, err := d.resolveTemplate(command, releaseName)
 	if err != nil {
@@ -231,64 +238,6 @@ func (d *LocalDeployer) runCommandAttachedAsync(releaseName, command string, env
 	return cmd, done, nil
 }
 
-func (d *LocalDeployer) runCommandAttachedWithStreaming(releaseName, command string, env map[string]string, formatter *ui.DeploymentFormatter) (*exec.Cmd, <-chan error, error) {
-	cmdStr, err := d.resolveTemplate(command, releaseName)
-	if err != nil {
-		return nil, nil, fmt.Errorf("could not resolve command template: %w", err)
-	}
-
-	cmdParts := strings.Fields(cmdStr)
-	if len(cmdParts) == 0 {
-		return nil, nil, fmt.Errorf("empty command after resolving template")
-	}
-
-	cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
-	cmd.Dir = d.config.GetReleasePathByName(releaseName)
-
-	cmd.Env = os.Environ()
-	for key, value := range env {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
-	}
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get stdout pipe: %w", err)
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get stderr pipe: %w", err)
-	}
-
-	if formatter != nil {
-		formatter.StartStreaming(releaseName)
-		go streamOutput(stdout, releaseName, "out", formatter)
-		go streamOutput(stderr, releaseName, "err", formatter)
-	}
-
-	if err := cmd.Start(); err != nil {
-		return nil, nil, fmt.Errorf("failed to start command '%s': %w", cmdStr, err)
-	}
-
-	processDone := make(chan error, 1)
-	go func() {
-		processDone <- cmd.Wait()
-		if formatter != nil {
-			formatter.StopStreaming()
-		}
-	}()
-
-	return cmd, processDone, nil
-}
-
-func streamOutput(reader io.Reader, releaseName, streamType string, formatter *ui.DeploymentFormatter) {
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		if formatter != nil {
-			formatter.StreamLog(releaseName, streamType, scanner.Text())
-		}
-	}
-}
-
 func (d *LocalDeployer) resolveTemplate(template string, releaseName string) (string, error) {
 	// A simple key-value replacer. More complex templating can be added later.
 	if releaseName == "" {
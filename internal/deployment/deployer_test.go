@@ -1,18 +1,29 @@
 package deployment
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/xukonxe/revlay/internal/config"
+	"github.com/xukonxe/revlay/internal/proxy"
 )
 
 // setupTestEnv creates a temporary directory structure and a valid config for testing.
@@ -27,7 +38,7 @@ func setupTestEnv(t *testing.T, mode config.DeploymentMode) (*config.Config, str
 	// We manually substitute ${PORT} in the test assertions.
 	cfg.Service.StartCommand = "touch " + filepath.Join(tmpDir, "service_started_on_${PORT}")
 	cfg.Service.StopCommand = "touch " + filepath.Join(tmpDir, "service_stopped_on_${PORT}")
-	cfg.Service.HealthCheck = "/health"
+	cfg.Service.HealthCheck = config.HealthCheck{Path: "/health"}
 	cfg.Service.GracefulTimeout = 0 // Disable for tests to avoid waiting
 	cfg.App.KeepReleases = 1
 
@@ -95,6 +106,7 @@ func TestDeployZeroDowntime(t *testing.T) {
 	err = os.MkdirAll(cfg.GetReleasePathByName(dummyOldRelease), 0755)
 	require.NoError(t, err)
 
+	// The start command exits 0 at once like a daemonizing one, the health check decides.
 	deployer := NewLocalDeployer(cfg)
 	releaseName := "release-zero-1"
 
@@ -123,3 +135,923 @@ func TestDeployZeroDowntime(t *testing.T) {
 	_, err = os.Stat(cfg.GetReleasePathByName(dummyOldRelease))
 	assert.True(t, os.IsNotExist(err), "Old release should have been pruned")
 }
+
+func TestListeningInodes(t *testing.T) {
+	procNetTCP := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 41234 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F91 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 41235 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F90 0100007F:D2A4 01 00000000:00000000 00:00000000 00000000  1000        0 41236 1 0000000000000000 20 4 30 10 -1
+`
+	// Only the listening socket on 8080 (0x1F90) counts, not the established connection to it.
+	assert.Equal(t, []string{"41234"}, listeningInodes(strings.NewReader(procNetTCP), 8080))
+	assert.Empty(t, listeningInodes(strings.NewReader(procNetTCP), 9090))
+}
+
+func TestProcessRecord(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+
+	sleeper := exec.Command("sleep", "30")
+	require.NoError(t, sleeper.Start())
+	defer sleeper.Process.Kill()
+
+	require.NoError(t, deployer.writeProcessRecord(&ProcessRecord{PID: sleeper.Process.Pid, Port: cfg.Service.AltPort, Release: "release-1"}))
+	require.NoError(t, os.MkdirAll(cfg.GetStatePath(), 0755))
+	require.NoError(t, os.WriteFile(cfg.GetActivePortPath(), []byte(strconv.Itoa(cfg.Service.AltPort)), 0644))
+
+	// Port 0 looks up the colour that receives traffic.
+	record, err := deployer.ServiceProcess(0)
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	assert.Equal(t, sleeper.Process.Pid, record.PID)
+	assert.Equal(t, "release-1", record.Release)
+	assert.Equal(t, processSourceRecord, record.Source)
+
+	// A record of a process that is gone is stale and removed.
+	sleeper.Process.Kill()
+	sleeper.Wait()
+	record, err = deployer.findProcess(cfg.Service.AltPort, false)
+	require.NoError(t, err)
+	assert.Nil(t, record)
+	assert.NoFileExists(t, cfg.GetProcessRecordPath(cfg.Service.AltPort))
+}
+
+func TestSpawnService_RunsDetachedWithLogFiles(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	cfg.Service.StartCommand = "echo listening on $PORT; exec sleep 30"
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	require.NoError(t, os.MkdirAll(cfg.GetReleasePathByName("release-1"), 0755))
+
+	cmd, err := deployer.spawnService("release-1", cfg.Service.AltPort)
+	require.NoError(t, err)
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+	// It runs in its own process group, so it does not get the signals of the deploying shell.
+	pgid, err := syscall.Getpgid(cmd.Process.Pid)
+	require.NoError(t, err)
+	assert.Equal(t, cmd.Process.Pid, pgid)
+
+	record, err := deployer.readProcessRecord(cfg.Service.AltPort)
+	require.NoError(t, err)
+	assert.Equal(t, cmd.Process.Pid, record.PID)
+	assert.True(t, record.ProcessGroup)
+
+	logPath := deployer.resolvePath(cfg.Service.StdoutLog, "release-1")
+	assert.Eventually(t, func() bool {
+		output, _ := os.ReadFile(logPath)
+		return strings.Contains(string(output), fmt.Sprintf("listening on %d", cfg.Service.AltPort))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReadNewLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.log")
+	require.NoError(t, os.WriteFile(path, []byte("old line\n"), 0644))
+	offset := int64(len("old line\n"))
+
+	var lines []string
+	collect := func(line string) { lines = append(lines, line) }
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	defer f.Close()
+	f.WriteString("first\nsecond\nthi")
+
+	// Only complete lines written after offset are shown, the rest waits for its newline.
+	offset, partial := readNewLines(path, offset, "", collect)
+	assert.Equal(t, []string{"first", "second"}, lines)
+	assert.Equal(t, "thi", partial)
+
+	f.WriteString("rd\n")
+	_, partial = readNewLines(path, offset, partial, collect)
+	assert.Equal(t, []string{"first", "second", "third"}, lines)
+	assert.Empty(t, partial)
+}
+
+func TestStopPort_RunsStopCommand(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	cfg.Service.StartCommand = "exec sleep 30"
+	cfg.Service.StopCommand = "echo $PID > stopped_on_$PORT; kill $PID"
+	cfg.Service.GracefulTimeout = 5
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	releasePath := cfg.GetReleasePathByName("release-1")
+	require.NoError(t, os.MkdirAll(releasePath, 0755))
+
+	cmd, err := deployer.spawnService("release-1", cfg.Service.AltPort)
+	require.NoError(t, err)
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+	require.NoError(t, deployer.stopPort(cfg.Service.AltPort, nil))
+
+	// The stop command runs in the release with the port and PID of the process.
+	output, err := os.ReadFile(filepath.Join(releasePath, fmt.Sprintf("stopped_on_%d", cfg.Service.AltPort)))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(cmd.Process.Pid), strings.TrimSpace(string(output)))
+	assert.False(t, processAlive(cmd.Process.Pid))
+	_, err = deployer.readProcessRecord(cfg.Service.AltPort)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStopPort_EscalatesToSigkill(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	cfg.Service.StartCommand = "trap '' TERM; while true; do sleep 0.1; done"
+	cfg.Service.StopCommand = ""
+	cfg.Service.GracefulTimeout = 1
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	require.NoError(t, os.MkdirAll(cfg.GetReleasePathByName("release-1"), 0755))
+
+	cmd, err := deployer.spawnService("release-1", cfg.Service.AltPort)
+	require.NoError(t, err)
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	time.Sleep(200 * time.Millisecond) // let the shell install its trap
+
+	start := time.Now()
+	require.NoError(t, deployer.stopPort(cfg.Service.AltPort, nil))
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.False(t, processAlive(cmd.Process.Pid))
+}
+
+func TestRollbackZeroDowntime_KeepsCurrentWhenReleaseFails(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	cfg.Service.StartCommand = "exit 1"
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	for _, release := range []string{"release-1", "release-2"} {
+		require.NoError(t, os.MkdirAll(cfg.GetReleasePathByName(release), 0755))
+	}
+	require.NoError(t, deployer.switchSymlink("release-2", nil))
+	require.NoError(t, deployer.writeStateFile(cfg.Service.Port))
+
+	// The rollback release is started on the idle colour, so the live one is not touched
+	// when it does not come up.
+	require.Error(t, deployer.Rollback("release-1"))
+
+	current, err := deployer.GetCurrentRelease()
+	require.NoError(t, err)
+	assert.Equal(t, "release-2", current)
+	port, err := deployer.getCurrentPortFromState()
+	require.NoError(t, err)
+	assert.Equal(t, cfg.Service.Port, port)
+	_, err = os.Stat(filepath.Join(tmpDir, fmt.Sprintf("service_stopped_on_%d", cfg.Service.Port)))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// serverPort returns the port of a test server listening on 127.0.0.1.
+func serverPort(t *testing.T, addr string) int {
+	_, portStr, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+	return port
+}
+
+func TestProbeHealth_HTTP(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/redirect":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case r.Header.Get("X-Token") != "" && r.Header.Get("X-Token") != "secret":
+			w.WriteHeader(http.StatusForbidden)
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			fmt.Fprint(w, `{"status":"ready","version":"1.2.3"}`)
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	port := serverPort(t, server.Listener.Addr().String())
+	deployer := &LocalDeployer{config: config.DefaultConfig()}
+
+	probe := func(check config.HealthCheck) error {
+		deployer.config.Service.HealthCheck = check
+		return deployer.probeHealth(port, time.Second)
+	}
+	assert.NoError(t, probe(config.HealthCheck{Path: "/health"}))
+	assert.NoError(t, probe(config.HealthCheck{Path: "/redirect"}), "3xx is healthy by default")
+	assert.Error(t, probe(config.HealthCheck{Path: "/redirect", ExpectedStatus: []int{200}}))
+	assert.NoError(t, probe(config.HealthCheck{Method: "post", ExpectedStatus: []int{202}}))
+	assert.NoError(t, probe(config.HealthCheck{Headers: map[string]string{"X-Token": "secret"}}))
+	assert.Error(t, probe(config.HealthCheck{Headers: map[string]string{"X-Token": "wrong"}}))
+	assert.NoError(t, probe(config.HealthCheck{BodyContains: `"status":"ready"`}))
+	assert.Error(t, probe(config.HealthCheck{BodyContains: "starting"}))
+	assert.NoError(t, probe(config.HealthCheck{BodyRegex: `"version":"1\.\d+`}))
+	assert.Error(t, probe(config.HealthCheck{BodyRegex: `"version":"2\.`}))
+
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	port = serverPort(t, tlsServer.Listener.Addr().String())
+	assert.NoError(t, probe(config.HealthCheck{Path: "/health", HTTPS: true}))
+	assert.Error(t, probe(config.HealthCheck{Path: "/health"}))
+}
+
+func TestProbeHealth_TCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := serverPort(t, listener.Addr().String())
+	deployer := &LocalDeployer{config: config.DefaultConfig()}
+	deployer.config.Service.HealthCheck = config.HealthCheck{Type: config.TCPHealthCheck}
+
+	assert.NoError(t, deployer.probeHealth(port, time.Second))
+	listener.Close()
+	assert.Error(t, deployer.probeHealth(port, time.Second))
+}
+
+func TestProbeHealth_Exec(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	ready := filepath.Join(tmpDir, "ready")
+	cfg.Service.HealthCheck = config.HealthCheck{Type: config.ExecHealthCheck, Command: "test -f " + ready + "-$PORT"}
+
+	assert.Error(t, deployer.probeHealth(8081, time.Second))
+	require.NoError(t, os.WriteFile(ready+"-8081", nil, 0644))
+	assert.NoError(t, deployer.probeHealth(8081, time.Second))
+
+	// A command that hangs fails the check after the timeout.
+	cfg.Service.HealthCheck.Command = "sleep 5"
+	start := time.Now()
+	assert.Error(t, deployer.probeHealth(8081, 100*time.Millisecond))
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestWaitForService_None(t *testing.T) {
+	deployer := &LocalDeployer{config: config.DefaultConfig()}
+	deployer.config.Service.HealthCheck = config.HealthCheck{Type: config.NoHealthCheck}
+	deployer.config.Service.HealthCheckRetries = 1
+
+	// Nothing listens on the port, yet the service counts as healthy.
+	assert.NoError(t, deployer.waitForService(1))
+}
+
+func TestVerifyRelease(t *testing.T) {
+	// failing 是健康检查接下来要失败的次数，负数表示一直失败
+	var failing atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := failing.Load(); n != 0 {
+			failing.Add(-1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	port := serverPort(t, server.Listener.Addr().String())
+	deployer := &LocalDeployer{config: config.DefaultConfig()}
+	deployer.config.Deploy.Verify.Duration = 2
+	deployer.config.Deploy.Verify.Interval = 1
+	deployer.config.Deploy.Verify.FailureThreshold = 2
+
+	assert.NoError(t, deployer.verifyRelease(port, make(chan error), newStepLogger()))
+
+	// A single failed probe is not enough to fail verification.
+	failing.Store(1)
+	assert.NoError(t, deployer.verifyRelease(port, make(chan error), newStepLogger()))
+
+	failing.Store(-1)
+	assert.Error(t, deployer.verifyRelease(port, make(chan error), newStepLogger()))
+
+	failing.Store(0)
+	exited := make(chan error, 1)
+	exited <- nil
+	assert.Error(t, deployer.verifyRelease(port, exited, newStepLogger()))
+}
+
+func TestRevertVerifiedRelease(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	cfg.Service.StopCommand = ""
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	for _, release := range []string{"release-1", "release-2"} {
+		require.NoError(t, os.MkdirAll(cfg.GetReleasePathByName(release), 0755))
+	}
+	// release-2 went live on the alt port and then failed verification.
+	require.NoError(t, deployer.switchSymlink("release-2", nil))
+	require.NoError(t, deployer.writeStateFile(cfg.Service.AltPort))
+
+	err := deployer.revertVerifiedRelease("release-2", "release-1", cfg.Service.Port, cfg.Service.AltPort, fmt.Errorf("exited"), newStepLogger())
+	require.Error(t, err)
+
+	current, err := deployer.GetCurrentRelease()
+	require.NoError(t, err)
+	assert.Equal(t, "release-1", current)
+	port, err := deployer.getCurrentPortFromState()
+	require.NoError(t, err)
+	assert.Equal(t, cfg.Service.Port, port)
+	reason, failed := deployer.ReleaseFailure("release-2")
+	assert.True(t, failed)
+	assert.Equal(t, "exited", reason)
+	_, failed = deployer.ReleaseFailure("release-1")
+	assert.False(t, failed)
+}
+
+func TestRevertVerifiedRelease_FirstDeployKeepsRunning(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	require.NoError(t, os.MkdirAll(cfg.GetReleasePathByName("release-1"), 0755))
+	require.NoError(t, deployer.switchSymlink("release-1", nil))
+	require.NoError(t, deployer.writeStateFile(cfg.Service.Port))
+
+	stopped := filepath.Join(tmpDir, "stopped")
+	cfg.Service.StopCommand = "touch " + stopped
+
+	err := deployer.revertVerifiedRelease("release-1", "", cfg.Service.Port, cfg.Service.Port, fmt.Errorf("unhealthy"), newStepLogger())
+	require.Error(t, err)
+
+	// The only release serving traffic is marked failed but not stopped or unlinked.
+	reason, failed := deployer.ReleaseFailure("release-1")
+	assert.True(t, failed)
+	assert.Equal(t, "unhealthy", reason)
+	current, err := deployer.GetCurrentRelease()
+	require.NoError(t, err)
+	assert.Equal(t, "release-1", current)
+	assert.NoFileExists(t, stopped)
+}
+
+// canaryEnv runs an http proxy on the app's control socket in front of an old and a new
+// backend and sends requests through it until the test ends. newStatus is the status the
+// new backend answers requests other than its health check with.
+func canaryEnv(t *testing.T, newStatus int) (*LocalDeployer, *proxy.ControlClient, int, int) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+	cfg.Service.HealthCheckInterval = 1
+	cfg.Deploy.Canary.StepInterval = 1
+
+	oldBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(oldBackend.Close)
+	newBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(newStatus)
+		}
+	}))
+	t.Cleanup(newBackend.Close)
+	oldPort := serverPort(t, oldBackend.Listener.Addr().String())
+	newPort := serverPort(t, newBackend.Listener.Addr().String())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listenPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	manager := proxy.NewManagerWithOptions(listenPort, oldPort, cfg.GetActivePortPath(), proxy.Options{Mode: proxy.ModeHTTP})
+	go manager.Start()
+	t.Cleanup(manager.Stop)
+	<-manager.Ready()
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		url := fmt.Sprintf("http://127.0.0.1:%d/", listenPort)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			if resp, err := http.Get(url); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-stopped
+	})
+
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	return deployer, proxy.NewControlClient(cfg.GetProxySocketPath()), oldPort, newPort
+}
+
+func TestShiftTrafficGradually_RampsThroughSteps(t *testing.T) {
+	deployer, client, oldPort, newPort := canaryEnv(t, http.StatusOK)
+	deployer.config.Deploy.Canary.Steps = []int{25, 50, 100}
+
+	// Record the weights of the new release the proxy is set to along the way.
+	var weights []int
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		for {
+			if status, err := client.Status(); err == nil {
+				for _, target := range status.Targets {
+					if target.Addr == proxy.LocalTarget(newPort, 0).Addr &&
+						(len(weights) == 0 || weights[len(weights)-1] != target.Weight) {
+						weights = append(weights, target.Weight)
+					}
+				}
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}()
+
+	err := deployer.shiftTrafficGradually(oldPort, newPort, make(chan error), newStepLogger())
+	close(done)
+	<-watched
+	require.NoError(t, err)
+	assert.Equal(t, []int{25, 50}, weights, "100% is left to the final switch")
+
+	// Both releases served traffic during the ramp.
+	status, err := client.Status()
+	require.NoError(t, err)
+	assert.Equal(t, []proxy.Target{proxy.LocalTarget(oldPort, 50), proxy.LocalTarget(newPort, 50)}, status.Targets)
+	assert.NotZero(t, status.Stats[proxy.LocalTarget(oldPort, 0).Addr].Requests)
+	assert.NotZero(t, status.Stats[proxy.LocalTarget(newPort, 0).Addr].Requests)
+}
+
+func TestShiftTrafficGradually_AbortsOnErrorRate(t *testing.T) {
+	// The new release passes its health check but fails every request.
+	deployer, client, oldPort, newPort := canaryEnv(t, http.StatusInternalServerError)
+	deployer.config.Deploy.Canary.Steps = []int{50, 100}
+	deployer.config.Deploy.Canary.StepInterval = 5
+
+	err := deployer.shiftTrafficGradually(oldPort, newPort, make(chan error), newStepLogger())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "100.0%")
+
+	// All traffic went back to the old release.
+	status, err := client.Status()
+	require.NoError(t, err)
+	assert.Equal(t, proxy.LocalTarget(oldPort, 0).Addr, status.Target)
+	require.Len(t, status.Targets, 1)
+	assert.Equal(t, proxy.LocalTarget(oldPort, 0).Addr, status.Targets[0].Addr)
+}
+
+func TestShiftTrafficGradually_AbortsWhenProcessExits(t *testing.T) {
+	deployer, client, oldPort, newPort := canaryEnv(t, http.StatusOK)
+	deployer.config.Deploy.Canary.Steps = []int{50}
+	deployer.config.Deploy.Canary.StepInterval = 5
+
+	exited := make(chan error, 1)
+	exited <- fmt.Errorf("exit status 1")
+	require.Error(t, deployer.shiftTrafficGradually(oldPort, newPort, exited, newStepLogger()))
+
+	status, err := client.Status()
+	require.NoError(t, err)
+	assert.Equal(t, proxy.LocalTarget(oldPort, 0).Addr, status.Target)
+	require.Len(t, status.Targets, 1)
+}
+
+func TestRunHooks(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	cfg.Hooks.WorkingDir = "app"
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	releasePath := cfg.GetReleasePathByName("release-2")
+	require.NoError(t, os.MkdirAll(filepath.Join(releasePath, "app"), 0755))
+	hc := hookContext{Release: "release-2", PreviousRelease: "release-1", Port: 8081}
+
+	// Hooks run through a shell in the working directory of the new release.
+	err := deployer.runHooks([]string{
+		`echo "$REVLAY_RELEASE $REVLAY_PREVIOUS_RELEASE $REVLAY_PORT" > env.txt && pwd >> env.txt`,
+		`test "$REVLAY_RELEASE_PATH" = "` + releasePath + `" || exit 3`,
+	}, "test", hc, nil)
+	require.NoError(t, err)
+	output, err := os.ReadFile(filepath.Join(releasePath, "app", "env.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "release-2 release-1 8081\n"+filepath.Join(releasePath, "app")+"\n", string(output))
+
+	// A failing hook stops the ones after it.
+	err = deployer.runHooks([]string{"exit 3", "touch never"}, "test", hc, nil)
+	assert.Error(t, err)
+	assert.NoFileExists(t, filepath.Join(releasePath, "app", "never"))
+
+	// Hooks are killed after hooks.timeout_seconds.
+	cfg.Hooks.Timeout = 1
+	start := time.Now()
+	err = deployer.runHooks([]string{"sleep 10"}, "test", hc, nil)
+	assert.ErrorContains(t, err, "sleep 10")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRollbackHooks(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ShortDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	cfg.Service.StartupDelay = 0
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	for _, release := range []string{"release-1", "release-2"} {
+		require.NoError(t, os.MkdirAll(cfg.GetReleasePathByName(release), 0755))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "pids"), 0755))
+	require.NoError(t, deployer.switchSymlink("release-2", nil))
+	hookLog := filepath.Join(tmpDir, "hooks.log")
+	record := func(stage string) []string {
+		return []string{fmt.Sprintf(`echo "%s $REVLAY_RELEASE $REVLAY_PREVIOUS_RELEASE" >> %s`, stage, hookLog)}
+	}
+
+	// A failing pre_rollback hook aborts the rollback before anything is touched.
+	cfg.Hooks.PreRollback = []string{"exit 1"}
+	cfg.Hooks.OnFailure = record("on_failure")
+	require.Error(t, deployer.Rollback("release-1"))
+	current, _ := deployer.GetCurrentRelease()
+	assert.Equal(t, "release-2", current)
+	assert.NoFileExists(t, hookLog)
+
+	cfg.Hooks.PreRollback = record("pre_rollback")
+	cfg.Hooks.PostRollback = record("post_rollback")
+	require.NoError(t, deployer.Rollback("release-1"))
+	output, err := os.ReadFile(hookLog)
+	require.NoError(t, err)
+	assert.Equal(t, "pre_rollback release-1 release-2\npost_rollback release-1 release-2\n", string(output))
+
+	// on_failure hooks run when the rollback itself fails and get the reason.
+	require.NoError(t, os.Remove(hookLog))
+	cfg.Deploy.Mode = config.ZeroDowntimeMode
+	cfg.Service.StartCommand = "exit 1"
+	cfg.Hooks.OnFailure = []string{fmt.Sprintf(`test -n "$REVLAY_ERROR" && echo failed >> %s`, hookLog)}
+	require.Error(t, deployer.Rollback("release-2"))
+	output, err = os.ReadFile(hookLog)
+	require.NoError(t, err)
+	assert.Equal(t, "pre_rollback release-2 release-1\nfailed\n", string(output))
+}
+
+func TestReleaseManifest(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+
+	sourceDir := filepath.Join(tmpDir, "source")
+	require.NoError(t, os.MkdirAll(filepath.Join(sourceDir, "bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(sourceDir, "bin", "app"), []byte("binary"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(sourceDir, "config.yml"), []byte("port: 1"), 0644))
+	t.Setenv(envDeployer, "alice")
+	t.Setenv(envGitCommit, "0123456789abcdef")
+	t.Setenv(envGitBranch, "main")
+
+	// Nothing is written before the release directory exists.
+	manifest := deployer.newReleaseManifest("release-1", sourceDir, cfg.Service.AltPort)
+	require.NoError(t, deployer.finishReleaseManifest(manifest, nil))
+	assert.NoFileExists(t, filepath.Join(cfg.GetReleasePathByName("release-1"), manifestFile))
+
+	// Once the release directory exists the manifest is written as deploying, so a deploy
+	// that dies halfway leaves a deploying release rather than one without a manifest.
+	require.NoError(t, os.MkdirAll(cfg.GetReleasePathByName("release-1"), 0755))
+	deployer.startReleaseManifest(manifest, newStepLogger())
+	loaded, err := deployer.ReleaseManifest("release-1")
+	require.NoError(t, err)
+	assert.Equal(t, ReleaseDeploying, loaded.Status)
+	assert.Equal(t, "alice", loaded.DeployedBy)
+
+	require.NoError(t, deployer.finishReleaseManifest(manifest, nil))
+	loaded, err = deployer.ReleaseManifest("release-1")
+	require.NoError(t, err)
+	assert.Equal(t, ReleaseLive, loaded.Status)
+	assert.Equal(t, "alice", loaded.DeployedBy)
+	assert.Equal(t, "0123456789abcdef", loaded.GitCommit)
+	assert.Equal(t, "main", loaded.GitBranch)
+	assert.Equal(t, config.ZeroDowntimeMode, loaded.Mode)
+	assert.Equal(t, cfg.Service.AltPort, loaded.Port)
+	assert.Equal(t, int64(len("binary")+len("port: 1")), loaded.SourceSize)
+	assert.Len(t, loaded.SourceChecksum, 64)
+	assert.False(t, loaded.FinishedAt.Before(loaded.StartedAt))
+
+	// The checksum covers file contents.
+	checksum, _, err := checksumDirectory(sourceDir)
+	require.NoError(t, err)
+	assert.Equal(t, loaded.SourceChecksum, checksum)
+	require.NoError(t, os.WriteFile(filepath.Join(sourceDir, "config.yml"), []byte("port: 2"), 0644))
+	checksum, _, err = checksumDirectory(sourceDir)
+	require.NoError(t, err)
+	assert.NotEqual(t, loaded.SourceChecksum, checksum)
+
+	// A failed deploy records the error, which ReleaseFailure reports.
+	require.NoError(t, deployer.finishReleaseManifest(manifest, fmt.Errorf("health check failed")))
+	reason, failed := deployer.ReleaseFailure("release-1")
+	assert.True(t, failed)
+	assert.Equal(t, "health check failed", reason)
+
+	require.NoError(t, deployer.setReleaseStatus("release-1", ReleaseRolledBack, ""))
+	loaded, err = deployer.ReleaseManifest("release-1")
+	require.NoError(t, err)
+	assert.Equal(t, ReleaseRolledBack, loaded.Status)
+	assert.Equal(t, "alice", loaded.DeployedBy)
+	_, failed = deployer.ReleaseFailure("release-1")
+	assert.False(t, failed)
+
+	// Releases deployed before manifests existed only have a name.
+	require.NoError(t, os.MkdirAll(cfg.GetReleasePathByName("release-0"), 0755))
+	loaded, err = deployer.ReleaseManifest("release-0")
+	require.NoError(t, err)
+	assert.Equal(t, &ReleaseManifest{Name: "release-0"}, loaded)
+
+	// Older versions marked failed releases with a .revlay-failed file instead.
+	require.NoError(t, os.WriteFile(filepath.Join(cfg.GetReleasePathByName("release-0"), legacyFailedMarker), []byte("exited\n"), 0644))
+	reason, failed = deployer.ReleaseFailure("release-0")
+	assert.True(t, failed)
+	assert.Equal(t, "exited", reason)
+}
+
+func TestHistory(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ShortDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	t.Setenv(envDeployer, "alice")
+
+	entries, err := deployer.History(time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	require.NoError(t, os.MkdirAll(cfg.GetReleasePathByName("release-1"), 0755))
+	require.NoError(t, deployer.switchSymlink("release-1", nil))
+	deployer.recordHistory(OpDeploy, "release-1", nil)
+	deployer.recordHistory(OpDeploy, "release-2", fmt.Errorf("health check failed"))
+
+	// A torn line does not hide the entries around it.
+	f, err := os.OpenFile(cfg.GetHistoryPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString("{\"time\":\"2024-\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, deployer.appendHistory(HistoryEntry{Time: time.Now().UTC(), Operation: OpStop, Result: ResultSuccess}))
+
+	entries, err = deployer.History(time.Time{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "alice", entries[0].Actor)
+	assert.Equal(t, OpDeploy, entries[0].Operation)
+	assert.Equal(t, "release-1", entries[0].Release)
+	assert.Equal(t, "release-1", entries[0].Live)
+	assert.Equal(t, ResultSuccess, entries[0].Result)
+	assert.Equal(t, "release-2", entries[1].Release)
+	assert.Equal(t, "release-1", entries[1].Live)
+	assert.Equal(t, ResultFailed, entries[1].Result)
+	assert.Equal(t, "health check failed", entries[1].Error)
+	assert.Equal(t, OpStop, entries[2].Operation)
+
+	// --since filters by time.
+	require.NoError(t, deployer.appendHistory(HistoryEntry{Time: time.Now().Add(time.Hour), Operation: OpStart, Result: ResultSuccess}))
+	entries, err = deployer.History(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, OpStart, entries[0].Operation)
+}
+
+func TestRollbackTarget(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ShortDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+	// Names that do not sort in deployment order.
+	for _, release := range []string{"v1", "v2-hotfix", "a3"} {
+		require.NoError(t, os.MkdirAll(cfg.GetReleasePathByName(release), 0755))
+	}
+	activate := func(operation, release string) {
+		require.NoError(t, deployer.switchSymlink(release, nil))
+		deployer.recordHistory(operation, release, nil)
+	}
+
+	// Without history the release directories before the current one are used.
+	require.NoError(t, deployer.switchSymlink("v2-hotfix", nil))
+	target, err := deployer.RollbackTarget(1, false)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", target)
+
+	// After upgrading, releases deployed before the history existed still come before the
+	// first recorded one.
+	deployer.recordHistory(OpStart, "v2-hotfix", nil)
+	target, err = deployer.RollbackTarget(1, false)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", target)
+	target, err = deployer.RollbackTarget(2, false)
+	require.NoError(t, err)
+	assert.Equal(t, "a3", target)
+	require.NoError(t, os.Remove(cfg.GetHistoryPath()))
+
+	activate(OpDeploy, "v1")
+	activate(OpDeploy, "v2-hotfix")
+	deployer.recordHistory(OpStop, "v2-hotfix", nil)
+	activate(OpDeploy, "a3")
+
+	target, err = deployer.RollbackTarget(1, false)
+	require.NoError(t, err)
+	assert.Equal(t, "v2-hotfix", target)
+	target, err = deployer.RollbackTarget(2, false)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", target)
+	_, err = deployer.RollbackTarget(3, false)
+	assert.Error(t, err)
+
+	// After a rollback, rolling back again goes further back.
+	activate(OpRollback, "v2-hotfix")
+	target, err = deployer.RollbackTarget(1, false)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", target)
+
+	// --to-previous-live skips failed releases, rollback refuses them and the current release.
+	activate(OpDeploy, "a3")
+	require.NoError(t, deployer.markReleaseFailed("v2-hotfix", "verification failed"))
+	target, err = deployer.RollbackTarget(1, false)
+	require.NoError(t, err)
+	assert.Equal(t, "v2-hotfix", target)
+	target, err = deployer.RollbackTarget(1, true)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", target)
+	assert.ErrorContains(t, deployer.Rollback("v2-hotfix"), "verification failed")
+	assert.Error(t, deployer.Rollback("a3"))
+	current, _ := deployer.GetCurrentRelease()
+	assert.Equal(t, "a3", current)
+}
+
+// archiveEntry is a file, directory (name ending in /) or symlink (link set) written by writeTestArchive.
+type archiveEntry struct {
+	name, body, link string
+}
+
+func writeTestArchive(t *testing.T, path string, entries []archiveEntry) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	if strings.HasSuffix(path, ".zip") {
+		zw := zip.NewWriter(f)
+		for _, e := range entries {
+			header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+			body := e.body
+			switch {
+			case e.link != "":
+				header.SetMode(os.ModeSymlink | 0777)
+				body = e.link
+			case strings.HasSuffix(e.name, "/"):
+				header.SetMode(os.ModeDir | 0755)
+			default:
+				header.SetMode(0750)
+			}
+			w, err := zw.CreateHeader(header)
+			require.NoError(t, err)
+			_, err = w.Write([]byte(body))
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+		return
+	}
+
+	var compressed io.WriteCloser
+	if strings.HasSuffix(path, ".tar.zst") {
+		compressed, err = zstd.NewWriter(f)
+		require.NoError(t, err)
+	} else {
+		compressed = gzip.NewWriter(f)
+	}
+	tw := tar.NewWriter(compressed)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0750, Size: int64(len(e.body)), Typeflag: tar.TypeReg, ModTime: time.Unix(1700000000, 0)}
+		switch {
+		case e.link != "":
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, e.link, 0
+		case strings.HasSuffix(e.name, "/"):
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		_, err := tw.Write([]byte(e.body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, compressed.Close())
+}
+
+func TestDeployFromArchive(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ShortDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+
+	for _, name := range []string{"app.tar.gz", "app.tar.zst", "app.zip"} {
+		t.Run(name, func(t *testing.T) {
+			archive := filepath.Join(tmpDir, name)
+			writeTestArchive(t, archive, []archiveEntry{
+				{name: "./"},
+				{name: "bin/"},
+				{name: "bin/server", body: "#!/bin/sh\n"},
+				{name: "config/app.yml", body: "port: 8080\n"},
+				{name: "server", link: "bin/server"},
+				{name: "bin/config.yml", link: "../config/app.yml"},
+			})
+			require.True(t, IsArchive(archive))
+
+			release := strings.ReplaceAll(name, ".", "-")
+			require.NoError(t, deployer.setupDirectoriesAndRelease(release, archive, nil))
+			releasePath := cfg.GetReleasePathByName(release)
+			content, err := os.ReadFile(filepath.Join(releasePath, "config", "app.yml"))
+			require.NoError(t, err)
+			assert.Equal(t, "port: 8080\n", string(content))
+			info, err := os.Stat(filepath.Join(releasePath, "bin", "server"))
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+			link, err := os.Readlink(filepath.Join(releasePath, "server"))
+			require.NoError(t, err)
+			assert.Equal(t, "bin/server", link)
+			content, err = os.ReadFile(filepath.Join(releasePath, "bin", "config.yml"))
+			require.NoError(t, err)
+			assert.Equal(t, "port: 8080\n", string(content))
+		})
+	}
+
+	// Entries that would be written outside the release directory are rejected
+	// and the partly extracted release is removed.
+	for name, entries := range map[string][]archiveEntry{
+		"dotdot":        {{name: "ok", body: "x"}, {name: "../escaped", body: "x"}},
+		"absolute":      {{name: "/tmp/escaped", body: "x"}},
+		"symlink":       {{name: "etc", link: "../../../etc"}},
+		"absolute-link": {{name: "etc", link: "/etc"}},
+		"below-symlink": {{name: "dir/"}, {name: "link", link: "dir"}, {name: "link/file", body: "x"}},
+		"chained-symlink": {
+			{name: "d1/"}, {name: "d1/d2/"}, {name: "d1/d2/u", link: "../.."},
+			{name: "t", link: "d1/d2/u/../.."},
+		},
+		"dotdot-before-dir": {{name: "x", link: "later/../.."}, {name: "later/"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			archive := filepath.Join(tmpDir, name+".tar.gz")
+			writeTestArchive(t, archive, entries)
+			err := deployer.setupDirectoriesAndRelease(name, archive, nil)
+			assert.Error(t, err)
+			assert.NoDirExists(t, cfg.GetReleasePathByName(name))
+			assert.NoFileExists(t, filepath.Join(tmpDir, "escaped"))
+		})
+	}
+}
+
+func TestSetupReleaseHardlinksUnchangedFiles(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ShortDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	cfg.Deploy.HardlinkUnchanged = true
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+
+	sourceDir := filepath.Join(tmpDir, "source")
+	mtime := time.Unix(1700000000, 0)
+	writeSource := func(name, content string, mtime time.Time) {
+		path := filepath.Join(sourceDir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	writeSource("vendor/lib.js", "unchanged", mtime)
+	writeSource("app.js", "version 1", mtime)
+	writeSource("config.yml", "port: 1", mtime)
+
+	// The first release has nothing to link from, copies keep the modification time.
+	require.NoError(t, deployer.setupDirectoriesAndRelease("release-1", sourceDir, nil))
+	info, err := os.Stat(filepath.Join(cfg.GetReleasePathByName("release-1"), "app.js"))
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(mtime))
+	require.NoError(t, deployer.switchSymlink("release-1", nil))
+
+	writeSource("app.js", "version 2", mtime)                  // same size and mtime, different content
+	writeSource("config.yml", "port: 1", mtime.Add(time.Hour)) // same content, touched
+	require.NoError(t, deployer.setupDirectoriesAndRelease("release-2", sourceDir, nil))
+
+	sameInode := func(name string) bool {
+		a, err := os.Stat(filepath.Join(cfg.GetReleasePathByName("release-1"), name))
+		require.NoError(t, err)
+		b, err := os.Stat(filepath.Join(cfg.GetReleasePathByName("release-2"), name))
+		require.NoError(t, err)
+		return os.SameFile(a, b)
+	}
+	assert.True(t, sameInode("vendor/lib.js"))
+	assert.False(t, sameInode("app.js"))
+	assert.False(t, sameInode("config.yml"))
+	content, err := os.ReadFile(filepath.Join(cfg.GetReleasePathByName("release-2"), "app.js"))
+	require.NoError(t, err)
+	assert.Equal(t, "version 2", string(content))
+
+	// Without the option every file is copied.
+	cfg.Deploy.HardlinkUnchanged = false
+	require.NoError(t, deployer.setupDirectoriesAndRelease("release-3", sourceDir, nil))
+	a, err := os.Stat(filepath.Join(cfg.GetReleasePathByName("release-1"), "vendor/lib.js"))
+	require.NoError(t, err)
+	b, err := os.Stat(filepath.Join(cfg.GetReleasePathByName("release-3"), "vendor/lib.js"))
+	require.NoError(t, err)
+	assert.False(t, os.SameFile(a, b))
+}
+
+func TestSpawnService_ResolvesTemplate(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ZeroDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	require.NoError(t, os.MkdirAll(cfg.GetReleasePathByName("release-1"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "pids"), 0755))
+	output := filepath.Join(tmpDir, "started")
+	cfg.Service.StartCommand = "echo {{release}} {{.ReleaseName}} > " + output
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+
+	cmd, err := deployer.spawnService("release-1", cfg.Service.AltPort)
+	require.NoError(t, err)
+	require.NoError(t, cmd.Wait())
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "release-1 release-1\n", string(content))
+}
+
+func TestGracePeriod_DefaultsWhenUnset(t *testing.T) {
+	cfg, tmpDir := setupTestEnv(t, config.ShortDowntimeMode)
+	defer os.RemoveAll(tmpDir)
+	deployer := NewLocalDeployer(cfg).(*LocalDeployer)
+
+	cfg.Service.GracefulTimeout = 0
+	assert.Equal(t, defaultGracePeriod, deployer.gracePeriod())
+	cfg.Service.GracefulTimeout = 3
+	assert.Equal(t, 3*time.Second, deployer.gracePeriod())
+}
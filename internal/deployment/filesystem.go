@@ -1,6 +1,8 @@
 package deployment
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
@@ -57,6 +59,7 @@ func (d *LocalDeployer) setupDirectories(logger *stepLogger) error {
 }
 
 // setupDirectoriesAndRelease creates the directory for a new release and copies the source code.
+// sourceDir may also be a .tar.gz, .tar.zst or .zip archive, which is extracted into the release.
 func (d *LocalDeployer) setupDirectoriesAndRelease(releaseName string, sourceDir string, logger *stepLogger) error {
 	// 创建目录结构
 	if logger != nil {
@@ -73,15 +76,37 @@ func (d *LocalDeployer) setupDirectoriesAndRelease(releaseName string, sourceDir
 		logger.SystemLog(fmt.Sprintf("准备创建版本目录: %s", releasePath))
 	}
 
-	// 如果提供了源目录，则复制内容
-	if sourceDir != "" {
+	// 如果提供了压缩包，则解压到版本目录
+	if IsArchive(sourceDir) {
+		if logger != nil {
+			logger.SystemLog(fmt.Sprintf("解压压缩包: %s -> %s", sourceDir, releasePath))
+		}
+		if err := extractArchive(sourceDir, releasePath); err != nil {
+			return fmt.Errorf("failed to extract archive %s: %w", sourceDir, err)
+		}
+		if logger != nil {
+			logger.SystemLog("压缩包解压完成")
+		}
+	} else if sourceDir != "" {
+		// 如果提供了源目录，则复制内容
 		if logger != nil {
 			logger.SystemLog(fmt.Sprintf("从源目录复制内容: %s -> %s", sourceDir, releasePath))
 		}
-		if err := copyDirectory(sourceDir, releasePath); err != nil {
+		// 从当前版本硬链接没有变化的文件，节省复制时间和磁盘空间
+		var linkFrom string
+		if d.config.Deploy.HardlinkUnchanged {
+			if current, err := d.GetCurrentRelease(); err == nil && current != releaseName {
+				linkFrom = d.config.GetReleasePathByName(current)
+			}
+		}
+		linked, err := copyDirectory(sourceDir, releasePath, linkFrom)
+		if err != nil {
 			return fmt.Errorf("failed to copy from source directory %s: %w", sourceDir, err)
 		}
 		if logger != nil {
+			if linkFrom != "" {
+				logger.SystemLog(fmt.Sprintf("从当前版本硬链接了 %d 个没有变化的文件: %s", linked, linkFrom))
+			}
 			logger.SystemLog("源目录内容复制完成")
 		}
 	} else {
@@ -326,14 +351,18 @@ func (d *LocalDeployer) resolvePath(pathTemplate string, releaseName string) str
 	return filepath.Join(d.config.RootPath, resolved)
 }
 
-// copyDirectory copies a directory from src to dest.
-func copyDirectory(src, dest string) error {
+// copyDirectory copies a directory from src to dest. If linkFrom is set, files that are
+// unchanged in linkFrom (the previous release) are hardlinked from there instead of copied,
+// and the number of linked files is returned. A file counts as unchanged when its size,
+// modification time, permissions and sha256 are the same.
+func copyDirectory(src, dest, linkFrom string) (int, error) {
 	// Create the destination directory
 	if err := os.MkdirAll(dest, 0755); err != nil {
-		return err
+		return 0, err
 	}
 
-	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
+	linked := 0
+	err := filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -355,24 +384,69 @@ func copyDirectory(src, dest string) error {
 			return nil
 		}
 
-		return copyRegularFile(path, destPath, info.Mode())
+		if linkFrom != "" {
+			previous := filepath.Join(linkFrom, relPath)
+			if sameFile(path, info, previous) && os.Link(previous, destPath) == nil {
+				linked++
+				return nil
+			}
+			// 文件有变化，或者不能创建硬链接（例如跨文件系统），复制文件
+		}
+		return copyRegularFile(path, destPath, info)
 	})
+	return linked, err
+}
+
+// sameFile reports whether previous is a regular file with the same size, modification
+// time, permissions and content as the file at path.
+func sameFile(path string, info fs.FileInfo, previous string) bool {
+	prevInfo, err := os.Lstat(previous)
+	if err != nil || !prevInfo.Mode().IsRegular() {
+		return false
+	}
+	if prevInfo.Size() != info.Size() || !prevInfo.ModTime().Equal(info.ModTime()) || prevInfo.Mode().Perm() != info.Mode().Perm() {
+		return false
+	}
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return false
+	}
+	prevSum, err := fileChecksum(previous)
+	return err == nil && sum == prevSum
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// copyRegularFile copies a single regular file.
-func copyRegularFile(src, dest string, mode os.FileMode) error {
+// copyRegularFile copies a single regular file, keeping its permissions and modification time
+// so that the next deploy can tell whether it changed.
+func copyRegularFile(src, dest string, info fs.FileInfo) error {
 	sourceFile, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer sourceFile.Close()
 
-	destFile, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	destFile, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode())
 	if err != nil {
 		return err
 	}
-	defer destFile.Close()
-
-	_, err = io.Copy(destFile, sourceFile)
-	return err
+	if _, err := io.Copy(destFile, sourceFile); err != nil {
+		destFile.Close()
+		return err
+	}
+	if err := destFile.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
 }
@@ -0,0 +1,197 @@
+package deployment
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/color"
+	"github.com/xukonxe/revlay/internal/config"
+	"github.com/xukonxe/revlay/internal/i18n"
+)
+
+// maxHealthCheckBody limits how much of a response body is read to match body_contains and body_regex
+const maxHealthCheckBody = 1 << 20
+
+// performHealthCheck performs a health check on the given port.
+func (d *LocalDeployer) performHealthCheck(port int) error {
+	return d.waitForService(port)
+}
+
+// waitForService waits for a service to pass service.health_check on a given port.
+func (d *LocalDeployer) waitForService(port int) error {
+	if d.config.Service.HealthCheck.Kind() == config.NoHealthCheck {
+		log.Println(color.Yellow(i18n.T().DeployHealthSkipped))
+		return nil
+	}
+
+	maxRetries := d.config.Service.HealthCheckRetries
+	if maxRetries <= 0 {
+		maxRetries = 10 // Default retries
+	}
+
+	timeout := d.config.Service.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = 5 // Default timeout in seconds
+	}
+
+	interval := d.config.Service.HealthCheckInterval
+	if interval <= 0 {
+		interval = 2 // Default interval in seconds
+	}
+
+	target := d.healthCheckTarget(port)
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		log.Print(i18n.Sprintf(i18n.T().DeployHealthAttempt, i+1, target))
+		if err = d.probeHealth(port, time.Duration(timeout)*time.Second); err == nil {
+			log.Println(color.Green(i18n.T().DeployHealthPassed))
+			return nil // Service is healthy
+		}
+
+		if i < maxRetries-1 {
+			time.Sleep(time.Duration(interval) * time.Second)
+		}
+	}
+
+	return fmt.Errorf("service at %s did not pass the health check after %d attempts: %w", target, maxRetries, err)
+}
+
+// healthCheckTarget describes what the health check of port checks, for log messages.
+func (d *LocalDeployer) healthCheckTarget(port int) string {
+	check := d.config.Service.HealthCheck
+	switch check.Kind() {
+	case config.TCPHealthCheck:
+		return fmt.Sprintf("tcp://localhost:%d", port)
+	case config.ExecHealthCheck:
+		return fmt.Sprintf("'%s' (PORT=%d)", check.Command, port)
+	default:
+		return healthCheckURL(check, port)
+	}
+}
+
+// probeHealth runs service.health_check once against port.
+func (d *LocalDeployer) probeHealth(port int, timeout time.Duration) error {
+	check := d.config.Service.HealthCheck
+	switch check.Kind() {
+	case config.NoHealthCheck:
+		return nil
+	case config.TCPHealthCheck:
+		return probeTCP(port, timeout)
+	case config.ExecHealthCheck:
+		return d.probeExec(port, timeout)
+	default:
+		return probeHTTP(check, port, timeout)
+	}
+}
+
+func healthCheckURL(check config.HealthCheck, port int) string {
+	scheme := "http"
+	if check.HTTPS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://localhost:%d%s", scheme, port, check.Path)
+}
+
+// probeHTTP sends the health check request. Without expected_status any 2xx or 3xx status
+// counts as healthy. Redirects are not followed.
+func probeHTTP(check config.HealthCheck, port int, timeout time.Duration) error {
+	url := healthCheckURL(check, port)
+	method := check.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(strings.ToUpper(method), url, nil)
+	if err != nil {
+		return err
+	}
+	for key, value := range check.Headers {
+		if strings.EqualFold(key, "Host") {
+			req.Host = value
+		} else {
+			req.Header.Set(key, value)
+		}
+	}
+
+	client := http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	if check.HTTPS {
+		// 服务通常使用为公网域名签发的证书，通过 localhost 访问时无法验证
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Ensure body is closed to prevent resource leaks
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+	if err != nil {
+		return fmt.Errorf("%s: could not read response: %w", url, err)
+	}
+
+	if len(check.ExpectedStatus) > 0 {
+		if !slices.Contains(check.ExpectedStatus, resp.StatusCode) {
+			return fmt.Errorf("%s returned status %d, expected %v", url, resp.StatusCode, check.ExpectedStatus)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	if check.BodyContains != "" && !strings.Contains(string(body), check.BodyContains) {
+		return fmt.Errorf("%s: response does not contain '%s'", url, check.BodyContains)
+	}
+	if check.BodyRegex != "" {
+		matched, err := regexp.Match(check.BodyRegex, body)
+		if err != nil {
+			return fmt.Errorf("invalid body_regex: %w", err)
+		}
+		if !matched {
+			return fmt.Errorf("%s: response does not match '%s'", url, check.BodyRegex)
+		}
+	}
+	return nil
+}
+
+// probeTCP checks that the service accepts connections on port.
+func probeTCP(port int, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeExec runs the health check command through sh in the release running on port,
+// with the same environment as the service. It passes when the command exits with status 0.
+func (d *LocalDeployer) probeExec(port int, timeout time.Duration) error {
+	releaseName := ""
+	if record, err := d.readProcessRecord(port); err == nil {
+		releaseName = record.Release
+	}
+	command, err := d.resolveTemplate(d.config.Service.HealthCheck.Command, releaseName)
+	if err != nil {
+		return fmt.Errorf("could not resolve command template: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := shellCommand(ctx, command)
+	cmd.Dir = d.commandDir(releaseName)
+	cmd.Env = d.serviceEnv(port)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("'%s' failed: %w: %s", command, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
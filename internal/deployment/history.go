@@ -0,0 +1,201 @@
+package deployment
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/i18n"
+)
+
+// 历史记录中的操作
+const (
+	OpDeploy       = "deploy"
+	OpRollback     = "rollback"
+	OpAutoRollback = "auto-rollback" // 部署失败或验证失败后自动切回之前的版本
+	OpStart        = "start"
+	OpStop         = "stop"
+)
+
+// 历史记录中操作的结果
+const (
+	ResultSuccess = "success"
+	ResultFailed  = "failed"
+)
+
+// HistoryEntry 是 .revlay/history.jsonl 中的一条记录
+type HistoryEntry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor,omitempty"`
+	Operation string    `json:"operation"`
+	Release   string    `json:"release,omitempty"`
+	// Live 是操作结束后 current 指向的版本，用于按上线顺序回滚
+	Live   string `json:"live,omitempty"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// recordHistory 在历史记录末尾追加一条记录，opErr 为 nil 表示操作成功
+// 历史记录只用于审计，写入失败不影响操作本身
+func (d *LocalDeployer) recordHistory(operation, releaseName string, opErr error) {
+	entry := HistoryEntry{
+		Time:      time.Now().UTC(),
+		Actor:     deployActor(),
+		Operation: operation,
+		Release:   releaseName,
+		Result:    ResultSuccess,
+	}
+	entry.Live, _ = d.GetCurrentRelease()
+	if opErr != nil {
+		entry.Result = ResultFailed
+		entry.Error = opErr.Error()
+	}
+	if err := d.appendHistory(entry); err != nil {
+		log.Printf("Could not record %s in the history: %v", operation, err)
+	}
+}
+
+func (d *LocalDeployer) appendHistory(entry HistoryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	path := d.config.GetHistoryPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// O_APPEND 保证同时写入的记录不会互相覆盖
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// History 按时间顺序返回 since 之后（含）的历史记录，since 为零值时返回全部记录
+func (d *LocalDeployer) History(since time.Time) ([]HistoryEntry, error) {
+	f, err := os.Open(d.config.GetHistoryPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read the history: %w", err)
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry HistoryEntry
+		// 跳过写了一半或者损坏的行，不影响其它记录
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if entry.Time.Before(since) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read the history: %w", err)
+	}
+	return entries, nil
+}
+
+// deployActor 返回执行操作的用户，通过 revlay push 部署时是推送的用户
+func deployActor() string {
+	if actor := os.Getenv(envDeployer); actor != "" {
+		return actor
+	}
+	return currentUser()
+}
+
+// previousLiveReleases 按上线顺序返回当前版本之前上线过的版本，最近的在前
+// 上线顺序从历史记录中还原：部署上线的版本入栈，回滚到栈中已有的版本时出栈到该版本，
+// 因此连续回滚会一步步退回更早的版本。已清理的版本不在结果中。
+// 历史记录出现之前部署的版本按版本目录的顺序排在第一个有记录的版本（没有记录时是当前版本）之前。
+func (d *LocalDeployer) previousLiveReleases() ([]string, error) {
+	entries, err := d.History(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	current, _ := d.GetCurrentRelease()
+
+	// 升级到有历史记录的版本之前部署的版本
+	anchor := current
+	for _, e := range entries {
+		if e.Live != "" {
+			anchor = e.Live
+			break
+		}
+	}
+	releases, err := d.ListReleases()
+	if err != nil {
+		return nil, err
+	}
+	var stack []string
+	if i := slices.Index(releases, anchor); i >= 0 {
+		stack = slices.Clone(releases[:i+1])
+	}
+
+	for _, e := range entries {
+		if e.Live == "" || (len(stack) > 0 && stack[len(stack)-1] == e.Live) {
+			continue
+		}
+		if e.Operation == OpRollback || e.Operation == OpAutoRollback {
+			if i := slices.Index(stack, e.Live); i >= 0 {
+				stack = stack[:i+1]
+				continue
+			}
+		}
+		stack = append(stack, e.Live)
+	}
+
+	var previous []string
+	for i := len(stack) - 1; i >= 0; i-- {
+		release := stack[i]
+		if release == current || slices.Contains(previous, release) || !isDir(d.config.GetReleasePathByName(release)) {
+			continue
+		}
+		previous = append(previous, release)
+	}
+	return previous, nil
+}
+
+// RollbackTarget 返回回滚的目标版本：按上线顺序往回数 steps 个版本，
+// toPreviousLive 为 true 时返回最近一个上线过且没有被标记为失败的版本
+func (d *LocalDeployer) RollbackTarget(steps int, toPreviousLive bool) (string, error) {
+	previous, err := d.previousLiveReleases()
+	if err != nil {
+		return "", err
+	}
+	if toPreviousLive {
+		for _, release := range previous {
+			if _, failed := d.ReleaseFailure(release); !failed {
+				return release, nil
+			}
+		}
+		return "", errors.New(i18n.T().RollbackNoReleases)
+	}
+	if steps < 1 {
+		return "", fmt.Errorf("--steps must be at least 1")
+	}
+	if len(previous) == 0 {
+		return "", errors.New(i18n.T().RollbackNoReleases)
+	}
+	if steps > len(previous) {
+		return "", fmt.Errorf(i18n.T().RollbackNotEnoughHistory, len(previous), steps)
+	}
+	return previous[steps-1], nil
+}
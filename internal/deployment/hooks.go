@@ -0,0 +1,142 @@
+package deployment
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/color"
+	"github.com/xukonxe/revlay/internal/config"
+	"github.com/xukonxe/revlay/internal/i18n"
+)
+
+// defaultHookTimeout 是没有配置 hooks.timeout_seconds 时每个钩子的最长运行时间
+const defaultHookTimeout = 5 * time.Minute
+
+// hookContext 描述钩子所属的部署，以环境变量的形式传给钩子
+type hookContext struct {
+	// Release 是正在部署或回滚到的版本
+	Release string
+	// PreviousRelease 是部署开始时的当前版本，首次部署时为空
+	PreviousRelease string
+	// Port 是新版本运行的端口
+	Port int
+	// Error 是 on-failure 钩子收到的失败原因
+	Error string
+}
+
+// hookStage 是部署中的一个阶段和它的钩子
+type hookStage struct {
+	name  string
+	hooks []string
+}
+
+// newHookContext 在部署开始、切换之前确定钩子的上下文
+func (d *LocalDeployer) newHookContext(releaseName string) hookContext {
+	previous, _ := d.GetCurrentRelease()
+	port := d.config.Service.Port
+	if d.config.Deploy.Mode == config.ZeroDowntimeMode {
+		_, port, _ = d.determinePorts()
+	}
+	return hookContext{Release: releaseName, PreviousRelease: previous, Port: port}
+}
+
+// env 返回钩子的环境变量
+func (c hookContext) env(releasePath string) []string {
+	env := []string{
+		"REVLAY_RELEASE=" + c.Release,
+		"REVLAY_RELEASE_PATH=" + releasePath,
+		"REVLAY_PREVIOUS_RELEASE=" + c.PreviousRelease,
+		fmt.Sprintf("REVLAY_PORT=%d", c.Port),
+	}
+	if c.Error != "" {
+		env = append(env, "REVLAY_ERROR="+c.Error)
+	}
+	return env
+}
+
+// runHooks 依次执行一个阶段的钩子，任何一个失败都会停止执行并返回错误
+// 钩子通过 sh -c 在新版本目录（或其中的 hooks.working_dir）中运行，输出逐行显示在 logger 中
+func (d *LocalDeployer) runHooks(hooks []string, stage string, hc hookContext, logger *stepLogger) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	if logger == nil {
+		logger = newStepLogger()
+	}
+	logger.SystemLog(color.Cyan(i18n.T().DeployRunningHooks, stage))
+
+	for _, hook := range hooks {
+		resolvedHook, err := d.resolveTemplate(hook, hc.Release)
+		if err != nil {
+			return fmt.Errorf("could not resolve hook template '%s': %w", hook, err)
+		}
+		if strings.TrimSpace(resolvedHook) == "" {
+			continue
+		}
+		if err := d.runHook(resolvedHook, stage, hc, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHook 执行单个钩子，超过 hooks.timeout_seconds 时结束它的整个进程组
+func (d *LocalDeployer) runHook(command, stage string, hc hookContext, logger *stepLogger) error {
+	timeout := time.Duration(d.config.Hooks.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// 首次部署的 pre-deploy 钩子运行时版本目录还不存在，此时在应用根目录中运行
+	releasePath := d.config.GetReleasePathByName(hc.Release)
+	dir := d.commandDir(hc.Release)
+	if d.config.Hooks.WorkingDir != "" && dir == releasePath {
+		dir = filepath.Join(releasePath, d.config.Hooks.WorkingDir)
+	}
+
+	cmd := shellCommand(ctx, command)
+	cmd.Dir = dir
+	cmd.Env = append(d.serviceEnv(hc.Port), hc.env(releasePath)...)
+
+	output, writer := io.Pipe()
+	cmd.Stdout, cmd.Stderr = writer, writer
+	streamed := make(chan struct{})
+	go func() {
+		defer close(streamed)
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			logger.SystemLog(fmt.Sprintf("    [%s] %s", stage, scanner.Text()))
+		}
+		io.Copy(io.Discard, output)
+	}()
+
+	logger.SystemLog(fmt.Sprintf("  $ %s", command))
+	err := cmd.Run()
+	writer.Close()
+	<-streamed
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf(i18n.T().DeployHookTimedOut, command, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("hook '%s' failed: %w", command, err)
+	}
+	return nil
+}
+
+// runFailureHooks 在部署或回滚失败后执行 on-failure 钩子，它们失败时只记录日志
+func (d *LocalDeployer) runFailureHooks(hc hookContext, cause error) {
+	hc.Error = cause.Error()
+	if err := d.runHooks(d.config.Hooks.OnFailure, "on-failure", hc, nil); err != nil {
+		log.Printf("on-failure hook failed: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package deployment
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/ui"
+)
+
+// logFollowInterval 是检查日志文件新内容的间隔
+const logFollowInterval = 200 * time.Millisecond
+
+// followLogs 从当前末尾开始跟踪版本的日志文件，把新写入的行显示在部署输出中
+// 服务作为守护进程运行，输出写入日志文件而不是管道，部署命令退出后服务不受影响
+// 返回的函数停止跟踪，调用前会先显示已写入的剩余内容
+func (d *LocalDeployer) followLogs(releaseName string, formatter *ui.DeploymentFormatter) func() {
+	streams := map[string]string{}
+	if d.config.Service.StdoutLog != "" {
+		streams["out"] = d.resolvePath(d.config.Service.StdoutLog, releaseName)
+	}
+	if d.config.Service.StderrLog != "" {
+		if path := d.resolvePath(d.config.Service.StderrLog, releaseName); path != streams["out"] {
+			streams["err"] = path
+		}
+	}
+
+	emit := func(streamType, line string) {
+		if formatter != nil {
+			formatter.StreamLog(releaseName, streamType, line)
+		} else {
+			log.Printf("[%s-%s] %s", releaseName, streamType, line)
+		}
+	}
+
+	if formatter != nil {
+		formatter.StartStreaming(releaseName)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for streamType, path := range streams {
+		// 其他版本也可能写同一个日志文件，只显示从现在开始写入的内容
+		var offset int64
+		if info, err := os.Stat(path); err == nil {
+			offset = info.Size()
+		}
+		wg.Add(1)
+		go func(streamType, path string, offset int64) {
+			defer wg.Done()
+			var partial string
+			for {
+				offset, partial = readNewLines(path, offset, partial, func(line string) { emit(streamType, line) })
+				select {
+				case <-stop:
+					if partial != "" {
+						emit(streamType, partial)
+					}
+					return
+				case <-time.After(logFollowInterval):
+				}
+			}
+		}(streamType, path, offset)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			wg.Wait()
+			if formatter != nil {
+				formatter.StopStreaming()
+			}
+		})
+	}
+}
+
+// readNewLines 读取文件中 offset 之后的完整行，返回新的 offset 和未以换行结束的部分
+// 文件被截断时从头开始读
+func readNewLines(path string, offset int64, partial string, emit func(string)) (int64, string) {
+	f, err := os.Open(path)
+	if err != nil {
+		return offset, partial
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() < offset {
+		offset, partial = 0, ""
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, partial
+	}
+
+	reader := bufio.NewReader(f)
+	for {
+		chunk, err := reader.ReadString('\n')
+		offset += int64(len(chunk))
+		partial += chunk
+		if err != nil {
+			return offset, partial
+		}
+		emit(strings.TrimRight(partial, "\r\n"))
+		partial = ""
+	}
+}
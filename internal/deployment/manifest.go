@@ -0,0 +1,244 @@
+package deployment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/config"
+)
+
+// manifestFile 是每个版本目录中记录版本元数据的文件
+const manifestFile = ".revlay-release.json"
+
+// ReleaseStatus 是版本部署的最终结果
+type ReleaseStatus string
+
+const (
+	// ReleaseDeploying 表示部署还在进行中，或者部署进程意外退出
+	ReleaseDeploying ReleaseStatus = "deploying"
+	// ReleaseLive 表示部署成功，版本上线
+	ReleaseLive ReleaseStatus = "live"
+	// ReleaseFailed 表示部署失败，或者上线后没有通过验证
+	ReleaseFailed ReleaseStatus = "failed"
+	// ReleaseRolledBack 表示版本上线后被回滚
+	ReleaseRolledBack ReleaseStatus = "rolled-back"
+)
+
+// ReleaseManifest 记录一个版本是谁、从哪里、如何部署的，以及部署的结果
+type ReleaseManifest struct {
+	Name          string `json:"name"`
+	DeployedBy    string `json:"deployed_by,omitempty"`
+	Host          string `json:"host,omitempty"`
+	RevlayVersion string `json:"revlay_version,omitempty"`
+	GitCommit     string `json:"git_commit,omitempty"`
+	GitBranch     string `json:"git_branch,omitempty"`
+	// SourceChecksum 是源目录中所有文件路径和内容的 sha256
+	SourceChecksum string                `json:"source_checksum,omitempty"`
+	SourceSize     int64                 `json:"source_size"`
+	Mode           config.DeploymentMode `json:"mode"`
+	Port           int                   `json:"port,omitempty"`
+	StartedAt      time.Time             `json:"started_at"`
+	FinishedAt     time.Time             `json:"finished_at,omitempty"`
+	// Duration 是部署用时，单位为秒
+	Duration float64       `json:"duration_seconds"`
+	Status   ReleaseStatus `json:"status"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// revlayVersion 是写入版本元数据的 revlay 版本，由命令行在启动时设置
+var revlayVersion string
+
+// SetVersion 设置写入版本元数据的 revlay 版本
+func SetVersion(v string) {
+	revlayVersion = v
+}
+
+// 通过 revlay push 部署时，客户端用这些环境变量传递部署者、来源主机和 git 信息
+const (
+	envDeployer   = "REVLAY_DEPLOYER"
+	envSourceHost = "REVLAY_SOURCE_HOST"
+	envGitCommit  = "REVLAY_GIT_COMMIT"
+	envGitBranch  = "REVLAY_GIT_BRANCH"
+)
+
+// newReleaseManifest 在部署开始时收集版本的元数据
+func (d *LocalDeployer) newReleaseManifest(releaseName, sourceDir string, port int) *ReleaseManifest {
+	manifest := &ReleaseManifest{
+		Name:          releaseName,
+		DeployedBy:    deployActor(),
+		Host:          os.Getenv(envSourceHost),
+		RevlayVersion: revlayVersion,
+		GitCommit:     os.Getenv(envGitCommit),
+		GitBranch:     os.Getenv(envGitBranch),
+		Mode:          d.config.Deploy.Mode,
+		Port:          port,
+		StartedAt:     time.Now(),
+		Status:        ReleaseDeploying,
+	}
+	if manifest.Host == "" {
+		manifest.Host, _ = os.Hostname()
+	}
+	if sourceDir != "" {
+		if manifest.GitCommit == "" {
+			manifest.GitCommit, manifest.GitBranch = gitInfo(sourceDir)
+		}
+		manifest.SourceChecksum, manifest.SourceSize, _ = checksumDirectory(sourceDir)
+	}
+	return manifest
+}
+
+// startReleaseManifest 在版本目录创建后立即写入 deploying 状态的元数据
+// 部署进程中途退出时，版本仍然带着 deploying 状态，而不会被当成没有元数据的旧版本
+func (d *LocalDeployer) startReleaseManifest(manifest *ReleaseManifest, logger *stepLogger) {
+	if manifest == nil {
+		return
+	}
+	if err := d.writeReleaseManifest(manifest); err != nil {
+		logger.Warn(fmt.Sprintf("Could not write the release manifest: %v", err))
+	}
+}
+
+// finishReleaseManifest 记录部署的结果，版本目录不存在时（部署在创建它之前就失败了）不写入
+func (d *LocalDeployer) finishReleaseManifest(manifest *ReleaseManifest, deployErr error) error {
+	if !isDir(d.config.GetReleasePathByName(manifest.Name)) {
+		return nil
+	}
+	manifest.FinishedAt = time.Now()
+	manifest.Duration = manifest.FinishedAt.Sub(manifest.StartedAt).Round(time.Millisecond).Seconds()
+	manifest.Status = ReleaseLive
+	if deployErr != nil {
+		manifest.Status = ReleaseFailed
+		manifest.Error = deployErr.Error()
+	}
+	return d.writeReleaseManifest(manifest)
+}
+
+// legacyFailedMarker 是引入元数据之前标记失败版本的文件，内容为失败原因
+const legacyFailedMarker = ".revlay-failed"
+
+// ReleaseManifest 读取版本的元数据，没有元数据的旧版本返回只有名称的记录
+// 旧版本带有 .revlay-failed 标记时，记录为失败版本
+func (d *LocalDeployer) ReleaseManifest(releaseName string) (*ReleaseManifest, error) {
+	releasePath := d.config.GetReleasePathByName(releaseName)
+	data, err := os.ReadFile(filepath.Join(releasePath, manifestFile))
+	if os.IsNotExist(err) {
+		manifest := &ReleaseManifest{Name: releaseName}
+		if reason, err := os.ReadFile(filepath.Join(releasePath, legacyFailedMarker)); err == nil {
+			manifest.Status = ReleaseFailed
+			manifest.Error = strings.TrimSpace(string(reason))
+		}
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest ReleaseManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid release manifest of %s: %w", releaseName, err)
+	}
+	manifest.Name = releaseName
+	return &manifest, nil
+}
+
+// writeReleaseManifest 写入版本的元数据
+func (d *LocalDeployer) writeReleaseManifest(manifest *ReleaseManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.config.GetReleasePathByName(manifest.Name), manifestFile)
+	// 先写临时文件再改名，读取方不会看到写了一半的元数据
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// setReleaseStatus 更新版本元数据中的状态
+func (d *LocalDeployer) setReleaseStatus(releaseName string, status ReleaseStatus, reason string) error {
+	manifest, err := d.ReleaseManifest(releaseName)
+	if err != nil {
+		return err
+	}
+	manifest.Status = status
+	manifest.Error = reason
+	if err := d.writeReleaseManifest(manifest); err != nil {
+		return fmt.Errorf("could not update the status of release %s: %w", releaseName, err)
+	}
+	return nil
+}
+
+// currentUser 返回运行 revlay 的用户，通过 sudo 运行时返回调用 sudo 的用户
+func currentUser() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// gitInfo 返回源目录所在 git 仓库的当前提交和分支，不是 git 仓库时返回空
+func gitInfo(dir string) (commit, branch string) {
+	run := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(out))
+	}
+	commit = run("rev-parse", "HEAD")
+	if commit == "" {
+		return "", ""
+	}
+	if branch = run("rev-parse", "--abbrev-ref", "HEAD"); branch == "HEAD" {
+		branch = "" // detached HEAD
+	}
+	return commit, branch
+}
+
+// checksumDirectory 计算目录中所有普通文件的路径和内容的 sha256 以及文件的总大小
+func checksumDirectory(dir string) (string, int64, error) {
+	hash := sha256.New()
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && entry.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(hash, "%s\x00", filepath.ToSlash(rel))
+		n, err := io.Copy(hash, f)
+		size += n
+		return err
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
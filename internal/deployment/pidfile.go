@@ -0,0 +1,275 @@
+package deployment
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/config"
+	"github.com/xukonxe/revlay/internal/supervisor"
+)
+
+// ProcessRecord 描述在某个端口（蓝绿部署中的一个颜色）上运行的服务进程
+// revlay 每次启动服务都会为端口写一个记录文件，停止、状态查询和回滚都依据它找到进程
+type ProcessRecord struct {
+	PID       int       `json:"pid"`
+	Port      int       `json:"port"`
+	Release   string    `json:"release,omitempty"`
+	Command   string    `json:"command,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+	// ProcessGroup 表示进程在自己的进程组中运行，停止时向整个进程组发送信号
+	ProcessGroup bool `json:"process_group"`
+	// Source 说明进程是如何找到的：record、supervisor、pid_file 或 /proc/net/tcp
+	Source string `json:"-"`
+}
+
+// 进程的来源
+const (
+	processSourceRecord     = "record"
+	processSourceSupervisor = "supervisor"
+	processSourcePidFile    = "pid_file"
+	processSourceProcNet    = "/proc/net/tcp"
+)
+
+// writeProcessRecord 写入端口的进程记录
+func (d *LocalDeployer) writeProcessRecord(record *ProcessRecord) error {
+	path := d.config.GetProcessRecordPath(record.Port)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if record.StartedAt.IsZero() {
+		record.StartedAt = time.Now()
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再改名，读取方不会看到写了一半的记录
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readProcessRecord 读取端口的进程记录
+func (d *LocalDeployer) readProcessRecord(port int) (*ProcessRecord, error) {
+	data, err := os.ReadFile(d.config.GetProcessRecordPath(port))
+	if err != nil {
+		return nil, err
+	}
+	var record ProcessRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid process record: %w", err)
+	}
+	record.Source = processSourceRecord
+	return &record, nil
+}
+
+// removeProcessRecord 删除端口的进程记录，主端口上同时删除 service.pid_file
+func (d *LocalDeployer) removeProcessRecord(port int) {
+	os.Remove(d.config.GetProcessRecordPath(port))
+	if port == d.config.Service.Port && d.config.Service.PidFile != "" {
+		os.Remove(d.resolvePath(d.config.Service.PidFile, ""))
+	}
+}
+
+// ServiceProcess 返回在指定端口上运行的服务进程，port 为 0 时使用当前接收流量的端口
+// 没有进程在运行时返回 nil
+func (d *LocalDeployer) ServiceProcess(port int) (*ProcessRecord, error) {
+	if port == 0 {
+		port = d.activePort()
+	}
+	return d.findProcess(port, true)
+}
+
+// activePort 返回当前接收流量的端口，short_downtime 模式下总是 service.port
+func (d *LocalDeployer) activePort() int {
+	if d.config.Deploy.Mode == config.ZeroDowntimeMode {
+		if port, err := d.getCurrentPortFromState(); err == nil {
+			return port
+		}
+	}
+	return d.config.Service.Port
+}
+
+// findProcess 查找在端口上运行的进程，依次使用进程记录、supervisor 的状态和 service.pid_file
+// scanSockets 为 true 时，在都没有记录的情况下从 /proc/net/tcp 中查找监听该端口的进程
+func (d *LocalDeployer) findProcess(port int, scanSockets bool) (*ProcessRecord, error) {
+	record, err := d.readProcessRecord(port)
+	if err == nil {
+		if processAlive(record.PID) {
+			return record, nil
+		}
+		// 进程已经不存在，记录已经过时
+		d.removeProcessRecord(port)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if d.supervised() {
+		if statuses, err := supervisor.ReadState(d.config.GetSupervisorStatePath()); err == nil {
+			for _, p := range statuses {
+				if p.Port == port && p.State == supervisor.StateRunning && p.Alive() {
+					return &ProcessRecord{
+						PID:          p.PID,
+						Port:         port,
+						Release:      p.Release,
+						Command:      p.Command,
+						StartedAt:    p.StartedAt,
+						ProcessGroup: true,
+						Source:       processSourceSupervisor,
+					}, nil
+				}
+			}
+		}
+	}
+
+	// 兼容没有进程记录时 startService 写下的 service.pid_file
+	if port == d.config.Service.Port && d.config.Service.PidFile != "" {
+		if pid, err := readPidFile(d.resolvePath(d.config.Service.PidFile, "")); err == nil && processAlive(pid) {
+			return &ProcessRecord{PID: pid, Port: port, ProcessGroup: true, Source: processSourcePidFile}, nil
+		}
+	}
+
+	if !scanSockets {
+		return nil, nil
+	}
+	pid, err := findListenerPID(port)
+	if err != nil || pid == 0 {
+		return nil, err
+	}
+	return &ProcessRecord{PID: pid, Port: port, Source: processSourceProcNet}, nil
+}
+
+// readPidFile 读取 PID 文件，兼容旧的 PID:timestamp 格式
+func readPidFile(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pidStr := strings.TrimSpace(string(content))
+	if i := strings.Index(pidStr, ":"); i >= 0 {
+		pidStr = pidStr[:i]
+	}
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid PID in file: %s", path)
+	}
+	return pid, nil
+}
+
+// processAlive 报告 PID 对应的进程是否存在
+// 已退出但还没有被父进程回收的僵尸进程不算存在
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	if err := syscall.Kill(pid, 0); err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+	return !zombie(pid)
+}
+
+// zombie 根据 /proc/<pid>/stat 中的进程状态判断进程是否为僵尸进程
+func zombie(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// pid (comm) state ...，comm 中可能包含空格和括号
+	i := strings.LastIndexByte(string(stat), ')')
+	return i >= 0 && i+2 < len(stat) && stat[i+2] == 'Z'
+}
+
+// signalProcess 向记录中的进程发送信号，进程在自己的进程组中时发送给整个进程组
+func signalProcess(record *ProcessRecord, sig syscall.Signal) error {
+	if record.ProcessGroup {
+		if err := syscall.Kill(-record.PID, sig); err == nil {
+			return nil
+		}
+	}
+	return syscall.Kill(record.PID, sig)
+}
+
+// findListenerPID 通过 /proc/net/tcp 和 /proc/net/tcp6 查找监听端口的进程
+// 找不到时返回 0。revlay 自己不会被当作服务进程
+func findListenerPID(port int) (int, error) {
+	inodes := make(map[string]bool)
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		for _, inode := range listeningInodes(f, port) {
+			inodes[inode] = true
+		}
+		f.Close()
+	}
+	if len(inodes) == 0 {
+		return 0, nil
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	self := os.Getpid()
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// 其他用户的进程无权查看
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			if inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] {
+				return pid, nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// tcpListen 是 /proc/net/tcp 中 LISTEN 状态的值
+const tcpListen = "0A"
+
+// listeningInodes 返回 /proc/net/tcp 格式的内容中监听端口的套接字 inode
+func listeningInodes(r io.Reader, port int) []string {
+	var inodes []string
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // 表头
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != tcpListen {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			continue
+		}
+		localPort, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil || int(localPort) != port {
+			continue
+		}
+		inodes = append(inodes, fields[9])
+	}
+	return inodes
+}
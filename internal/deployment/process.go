@@ -1,10 +1,9 @@
 package deployment
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,178 +16,192 @@ import (
 	"github.com/xukonxe/revlay/internal/i18n"
 )
 
-// waitForService waits for a service to become available on a given port.
-func (d *LocalDeployer) waitForService(port int) error {
-	maxRetries := d.config.Service.HealthCheckRetries
-	if maxRetries <= 0 {
-		maxRetries = 10 // Default retries
-	}
+// stopService stops the service on the port that currently receives traffic.
+// This is an internal function that doesn't expose itself via the Deployer interface.
+// The public one is StopService.
+func (d *LocalDeployer) stopService(logger *stepLogger) error {
+	return d.stopPort(d.activePort(), logger)
+}
 
-	timeout := d.config.Service.HealthCheckTimeout
-	if timeout <= 0 {
-		timeout = 5 // Default timeout in seconds
-	}
+// Steps by which stopPort stopped a process, reported to the user.
+const (
+	stopStepStopCommand = "stop_command"
+	stopStepSigterm     = "SIGTERM"
+	stopStepSigkill     = "SIGKILL"
+)
 
-	interval := d.config.Service.HealthCheckInterval
-	if interval <= 0 {
-		interval = 2 // Default interval in seconds
+// stopPort stops the service process on port. It is the one stop routine used when
+// stopping the service, before a short_downtime restart, for the old colour after a
+// zero_downtime switch, for a failed new release and on rollback.
+//
+// A supervised process is stopped by its supervisor, which follows the same steps.
+// Otherwise service.stop_command is run if configured, else the process group gets SIGTERM.
+// If the process is still running after service.graceful_timeout seconds (default 10) it is
+// killed with SIGKILL.
+func (d *LocalDeployer) stopPort(port int, logger *stepLogger) error {
+	if logger == nil {
+		logger = newStepLogger()
 	}
-
-	client := http.Client{
-		Timeout: time.Duration(timeout) * time.Second,
+	if d.stopSupervised(port, logger) {
+		return nil
 	}
-	healthCheckURL := fmt.Sprintf("http://localhost:%d%s", port, d.config.Service.HealthCheck)
 
-	for i := 0; i < maxRetries; i++ {
-		log.Print(i18n.Sprintf(i18n.T().DeployHealthAttempt, i+1, healthCheckURL))
-		resp, err := client.Get(healthCheckURL)
-		if err == nil {
-			// Ensure body is closed to prevent resource leaks
-			io.Copy(io.Discard, resp.Body)
-			resp.Body.Close()
+	record, err := d.findProcess(port, true)
+	if err != nil {
+		return fmt.Errorf("could not find the service process: %w", err)
+	}
+	defer d.removeProcessRecord(port) // 进程结束后，清理进程记录和PID文件
 
-			if resp.StatusCode >= 200 && resp.StatusCode < 400 {
-				log.Println(color.Green(i18n.T().DeployHealthPassed))
-				return nil // Service is healthy
-			}
+	step := stopStepSigterm
+	if d.config.Service.StopCommand != "" {
+		// 停止命令自己可能知道如何找到服务，没有找到进程时也执行
+		if err := d.runStopCommand(port, record, logger); err != nil {
+			logger.Warn(fmt.Sprintf(i18n.T().ServiceStopCommandFailed, err))
+		} else {
+			step = stopStepStopCommand
+		}
+	}
+	if record == nil {
+		if step == stopStepStopCommand {
+			logger.SystemLog(fmt.Sprintf(i18n.T().ServiceStoppedBy, port, step))
+		} else {
+			logger.SystemLog(fmt.Sprintf(i18n.T().ServiceNoProcessFound, port))
 		}
+		return nil
+	}
 
-		if i < maxRetries-1 {
-			time.Sleep(time.Duration(interval) * time.Second)
+	if step == stopStepSigterm {
+		logger.SystemLog(fmt.Sprintf(i18n.T().ServiceGracefulShutdown, record.PID))
+		if err := signalProcess(record, syscall.SIGTERM); err != nil && processAlive(record.PID) {
+			return fmt.Errorf("could not send SIGTERM to process: %w", err)
 		}
 	}
 
-	return fmt.Errorf("service at %s did not respond after %d attempts", healthCheckURL, maxRetries)
-}
+	// 进程不一定是当前进程的子进程，只能轮询它是否退出
+	gracePeriod := d.gracePeriod()
+	if !waitForExit(record.PID, gracePeriod) {
+		// 超时，强制终止进程
+		logger.Warn(fmt.Sprintf(i18n.T().ServiceForceKill, record.PID, gracePeriod))
+		if err := signalProcess(record, syscall.SIGKILL); err != nil && processAlive(record.PID) {
+			return fmt.Errorf("could not kill process %d: %w", record.PID, err)
+		}
+		step = stopStepSigkill
+		waitForExit(record.PID, time.Second)
+	}
 
-// performHealthCheck performs a health check on the given port.
-func (d *LocalDeployer) performHealthCheck(port int) error {
-	return d.waitForService(port)
+	logger.SystemLog(fmt.Sprintf(i18n.T().ServiceStoppedBy, port, step))
+	return nil
 }
 
-// stopService stops the running service by reading the PID file.
-// This is an internal function that doesn't expose itself via the Deployer interface.
-// The public one is StopService.
-func (d *LocalDeployer) stopService(logger *stepLogger) error {
-	pidPath := d.resolvePath(d.config.Service.PidFile, "")
-	if _, err := os.Stat(pidPath); os.IsNotExist(err) {
-		// 使用 logger 而不是 log.Println
-		if logger != nil {
-			logger.SystemLog("No PID file found, service may not be running.")
-		} else {
-			log.Println("No PID file found, service may not be running.")
-		}
-		return nil
+// runStopCommand runs service.stop_command for the process on port through sh, with the
+// same template variables as the start command. PORT and, if the process is known, PID are
+// set in its environment. It may take at most the grace period.
+func (d *LocalDeployer) runStopCommand(port int, record *ProcessRecord, logger *stepLogger) error {
+	releaseName := ""
+	if record != nil {
+		releaseName = record.Release
 	}
-
-	content, err := os.ReadFile(pidPath)
+	command, err := d.resolveTemplate(d.config.Service.StopCommand, releaseName)
 	if err != nil {
-		return fmt.Errorf("could not read PID file: %w", err)
+		return fmt.Errorf("could not resolve command template: %w", err)
 	}
 
-	pidStr := strings.TrimSpace(string(content))
-	var pid int
-
-	// 兼容旧格式 (PID:timestamp)
-	if strings.Contains(pidStr, ":") {
-		pidParts := strings.Split(pidStr, ":")
-		if len(pidParts) > 0 {
-			pid, _ = strconv.Atoi(pidParts[0])
-		}
-	} else {
-		pid, _ = strconv.Atoi(pidStr)
+	ctx, cancel := context.WithTimeout(context.Background(), d.gracePeriod())
+	defer cancel()
+	cmd := shellCommand(ctx, command)
+	cmd.Dir = d.commandDir(releaseName)
+	cmd.Env = d.serviceEnv(port)
+	if record != nil {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PID=%d", record.PID))
 	}
 
-	if pid <= 0 {
-		return fmt.Errorf("invalid PID in file: %s", pidPath)
+	logger.SystemLog(fmt.Sprintf(i18n.T().ServiceRunningStopCommand, command))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("'%s' failed: %w: %s", command, err, strings.TrimSpace(string(output)))
 	}
+	return nil
+}
 
-	// 使用 logger 而不是 log.Println
-	if logger != nil {
-		logger.SystemLog(fmt.Sprintf(i18n.T().ServiceGracefulShutdown, pid))
-	} else {
-		log.Println(color.Yellow(i18n.T().ServiceGracefulShutdown, pid))
-	}
+// defaultGracePeriod is used when service.graceful_timeout is not set, like the supervisor does.
+const defaultGracePeriod = 10 * time.Second
 
-	// Find the process
-	process, err := os.FindProcess(pid)
-	if err != nil {
-		return fmt.Errorf("could not find process with PID %d: %w", pid, err)
+// gracePeriod returns how long a stopping service may take before it is killed.
+func (d *LocalDeployer) gracePeriod() time.Duration {
+	if d.config.Service.GracefulTimeout <= 0 {
+		return defaultGracePeriod
 	}
+	return time.Duration(d.config.Service.GracefulTimeout) * time.Second
+}
 
-	// Send the SIGTERM signal
-	if err := process.Signal(syscall.SIGTERM); err != nil {
-		return fmt.Errorf("could not send SIGTERM to process: %w", err)
+// waitForExit waits up to timeout for the process to exit and reports whether it did.
+func waitForExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(stopPollInterval)
 	}
+	return true
+}
 
-	// 给予进程一些时间来清理退出
-	gracePeriod := 10 * time.Second
-	done := make(chan error)
+// stopPollInterval 是停止服务时检查进程是否退出的间隔
+const stopPollInterval = 100 * time.Millisecond
 
-	go func() {
-		state, err := process.Wait()
-		if err != nil {
-			done <- err
-			return
-		}
-		done <- nil
-		// 使用 logger 而不是 log.Println
-		if logger != nil {
-			if state.Success() {
-				logger.SystemLog("Service stopped gracefully.")
-			} else {
-				logger.SystemLog(fmt.Sprintf("Service exited with status: %v", state.String()))
-			}
-		} else {
-			if state.Success() {
-				log.Println("Service stopped gracefully.")
-			} else {
-				log.Printf("Service exited with status: %v", state.String())
-			}
-		}
-	}()
+// shellCommand runs command with sh -c in its own process group. When ctx is done the
+// whole group is killed, so that processes started by the command do not keep it waiting.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+	return cmd
+}
 
-	select {
-	case err := <-done:
-		os.Remove(pidPath) // 进程结束后，清理PID文件
-		return err
-	case <-time.After(gracePeriod):
-		// 超时，强制终止进程
-		// 使用 logger 而不是 log.Println
-		if logger != nil {
-			logger.SystemLog("Service did not stop gracefully. Forcing shutdown...")
-		} else {
-			log.Println(color.Red("Service did not stop gracefully. Forcing shutdown..."))
+// serviceEnv returns the environment of commands run for the service on port:
+// revlay's own environment, deploy.environment and PORT.
+func (d *LocalDeployer) serviceEnv(port int) []string {
+	env := os.Environ()
+	for key, value := range d.config.Deploy.Environment {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	return append(env, fmt.Sprintf("PORT=%d", port))
+}
+
+// commandDir returns the directory commands for a release run in, the release directory
+// if it exists and otherwise the app's root.
+func (d *LocalDeployer) commandDir(releaseName string) string {
+	if releaseName != "" {
+		if releasePath := d.config.GetReleasePathByName(releaseName); isDir(releasePath) {
+			return releasePath
 		}
-		err := process.Kill()
-		os.Remove(pidPath) // 进程结束后，清理PID文件
-		return err
 	}
+	return d.config.RootPath
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
 }
 
 // StopService is the public method to stop the service.
 func (d *LocalDeployer) StopService() error {
-	return d.stopService(nil) // Pass nil for now, as stepLogger is not directly available here
+	err := d.stopService(nil) // Pass nil for now, as stepLogger is not directly available here
+	current, _ := d.GetCurrentRelease()
+	d.recordHistory(OpStop, current, err)
+	return err
 }
 
 // startService starts the service for a given release.
 func (d *LocalDeployer) startService(releaseName string, logger *stepLogger) error {
-	// Check if service is already running by checking the PID file
+	// Check if service is already running by checking its process record or the PID file
 	pidPath := d.resolvePath(d.config.Service.PidFile, releaseName)
+	if record, err := d.findProcess(d.config.Service.Port, false); err == nil && record != nil {
+		return &ServiceAlreadyRunningError{PID: record.PID}
+	}
 	if _, err := os.Stat(pidPath); err == nil {
-		content, err := os.ReadFile(pidPath)
-		if err == nil {
-			pid, _ := strconv.Atoi(strings.TrimSpace(string(content)))
-			// Fallback for old format PID:timestamp
-			if parts := strings.Split(strings.TrimSpace(string(content)), ":"); len(parts) == 2 {
-				pid, _ = strconv.Atoi(parts[0])
-			}
-			if process, err := os.FindProcess(pid); err == nil {
-				if err := process.Signal(syscall.Signal(0)); err == nil {
-					return &ServiceAlreadyRunningError{PID: pid}
-				}
-			}
-		}
 		log.Println(color.Yellow(i18n.T().ServiceStalePidFile))
 		os.Remove(pidPath)
 	}
@@ -198,69 +211,118 @@ func (d *LocalDeployer) startService(releaseName string, logger *stepLogger) err
 		log.Println(color.Yellow("No start_command configured, skipping service start."))
 		return nil
 	}
+	if started, err := d.startSupervised(releaseName, d.config.Service.Port, logger); started || err != nil {
+		return err
+	}
 
-	// Paths
+	cmd, err := d.spawnService(releaseName, d.config.Service.Port)
+	if err != nil {
+		return err
+	}
 	stdoutLogPath := d.resolvePath(d.config.Service.StdoutLog, releaseName)
-	stderrLogPath := d.resolvePath(d.config.Service.StderrLog, releaseName)
+
+	// 在最后修改日志输出
+	if logger != nil {
+		logger.SystemLog(fmt.Sprintf(i18n.T().ServiceStartInitiated, cmd.Process.Pid, stdoutLogPath))
+	} else {
+		log.Println(color.Green(i18n.T().ServiceStartInitiated, cmd.Process.Pid, stdoutLogPath))
+	}
+
+	startupDelay := d.config.Service.StartupDelay
+	if startupDelay > 0 {
+		time.Sleep(time.Duration(startupDelay) * time.Second)
+		if err := cmd.Process.Signal(syscall.Signal(0)); err != nil {
+			return fmt.Errorf("service process died shortly after starting")
+		}
+	}
+
+	return nil
+}
+
+// spawnService starts the start command of a release on port as a daemon: in its own
+// process group and with its output appended to the log files, so that it keeps running
+// when revlay exits, e.g. at the end of an SSH session. The process is recorded for its port,
+// on service.port the PID is also written to service.pid_file.
+func (d *LocalDeployer) spawnService(releaseName string, port int) (*exec.Cmd, error) {
+	startCmd, err := d.resolveTemplate(d.config.Service.StartCommand, releaseName)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve command template: %w", err)
+	}
+
+	// Paths, output without a configured log file is discarded
+	var stdoutLogPath, stderrLogPath string
+	if d.config.Service.StdoutLog != "" {
+		stdoutLogPath = d.resolvePath(d.config.Service.StdoutLog, releaseName)
+	}
+	if d.config.Service.StderrLog != "" {
+		stderrLogPath = d.resolvePath(d.config.Service.StderrLog, releaseName)
+	}
 	releasePath := d.config.GetReleasePathByName(releaseName)
 
 	cmd := exec.Command("sh", "-c", startCmd)
 	cmd.Dir = releasePath
-	cmd.Env = os.Environ()
-	for key, value := range d.config.Deploy.Environment {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
-	}
-	cmd.Env = append(cmd.Env, fmt.Sprintf("PORT=%d", d.config.Service.Port))
+	cmd.Env = d.serviceEnv(port)
 
-	// Ensure log directories exist
-	for _, logPath := range []string{stdoutLogPath, stderrLogPath} {
-		if logPath != "" {
-			if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
-				return fmt.Errorf("failed to create log directory for %s: %w", logPath, err)
-			}
+	// Redirect stdout/stderr. The child keeps its own copies of the files.
+	openLog := func(path string) (*os.File, error) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create log directory for %s: %w", path, err)
 		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		return f, nil
+	}
+	if stdoutLogPath != "" {
+		stdout, err := openLog(stdoutLogPath)
+		if err != nil {
+			return nil, err
+		}
+		defer stdout.Close()
+		cmd.Stdout, cmd.Stderr = stdout, stdout
 	}
-
-	// Redirect stdout/stderr
-	cmd.Stdout, _ = os.OpenFile(stdoutLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 	if stderrLogPath != "" && stderrLogPath != stdoutLogPath {
-		cmd.Stderr, _ = os.OpenFile(stderrLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	} else {
-		cmd.Stderr = cmd.Stdout
+		stderr, err := openLog(stderrLogPath)
+		if err != nil {
+			return nil, err
+		}
+		defer stderr.Close()
+		cmd.Stderr = stderr
 	}
 
 	// Start the command in a new process group
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start service: %w", err)
+		return nil, fmt.Errorf("failed to start service: %w", err)
 	}
 
-	// Write the PID to a file
+	// Write the PID to a file and record the process for its port
 	pid := cmd.Process.Pid
-	if err := os.WriteFile(pidPath, []byte(strconv.Itoa(pid)), 0644); err != nil {
-		cmd.Process.Kill()
-		return fmt.Errorf("failed to write pid file: %w", err)
+	if port == d.config.Service.Port && d.config.Service.PidFile != "" {
+		pidPath := d.resolvePath(d.config.Service.PidFile, releaseName)
+		if err := os.WriteFile(pidPath, []byte(strconv.Itoa(pid)), 0644); err != nil {
+			syscall.Kill(-pid, syscall.SIGKILL)
+			return nil, fmt.Errorf("failed to write pid file: %w", err)
+		}
 	}
-
-	// 在最后修改日志输出
-	if logger != nil {
-		logger.SystemLog(fmt.Sprintf(i18n.T().ServiceStartInitiated, cmd.Process.Pid, stdoutLogPath))
-	} else {
-		log.Println(color.Green(i18n.T().ServiceStartInitiated, cmd.Process.Pid, stdoutLogPath))
+	record := &ProcessRecord{
+		PID:          pid,
+		Port:         port,
+		Release:      releaseName,
+		Command:      startCmd,
+		ProcessGroup: true,
 	}
-
-	startupDelay := d.config.Service.StartupDelay
-	if startupDelay > 0 {
-		time.Sleep(time.Duration(startupDelay) * time.Second)
-		if err := cmd.Process.Signal(syscall.Signal(0)); err != nil {
-			return fmt.Errorf("service process died shortly after starting")
-		}
+	if err := d.writeProcessRecord(record); err != nil {
+		syscall.Kill(-pid, syscall.SIGKILL)
+		return nil, fmt.Errorf("failed to write process record: %w", err)
 	}
-
-	return nil
+	return cmd, nil
 }
 
 // StartService is the public method to start the service.
 func (d *LocalDeployer) StartService(releaseName string) error {
-	return d.startService(releaseName, nil) // Pass nil for now, as stepLogger is not directly available here
+	err := d.startService(releaseName, nil) // Pass nil for now, as stepLogger is not directly available here
+	d.recordHistory(OpStart, releaseName, err)
+	return err
 }
@@ -35,3 +35,17 @@ func (d *LocalDeployer) GetCurrentRelease() (string, error) {
 	}
 	return filepath.Base(target), nil
 }
+
+// markReleaseFailed 在版本元数据中把版本标记为失败，例如切换流量后没有通过验证
+func (d *LocalDeployer) markReleaseFailed(releaseName, reason string) error {
+	return d.setReleaseStatus(releaseName, ReleaseFailed, reason)
+}
+
+// ReleaseFailure 返回版本被标记为失败的原因，没有失败时返回 false
+func (d *LocalDeployer) ReleaseFailure(releaseName string) (string, bool) {
+	manifest, err := d.ReleaseManifest(releaseName)
+	if err != nil || manifest.Status != ReleaseFailed {
+		return "", false
+	}
+	return manifest.Error, true
+}
@@ -8,7 +8,7 @@ import (
 	"github.com/xukonxe/revlay/internal/ui"
 )
 
-func (d *LocalDeployer) deployShortDowntime(releaseName string, sourceDir string) error {
+func (d *LocalDeployer) deployShortDowntime(releaseName string, sourceDir string, hooks hookContext, manifest *ReleaseManifest) error {
 	// 定义总步骤数
 	const totalSteps = 7
 
@@ -54,12 +54,26 @@ func (d *LocalDeployer) deployShortDowntime(releaseName string, sourceDir string
 		}
 		return err
 	}
+	d.startReleaseManifest(manifest, log)
 	if err := d.linkSharedPaths(releaseName, log); err != nil {
 		if formatter != nil {
 			formatter.CompleteDeployment(false, err.Error())
 		}
 		return err
 	}
+	for _, stage := range []hookStage{
+		{"post-unpack", d.config.Hooks.PostUnpack},
+		{"before-switch", d.config.Hooks.BeforeSwitch},
+	} {
+		// 旧版本还在运行，钩子失败时中止部署
+		if err := d.runHooks(stage.hooks, stage.name, hooks, log); err != nil {
+			err = fmt.Errorf("%s hook failed: %w", stage.name, err)
+			if formatter != nil {
+				formatter.CompleteDeployment(false, err.Error())
+			}
+			return err
+		}
+	}
 	log.Success("目录设置完成")
 
 	// Step 3: Stop the current service
@@ -85,6 +99,9 @@ func (d *LocalDeployer) deployShortDowntime(releaseName string, sourceDir string
 		return err
 	}
 	log.Success("新版本已激活")
+	if err := d.runHooks(d.config.Hooks.AfterSwitch, "after-switch", hooks, log); err != nil {
+		log.Warn(fmt.Sprintf(i18n.T().DeployHookWarn, err))
+	}
 
 	// Step 5 & 6: Start new service and perform health check
 	startAndCheckError := func() error {
@@ -101,6 +118,12 @@ func (d *LocalDeployer) deployShortDowntime(releaseName string, sourceDir string
 			return err
 		}
 		log.Success("健康检查通过")
+
+		// after-start 钩子失败和健康检查失败一样，回滚到之前的版本
+		if err := d.runHooks(d.config.Hooks.AfterStart, "after-start", hooks, log); err != nil {
+			d.stopService(log)
+			return fmt.Errorf("after-start hook failed: %w", err)
+		}
 		return nil
 	}()
 
@@ -118,6 +141,7 @@ func (d *LocalDeployer) deployShortDowntime(releaseName string, sourceDir string
 
 		// Rollback Step 1: Point symlink back to the old release
 		if err := d.switchSymlink(previousReleaseName, log); err != nil {
+			d.recordHistory(OpAutoRollback, previousReleaseName, err)
 			if formatter != nil {
 				formatter.CompleteDeployment(false, "部署失败，回滚也失败")
 			}
@@ -126,12 +150,14 @@ func (d *LocalDeployer) deployShortDowntime(releaseName string, sourceDir string
 
 		// Rollback Step 2: Restart the old service
 		if err := d.startService(previousReleaseName, log); err != nil {
+			d.recordHistory(OpAutoRollback, previousReleaseName, err)
 			if formatter != nil {
 				formatter.CompleteDeployment(false, "部署失败，回滚后服务启动失败")
 			}
 			return fmt.Errorf("CRITICAL: Deployment failed, and the subsequent rollback also failed when restarting the old service. The service may be down. Error: %w", err)
 		}
 
+		d.recordHistory(OpAutoRollback, previousReleaseName, nil)
 		log.SystemLog(fmt.Sprintf("成功回滚到版本 %s", previousReleaseName))
 
 		if formatter != nil {
@@ -155,3 +181,22 @@ func (d *LocalDeployer) deployShortDowntime(releaseName string, sourceDir string
 	}
 	return nil
 }
+
+// rollbackShortDowntime 停止当前服务，切换符号链接后在主端口上启动回滚的版本
+func (d *LocalDeployer) rollbackShortDowntime(releaseName string) error {
+	// 1. Stop current service
+	fmt.Println("  -> Stopping current service...")
+	if err := d.stopService(nil); err != nil {
+		fmt.Printf(color.Yellow(i18n.T().DeployStopServiceFailed, err))
+	}
+
+	// 2. Switch symlink
+	fmt.Println("  -> Activating rollback release...")
+	if err := d.switchSymlink(releaseName, nil); err != nil {
+		return err
+	}
+
+	// 3. Start service
+	fmt.Println("  -> Starting service...")
+	return d.startService(releaseName, nil)
+}
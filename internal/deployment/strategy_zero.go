@@ -1,19 +1,21 @@
 package deployment
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
-	"strings"
-	"syscall"
+	"time"
 
 	"github.com/xukonxe/revlay/internal/color"
 	"github.com/xukonxe/revlay/internal/i18n"
+	"github.com/xukonxe/revlay/internal/proxy"
 	"github.com/xukonxe/revlay/internal/ui"
 )
 
-func (d *LocalDeployer) deployZeroDowntime(releaseName string, sourceDir string) error {
+func (d *LocalDeployer) deployZeroDowntime(releaseName string, sourceDir string, hooks hookContext, manifest *ReleaseManifest) error {
 	const totalSteps = 7 // 步骤总数，包括清理
 	var formatter *ui.DeploymentFormatter
 	if d.enableTUI {
@@ -43,11 +45,18 @@ func (d *LocalDeployer) deployZeroDowntime(releaseName string, sourceDir string)
 	if err := d.setupDirectoriesAndRelease(releaseName, sourceDir, log); err != nil {
 		return handleError(err)
 	}
+	d.startReleaseManifest(manifest, log)
 	if err := d.linkSharedPaths(releaseName, log); err != nil {
 		return handleError(err)
 	}
+	if err := d.runHooks(d.config.Hooks.PostUnpack, "post-unpack", hooks, log); err != nil {
+		return handleError(fmt.Errorf("post-unpack hook failed: %w", err))
+	}
 	log.Success(i18n.T().DeploySetupDirsSuccess)
 
+	// 验证失败时切回的版本
+	previousRelease, _ := d.GetCurrentRelease()
+
 	// Step 2: Determine ports
 	log.Print(i18n.T().DeployDeterminePorts)
 	oldPort, newPort, err := d.determinePorts()
@@ -59,30 +68,67 @@ func (d *LocalDeployer) deployZeroDowntime(releaseName string, sourceDir string)
 	log.Success(i18n.T().DeployDeterminePortsSuccess)
 
 	// Step 3: Start the new version
+	// 新版本在后台运行，启动期间的输出从日志文件中读取显示，直到健康检查结束
 	log.Print(fmt.Sprintf(i18n.T().DeployStartNewRelease, newPort))
-	cmd, processDone, err := d.startNewRelease(releaseName, newPort, formatter)
+	stopFollowingLogs := d.followLogs(releaseName, formatter)
+	cmd, processDone, err := d.startNewRelease(releaseName, newPort, log)
 	if err != nil {
+		stopFollowingLogs()
 		return handleError(fmt.Errorf(i18n.T().DeployStartNewReleaseFailed, err))
 	}
 	log.Success(i18n.T().DeployStartNewReleaseSuccess)
 
 	// Step 4: Perform health check
 	log.Print(fmt.Sprintf(i18n.T().DeployHealthCheckOnPort, newPort))
-	if err := d.monitorHealthCheck(processDone, newPort, cmd); err != nil {
+	err = d.monitorHealthCheck(processDone, newPort, cmd)
+	stopFollowingLogs()
+	if err != nil {
 		return handleError(err)
 	}
 	log.Success(i18n.T().DeployHealthPassed)
 
-	// Step 5: Switch traffic
+	// 新版本还没有接收流量，钩子失败时停止它，旧版本继续运行
+	for _, stage := range []hookStage{
+		{"after-start", d.config.Hooks.AfterStart},
+		{"before-switch", d.config.Hooks.BeforeSwitch},
+	} {
+		if err := d.runHooks(stage.hooks, stage.name, hooks, log); err != nil {
+			d.stopNewRelease(newPort, log)
+			return handleError(fmt.Errorf("%s hook failed: %w", stage.name, err))
+		}
+	}
+
+	// Step 5: Switch traffic, gradually if deploy.canary is configured
 	log.Print(i18n.T().DeploySwitchProxy)
-	if err := d.switchTraffic(releaseName, newPort); err != nil {
+	if len(d.config.Deploy.Canary.Steps) > 0 && oldPort != newPort {
+		if err := d.shiftTrafficGradually(oldPort, newPort, processDone, log); err != nil {
+			// 流量已切回旧版本，停止新版本
+			d.stopNewRelease(newPort, log)
+			return handleError(err)
+		}
+	}
+	if err := d.switchTraffic(releaseName, newPort, log); err != nil {
 		return handleError(err)
 	}
 	log.Success(fmt.Sprintf(i18n.T().DeploySwitchProxySuccess, newPort))
+	if err := d.runHooks(d.config.Hooks.AfterSwitch, "after-switch", hooks, log); err != nil {
+		// 流量已经切换，after-switch 钩子失败不影响部署结果
+		log.Warn(fmt.Sprintf(i18n.T().DeployHookWarn, err))
+	}
 
-	// Step 6: Stop old version
+	// Keep observing the new release with the old one still running, if deploy.verify is configured
+	if d.config.Deploy.Verify.Duration > 0 {
+		log.Print(i18n.T().DeployVerify)
+		if err := d.verifyRelease(newPort, processDone, log); err != nil {
+			return handleError(d.revertVerifiedRelease(releaseName, previousRelease, oldPort, newPort, err, log))
+		}
+		log.Success(i18n.T().DeployVerifyPassed)
+	}
+
+	// Step 6: Stop old version once its connections have drained
 	log.Print(fmt.Sprintf(i18n.T().DeployStopOldService, oldPort))
-	if err := d.stopOldService(oldPort, releaseName, log); err != nil {
+	d.waitForDrain(oldPort, newPort, log)
+	if err := d.stopOldService(oldPort, log); err != nil {
 		log.Warn(fmt.Sprintf(i18n.T().DeployStopOldServiceWarn, err))
 	} else {
 		log.Success(i18n.T().DeployStopOldServiceSuccess)
@@ -102,6 +148,53 @@ func (d *LocalDeployer) deployZeroDowntime(releaseName string, sourceDir string)
 	return nil
 }
 
+// rollbackZeroDowntime 像部署一样回滚：在空闲的端口上启动回滚的版本，健康检查通过后切换流量，
+// 最后停止当前版本。回滚的版本没有通过健康检查时，当前版本继续接收流量
+func (d *LocalDeployer) rollbackZeroDowntime(releaseName string) error {
+	log := newStepLogger()
+
+	oldPort, newPort, err := d.determinePorts()
+	if err != nil {
+		log.Warn(fmt.Sprintf(i18n.T().DeployDeterminePortsWarn, err))
+	}
+
+	// Step 1: Start the rollback release on the idle port
+	log.Print(fmt.Sprintf(i18n.T().RollbackStartOnPort, releaseName, newPort))
+	stopFollowingLogs := d.followLogs(releaseName, nil)
+	cmd, processDone, err := d.startNewRelease(releaseName, newPort, log)
+	if err != nil {
+		stopFollowingLogs()
+		return fmt.Errorf(i18n.T().DeployStartNewReleaseFailed, err)
+	}
+	log.Success(i18n.T().DeployStartNewReleaseSuccess)
+
+	// Step 2: Perform health check
+	log.Print(fmt.Sprintf(i18n.T().DeployHealthCheckOnPort, newPort))
+	err = d.monitorHealthCheck(processDone, newPort, cmd)
+	stopFollowingLogs()
+	if err != nil {
+		return err
+	}
+	log.Success(i18n.T().DeployHealthPassed)
+
+	// Step 3: Switch traffic
+	log.Print(fmt.Sprintf(i18n.T().RollbackSwitchTraffic, newPort))
+	if err := d.switchTraffic(releaseName, newPort, log); err != nil {
+		return err
+	}
+	log.Success(fmt.Sprintf(i18n.T().DeploySwitchProxySuccess, newPort))
+
+	// Step 4: Stop the release that was live before the rollback
+	log.Print(fmt.Sprintf(i18n.T().RollbackStopCurrent, oldPort))
+	d.waitForDrain(oldPort, newPort, log)
+	if err := d.stopOldService(oldPort, log); err != nil {
+		log.Warn(fmt.Sprintf(i18n.T().DeployStopOldServiceWarn, err))
+	} else {
+		log.Success(i18n.T().DeployStopOldServiceSuccess)
+	}
+	return nil
+}
+
 // determinePorts 决定新旧服务的端口
 func (d *LocalDeployer) determinePorts() (int, int, error) {
 	oldPort, err := d.getCurrentPortFromState()
@@ -117,13 +210,34 @@ func (d *LocalDeployer) determinePorts() (int, int, error) {
 	return oldPort, newPort, err
 }
 
-// startNewRelease 启动新版本的服务
-func (d *LocalDeployer) startNewRelease(releaseName string, newPort int, formatter *ui.DeploymentFormatter) (*exec.Cmd, <-chan error, error) {
+// startNewRelease 以守护进程的方式启动新版本的服务，部署命令退出后它继续运行
+// 由 supervisor 启动时返回的 cmd 为 nil
+func (d *LocalDeployer) startNewRelease(releaseName string, newPort int, logger *stepLogger) (*exec.Cmd, <-chan error, error) {
 	if d.config.Service.StartCommand == "" {
 		return nil, nil, fmt.Errorf("start_command not configured")
 	}
-	env := map[string]string{"PORT": fmt.Sprintf("%d", newPort)}
-	return d.runCommandAttachedWithStreaming(releaseName, d.config.Service.StartCommand, env, formatter)
+	if started, err := d.startSupervised(releaseName, newPort, logger); err != nil {
+		return nil, nil, err
+	} else if started {
+		return nil, d.watchSupervised(newPort), nil
+	}
+
+	cmd, err := d.spawnService(releaseName, newPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	logger.SystemLog(fmt.Sprintf(i18n.T().ServiceStartInitiated, cmd.Process.Pid, d.resolvePath(d.config.Service.StdoutLog, releaseName)))
+
+	// 部署期间等待进程退出，部署命令退出后进程由 init 接管
+	// 只报告非零的退出：以状态码 0 退出的启动命令可能是把服务放到了后台（守护进程、systemctl start 等），
+	// 服务是否在运行由健康检查判断
+	processDone := make(chan error, 1)
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			processDone <- err
+		}
+	}()
+	return cmd, processDone, nil
 }
 
 // monitorHealthCheck 监控新服务的健康检查
@@ -135,74 +249,117 @@ func (d *LocalDeployer) monitorHealthCheck(processDone <-chan error, newPort int
 
 	select {
 	case err := <-processDone:
-		if err != nil {
-			return fmt.Errorf(i18n.T().DeployErrProcExitedEarlyWithError, err)
-		}
-		return fmt.Errorf(i18n.T().DeployErrProcExitedEarly)
+		// 受监管的进程可能正在等待重启，不能让它继续运行
+		d.stopNewRelease(newPort, nil)
+		return fmt.Errorf(i18n.T().DeployErrProcExitedEarlyWithError, err)
 	case err := <-healthCheckDone:
 		if err != nil {
-			if cmd != nil && cmd.Process != nil {
-				cmd.Process.Signal(syscall.SIGTERM)
-			}
+			d.stopNewRelease(newPort, nil)
 			return fmt.Errorf(i18n.T().DeployHealthFailed, err)
 		}
 		return nil
 	}
 }
 
+// stopNewRelease 停止部署失败的新版本
+func (d *LocalDeployer) stopNewRelease(newPort int, logger *stepLogger) {
+	if logger == nil {
+		logger = newStepLogger()
+	}
+	if err := d.stopPort(newPort, logger); err != nil {
+		logger.Warn(err.Error())
+	}
+}
+
 // switchTraffic 切换流量到新版本
-func (d *LocalDeployer) switchTraffic(releaseName string, newPort int) error {
-	if err := d.writeStateFile(newPort); err != nil {
-		return fmt.Errorf("failed to write state file to switch traffic: %w", err)
+// 优先通过代理的控制套接字切换并确认切换结果，只有在代理未运行时才退回到写状态文件
+func (d *LocalDeployer) switchTraffic(releaseName string, newPort int, logger *stepLogger) error {
+	status, err := proxy.NewControlClient(d.config.GetProxySocketPath()).Switch(newPort)
+	switch {
+	case errors.Is(err, proxy.ErrProxyNotRunning):
+		logger.Warn(i18n.T().DeploySwitchNoProxy)
+		if err := d.writeStateFile(newPort); err != nil {
+			return fmt.Errorf("failed to write state file to switch traffic: %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf(i18n.T().DeploySwitchNotAcknowledged, newPort, err)
+	case status.Target != fmt.Sprintf("127.0.0.1:%d", newPort):
+		return fmt.Errorf(i18n.T().DeploySwitchWrongTarget, status.Target, newPort)
+	default:
+		logger.SystemLog(fmt.Sprintf(i18n.T().DeploySwitchAcknowledged, status.Target))
 	}
+
 	if err := d.switchSymlink(releaseName, nil); err != nil {
 		return fmt.Errorf("failed to switch symlink: %w", err)
 	}
+	// 新版本接管了流量，代理之前的自动故障切换记录已经过时
+	os.Remove(d.config.GetFailoverPath())
 	return nil
 }
 
-// stopOldService 停止旧版本的服务
-func (d *LocalDeployer) stopOldService(oldPort int, currentRelease string, logger *stepLogger) error {
-	// 查找旧版本的 PID
-	pid, err := d.findPidByPort(oldPort)
-	if err != nil {
-		return fmt.Errorf(i18n.T().DeployFindOldPidFailed, err)
+// waitForDrain 等待代理上仍连接到旧端口的连接结束，最多等待 service.graceful_timeout 秒
+func (d *LocalDeployer) waitForDrain(oldPort, newPort int, logger *stepLogger) {
+	timeout := time.Duration(d.config.Service.GracefulTimeout) * time.Second
+	if timeout <= 0 || oldPort == newPort {
+		return
 	}
 
-	if pid == 0 {
-		logger.Warn(i18n.T().DeployOldPidNotFound)
-		return nil
+	// 代理在运行时，由代理自己等待连接结束
+	client := proxy.NewControlClient(d.config.GetProxySocketPath())
+	status, err := client.Status()
+	if err == nil {
+		remaining := status.ActiveOn(oldPort)
+		if remaining > 0 {
+			logger.SystemLog(fmt.Sprintf(i18n.T().DeployDrainWaiting, remaining, oldPort))
+			status, err = client.Drain(oldPort, timeout)
+			if err != nil {
+				if status != nil {
+					logger.Warn(fmt.Sprintf(i18n.T().DeployDrainTimeout, timeout, status.ActiveOn(oldPort), oldPort))
+				} else {
+					logger.Warn(err.Error())
+				}
+				return
+			}
+		}
+		logger.SystemLog(fmt.Sprintf(i18n.T().DeployDrainComplete, oldPort))
+		return
 	}
 
-	// 停止进程
-	process, err := os.FindProcess(pid)
-	if err != nil {
-		return fmt.Errorf(i18n.T().DeployFindOldProcessFailed, pid, err)
-	}
+	// 否则退回到轮询代理发布的连接状态文件
+	deadline := time.Now().Add(timeout)
+	newTarget := fmt.Sprintf("127.0.0.1:%d", newPort)
+	lastReported := -1
+	for {
+		state, err := proxy.ReadDrainState(d.config.GetDrainStatePath())
+		if err != nil || state.Stale() {
+			logger.SystemLog(i18n.T().DeployDrainNoProxy)
+			return
+		}
 
-	logger.SystemLog(fmt.Sprintf(i18n.T().ServiceGracefulShutdown, pid))
-	if err := process.Signal(syscall.SIGTERM); err != nil {
-		return fmt.Errorf(i18n.T().DeployStopOldProcessFailed, pid, err)
+		// Until the proxy has picked up the switch, new connections may still land on the old port.
+		remaining := state.ActiveOn(oldPort)
+		if state.Target == newTarget && remaining == 0 {
+			logger.SystemLog(fmt.Sprintf(i18n.T().DeployDrainComplete, oldPort))
+			return
+		}
+		if remaining != lastReported {
+			logger.SystemLog(fmt.Sprintf(i18n.T().DeployDrainWaiting, remaining, oldPort))
+			lastReported = remaining
+		}
+		if time.Now().After(deadline) {
+			logger.Warn(fmt.Sprintf(i18n.T().DeployDrainTimeout, timeout, remaining, oldPort))
+			return
+		}
+		time.Sleep(drainPollInterval)
 	}
-
-	return nil
 }
 
-// findPidByPort 根据端口号查找进程ID (这是一个简化的实现)
-func (d *LocalDeployer) findPidByPort(port int) (int, error) {
-	// 注意: 这是一个简化的、特定于平台的实现，可能不通用
-	// 在生产环境中，应该使用更可靠的方法来跟踪进程
-	cmd := exec.Command("lsof", "-i", fmt.Sprintf(":%d", port), "-t")
-	output, err := cmd.Output()
-	if err != nil {
-		// 如果 lsof 没有找到任何东西，它会返回一个非零的退出代码
-		return 0, nil
-	}
-	pidStr := strings.TrimSpace(string(output))
-	if pidStr == "" {
-		return 0, nil
-	}
-	return strconv.Atoi(pidStr)
+// drainPollInterval 是轮询代理连接状态的间隔
+const drainPollInterval = 500 * time.Millisecond
+
+// stopOldService 停止旧版本的服务
+func (d *LocalDeployer) stopOldService(oldPort int, logger *stepLogger) error {
+	return d.stopPort(oldPort, logger)
 }
 
 // getCurrentPortFromState reads the state file to determine the current active port.
@@ -221,5 +378,8 @@ func (d *LocalDeployer) getCurrentPortFromState() (int, error) {
 // writeStateFile writes the current active port to the state file.
 func (d *LocalDeployer) writeStateFile(port int) error {
 	statePath := d.config.GetActivePortPath()
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return err
+	}
 	return os.WriteFile(statePath, []byte(strconv.Itoa(port)), 0644)
 }
@@ -0,0 +1,131 @@
+package deployment
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/i18n"
+	"github.com/xukonxe/revlay/internal/supervisor"
+)
+
+// supervisedPollInterval 是部署期间查询受监管进程状态的间隔
+const supervisedPollInterval = time.Second
+
+// supervised 报告服务是否交给 supervisor 运行（配置了 service.restart）
+func (d *LocalDeployer) supervised() bool {
+	return d.config.Service.Restart != ""
+}
+
+func (d *LocalDeployer) supervisorClient() *supervisor.Client {
+	return supervisor.NewClient(d.config.GetSupervisorSocketPath())
+}
+
+// processSpec 描述在指定端口上运行某个版本的进程
+// 只有主端口上的进程写 service.pid_file，蓝绿部署的另一个颜色由 supervisor 的状态文件记录
+func (d *LocalDeployer) processSpec(releaseName string, port int) (supervisor.Spec, error) {
+	command, err := d.resolveTemplate(d.config.Service.StartCommand, releaseName)
+	if err != nil {
+		return supervisor.Spec{}, fmt.Errorf("could not resolve command template: %w", err)
+	}
+
+	// supervisor 在自己的环境变量基础上添加这些变量
+	var env []string
+	for key, value := range d.config.Deploy.Environment {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	env = append(env, fmt.Sprintf("PORT=%d", port))
+
+	spec := supervisor.Spec{
+		Release: releaseName,
+		Port:    port,
+		Command: command,
+		Dir:     d.config.GetReleasePathByName(releaseName),
+		Env:     env,
+	}
+	if d.config.Service.StdoutLog != "" {
+		spec.StdoutLog = d.resolvePath(d.config.Service.StdoutLog, releaseName)
+	}
+	if d.config.Service.StderrLog != "" {
+		spec.StderrLog = d.resolvePath(d.config.Service.StderrLog, releaseName)
+	}
+	if port == d.config.Service.Port && d.config.Service.PidFile != "" {
+		spec.PidFile = d.resolvePath(d.config.Service.PidFile, releaseName)
+	}
+	if d.config.Service.StopCommand != "" {
+		if spec.StopCommand, err = d.resolveTemplate(d.config.Service.StopCommand, releaseName); err != nil {
+			return supervisor.Spec{}, fmt.Errorf("could not resolve command template: %w", err)
+		}
+	}
+	return spec, nil
+}
+
+// startSupervised 让 supervisor 在指定端口上启动版本
+// 没有配置 service.restart 或 supervisor 未运行时返回 false，由调用方自行启动进程
+func (d *LocalDeployer) startSupervised(releaseName string, port int, logger *stepLogger) (bool, error) {
+	if !d.supervised() {
+		return false, nil
+	}
+	if logger == nil {
+		logger = newStepLogger()
+	}
+
+	spec, err := d.processSpec(releaseName, port)
+	if err != nil {
+		return true, err
+	}
+	status, err := d.supervisorClient().Start(spec)
+	if errors.Is(err, supervisor.ErrNotRunning) {
+		logger.Warn(i18n.T().ServiceSupervisorNotRunning)
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("supervisor could not start the service: %w", err)
+	}
+	logger.SystemLog(fmt.Sprintf(i18n.T().ServiceSupervisedStart, status.PID, port, d.config.Service.Restart))
+	return true, nil
+}
+
+// stopSupervised 让 supervisor 停止指定端口上的进程
+// supervisor 未运行或没有管理该端口时返回 false，由调用方自行停止进程
+func (d *LocalDeployer) stopSupervised(port int, logger *stepLogger) bool {
+	if !d.supervised() {
+		return false
+	}
+	if logger == nil {
+		logger = newStepLogger()
+	}
+
+	// supervisor 最多等待 graceful_timeout 后强制结束进程
+	status, err := d.supervisorClient().Stop(port, d.gracePeriod())
+	if err != nil {
+		// 包括 supervisor 没有管理该端口的情况，例如进程是在启用 supervisor 之前启动的
+		return false
+	}
+	logger.SystemLog(fmt.Sprintf(i18n.T().ServiceSupervisedStop, port, status.ExitCode))
+	return true
+}
+
+// watchSupervised 在受监管的进程不再运行时发送错误，相当于直接启动时等待进程退出
+// 轮询随部署命令退出而结束
+func (d *LocalDeployer) watchSupervised(port int) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		client := d.supervisorClient()
+		for {
+			time.Sleep(supervisedPollInterval)
+			processes, err := client.Status()
+			if err != nil {
+				done <- fmt.Errorf("lost contact with supervisor: %w", err)
+				return
+			}
+			for _, p := range processes {
+				if p.Port == port && p.State != supervisor.StateRunning {
+					done <- fmt.Errorf("process is %s, last exit code %d", p.State, p.ExitCode)
+					return
+				}
+			}
+		}
+	}()
+	return done
+}
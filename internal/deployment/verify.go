@@ -0,0 +1,78 @@
+package deployment
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/i18n"
+)
+
+// defaultVerifyFailureThreshold 是未配置 deploy.verify.failure_threshold 时判定验证失败所需的连续失败次数
+const defaultVerifyFailureThreshold = 3
+
+// verifyRelease 在切换流量后的 deploy.verify.duration_seconds 内持续检查新版本
+// 新版本进程退出或健康检查连续失败时返回错误，这期间旧版本保持运行，以便把流量切回去
+func (d *LocalDeployer) verifyRelease(newPort int, processDone <-chan error, logger *stepLogger) error {
+	verify := d.config.Deploy.Verify
+	window := time.Duration(verify.Duration) * time.Second
+	interval := time.Duration(verify.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Duration(d.config.Service.HealthCheckInterval) * time.Second
+	}
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
+	timeout := time.Duration(d.config.Service.HealthCheckTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	threshold := verify.FailureThreshold
+	if threshold <= 0 {
+		threshold = defaultVerifyFailureThreshold
+	}
+
+	logger.SystemLog(fmt.Sprintf(i18n.T().DeployVerifyStart, window))
+	deadline := time.Now().Add(window)
+	failures := 0
+	for {
+		select {
+		case <-processDone:
+			return errors.New(i18n.T().DeployVerifyProcessExited)
+		case <-time.After(min(interval, time.Until(deadline))):
+		}
+
+		// 连续 threshold 次检查失败才判定验证失败，检查成功时重新计数，避免瞬时抖动把正常的新版本回滚
+		if err := d.probeHealth(newPort, timeout); err != nil {
+			if failures++; failures >= threshold {
+				return fmt.Errorf(i18n.T().DeployVerifyHealthFailed, err)
+			}
+		} else {
+			failures = 0
+		}
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+	}
+}
+
+// revertVerifiedRelease 在验证失败后把新版本标记为失败，把流量和 current 链接切回旧版本并停止新版本
+// 没有可切回的旧版本时（首次部署或新旧端口相同），新版本是唯一在服务的版本，只标记失败而不停止它
+func (d *LocalDeployer) revertVerifiedRelease(releaseName, previousRelease string, oldPort, newPort int, cause error, logger *stepLogger) error {
+	if err := d.markReleaseFailed(releaseName, cause.Error()); err != nil {
+		logger.Warn(err.Error())
+	}
+	if previousRelease == "" || oldPort == newPort {
+		return fmt.Errorf(i18n.T().DeployVerifyFailed, cause)
+	}
+	logger.Warn(fmt.Sprintf(i18n.T().DeployVerifyReverting, previousRelease, oldPort))
+	err := d.switchTraffic(previousRelease, oldPort, logger)
+	d.recordHistory(OpAutoRollback, previousRelease, err)
+	if err != nil {
+		// 新版本仍在接收流量，不能停止它
+		logger.Error(fmt.Sprintf(i18n.T().DeployVerifyRevertFailed, err))
+		return fmt.Errorf(i18n.T().DeployVerifyFailed, cause)
+	}
+	d.stopNewRelease(newPort, logger)
+	return fmt.Errorf(i18n.T().DeployVerifyFailed, cause)
+}
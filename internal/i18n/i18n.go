@@ -49,6 +49,9 @@ type Messages struct {
 	DeployDryRunPlan  string
 	DeployFromDirFlag string
 
+	DeployFromArchiveFlag string
+	DeployInvalidArchive  string
+
 	// Rollback Command
 	RollbackShortDesc  string
 	RollbackLongDesc   string
@@ -58,14 +61,30 @@ type Messages struct {
 	RollbackNoReleases string
 	RollbackStarting   string
 
+	RollbackStartOnPort   string
+	RollbackSwitchTraffic string
+	RollbackStopCurrent   string
+
+	RollbackIsCurrent        string
+	RollbackReleaseFailed    string
+	RollbackNotEnoughHistory string
+
 	// Releases Command
-	ReleasesShortDesc  string
-	ReleasesLongDesc   string
-	ReleasesListHeader string
-	ReleasesNoReleases string
-	ReleasesCurrent    string
-	ReleasesHeader     string
-	ErrorReleasesList  string
+	ReleasesShortDesc   string
+	ReleasesLongDesc    string
+	ReleasesListHeader  string
+	ReleasesNoReleases  string
+	ReleasesCurrent     string
+	ReleasesTableHeader string
+	ReleasesHeader      string
+	ErrorReleasesList   string
+
+	// History Command
+	HistoryShortDesc    string
+	HistoryLongDesc     string
+	HistoryNoEntries    string
+	HistoryTableHeader  string
+	HistoryInvalidSince string
 
 	// Status Command
 	StatusShortDesc        string
@@ -78,29 +97,41 @@ type Messages struct {
 	StatusActive           string
 	StatusDirectoryDetails string
 	StatusDirFailed        string
+	StatusFailover         string
+	StatusFailoverReason   string
+	StatusProcess          string
+	StatusNoProcess        string
 
 	// Service Command
-	ServiceShortDesc          string
-	ServiceLongDesc           string
-	ServiceStartShortDesc     string
-	ServiceStartLongDesc      string
-	ServiceStarting           string
-	ServiceStartSuccess       string
-	ServiceStartFailed        string
-	ServiceStartNotConfigured string
-	ServiceStopShortDesc      string
-	ServiceStopLongDesc       string
-	ServiceStopping           string
-	ServiceStopSuccess        string
-	ServiceStopFailed         string
-	ServiceStopNotConfigured  string
-	ServiceStopNotRunning     string
-	ServiceNotFound           string
-	ServiceIdRequired         string
-	ServiceNoReleaseFound     string
-	ServiceNotConfigured      string
-	ServiceAlreadyRunning     string
-	ServiceStalePidFile       string
+	ServiceShortDesc            string
+	ServiceLongDesc             string
+	ServiceStartShortDesc       string
+	ServiceStartLongDesc        string
+	ServiceStarting             string
+	ServiceStartSuccess         string
+	ServiceStartFailed          string
+	ServiceStartNotConfigured   string
+	ServiceStopShortDesc        string
+	ServiceStopLongDesc         string
+	ServiceStopping             string
+	ServiceStopSuccess          string
+	ServiceStopFailed           string
+	ServiceStopNotConfigured    string
+	ServiceStopNotRunning       string
+	ServiceNotFound             string
+	ServiceIdRequired           string
+	ServiceNoReleaseFound       string
+	ServiceNotConfigured        string
+	ServiceAlreadyRunning       string
+	ServiceStalePidFile         string
+	ServiceSupervisorNotRunning string
+	ServiceSupervisedStart      string
+	ServiceSupervisedStop       string
+	ServiceNoProcessFound       string
+	ServiceRunningStopCommand   string
+	ServiceStopCommandFailed    string
+	ServiceForceKill            string
+	ServiceStoppedBy            string
 
 	// Push Command
 	PreflightCheckFailed string
@@ -146,6 +177,7 @@ type Messages struct {
 	DeployRestartingService           string
 	DeployHealthCheck                 string
 	DeployHealthAttempt               string
+	DeployHealthSkipped               string
 	DeployHealthFailed                string
 	DeployHealthPassed                string
 	DeployPostHooks                   string
@@ -167,7 +199,6 @@ type Messages struct {
 	DeploySwitchProxy                 string
 	DeployActivateSymlink             string
 	DeployStopOldService              string
-	DeployErrProcExitedEarly          string
 	DeployErrProcExitedEarlyWithError string
 	DeployCurrentPortInfo             string
 	DeployNewPortInfo                 string
@@ -208,6 +239,35 @@ type Messages struct {
 	DeployOldPidNotFound              string
 	DeployFindOldProcessFailed        string
 	DeployStopOldProcessFailed        string
+	DeployDrainWaiting                string
+	DeployDrainComplete               string
+	DeployDrainTimeout                string
+	DeployDrainNoProxy                string
+	DeploySwitchNoProxy               string
+	DeploySwitchNotAcknowledged       string
+	DeploySwitchWrongTarget           string
+	DeploySwitchAcknowledged          string
+	DeployCanaryStart                 string
+	DeployCanaryStep                  string
+	DeployCanaryStepPassed            string
+	DeployCanaryNoProxy               string
+	DeployCanaryHealthFailed          string
+	DeployCanaryErrorRate             string
+	DeployCanaryProcessExited         string
+	DeployCanarySplitFailed           string
+	DeployCanaryRolledBack            string
+	DeployCanaryRollbackFailed        string
+	DeployVerify                      string
+	DeployRunningHooks                string
+	DeployHookTimedOut                string
+	DeployHookWarn                    string
+	DeployVerifyStart                 string
+	DeployVerifyPassed                string
+	DeployVerifyProcessExited         string
+	DeployVerifyHealthFailed          string
+	DeployVerifyReverting             string
+	DeployVerifyRevertFailed          string
+	DeployVerifyFailed                string
 
 	// SSH Messages
 	SSHRunningRemote string
@@ -299,24 +359,43 @@ var chineseMessages = Messages{
 	DeployDryRunPlan:  "部署计划:",
 	DeployFromDirFlag: "从特定目录部署而不是从空目录",
 
+	DeployFromArchiveFlag: "从压缩包（.tar.gz、.tar.zst 或 .zip）部署，解压到新版本目录",
+	DeployInvalidArchive:  "错误: %s 不是 .tar.gz、.tar.zst 或 .zip 压缩包",
+
 	// releases command
-	ReleasesShortDesc:  "列出所有已部署的版本",
-	ReleasesLongDesc:   "列出在版本目录中找到的所有版本。",
-	ReleasesListHeader: "📋 已部署的版本:",
-	ReleasesNoReleases: "未找到任何版本。",
-	ReleasesCurrent:    " (当前)",
-	ReleasesHeader:     "%-18s %s",
-	ErrorReleasesList:  "列出版本失败: %v",
+	ReleasesShortDesc:   "列出所有已部署的版本",
+	ReleasesLongDesc:    "列出在版本目录中找到的所有版本。",
+	ReleasesListHeader:  "📋 已部署的版本:",
+	ReleasesNoReleases:  "未找到任何版本。",
+	ReleasesCurrent:     " (当前)",
+	ReleasesTableHeader: "版本\t状态\t部署时间\t部署者\t主机\tGit\t模式\t端口\t大小\t用时\t错误",
+	ReleasesHeader:      "%-18s %s",
+	ErrorReleasesList:   "列出版本失败: %v",
+
+	// History Command
+	HistoryShortDesc:    "查看部署历史",
+	HistoryLongDesc:     "显示 .revlay/history.jsonl 中记录的部署、回滚、自动回滚和服务启停，包括时间、操作者、版本、结果和错误。",
+	HistoryNoEntries:    "没有历史记录。",
+	HistoryTableHeader:  "时间\t操作者\t操作\t版本\t当前版本\t结果\t错误",
+	HistoryInvalidSince: "无效的 --since '%s'：应为时长（如 24h、7d）、日期（2006-01-02）或 RFC3339 时间",
 
 	// rollback command
 	RollbackShortDesc:  "回滚到之前的版本",
-	RollbackLongDesc:   "通过切换'current'符号链接，将应用程序回滚到指定的版本。",
+	RollbackLongDesc:   "通过切换'current'符号链接，将应用程序回滚到指定的版本。没有指定版本时按部署历史中的上线顺序回退 --steps 个版本（默认 1），连续回滚会一步步退回更早的版本；--to-previous-live 回滚到最近一个上线过且没有失败的版本。不能回滚到当前版本或被标记为失败的版本。zero_downtime 模式下先在空闲端口上启动并检查该版本，再切换流量。",
 	RollbackStarting:   "正在回滚到版本 %s...",
 	RollbackSuccess:    "成功回滚到 %s。",
 	RollbackFailed:     "回滚失败: %v",
 	RollbackToRelease:  "🔄 正在回滚到版本: %s",
 	RollbackNoReleases: "未找到可回滚的版本",
 
+	RollbackStartOnPort:   "在空闲端口 %[2]d 上启动版本 %[1]s",
+	RollbackSwitchTraffic: "切换流量到端口 %d",
+	RollbackStopCurrent:   "停止端口 %d 上的当前版本",
+
+	RollbackIsCurrent:        "版本 %s 就是当前版本",
+	RollbackReleaseFailed:    "版本 %s 被标记为失败，不能回滚到它: %s",
+	RollbackNotEnoughHistory: "之前只上线过 %d 个版本，不能回退 %d 步",
+
 	// Status Command
 	StatusShortDesc:        "显示部署状态",
 	StatusLongDesc:         "显示当前部署的版本和其他状态信息。",
@@ -328,29 +407,41 @@ var chineseMessages = Messages{
 	StatusActive:           "活动",
 	StatusDirectoryDetails: "目录详情:",
 	StatusDirFailed:        "  - 无法获取目录详情: %v",
+	StatusFailover:         "  - 代理自动故障切换: %s, :%d -> :%d",
+	StatusFailoverReason:   "    原因: %s",
+	StatusProcess:          "  - 端口 %d: 进程 %d，版本 %s（来源: %s）",
+	StatusNoProcess:        "  - 端口 %d: 没有运行中的进程",
 
 	// Service Command
-	ServiceShortDesc:          "管理 Revlay 服务",
-	ServiceLongDesc:           "管理 Revlay 服务列表，包括添加、删除和列出服务。",
-	ServiceStartShortDesc:     "启动一个服务",
-	ServiceStartLongDesc:      "启动全局服务列表中的指定服务。",
-	ServiceStarting:           "正在启动服务 '%s'...",
-	ServiceStartSuccess:       "✅ 服务 '%s' 已成功启动，进程ID: %d。",
-	ServiceStartFailed:        "❌ 启动服务 '%s' 失败: %v",
-	ServiceStartNotConfigured: "❌ 服务 '%s' 没有配置启动命令，无法启动。",
-	ServiceStopShortDesc:      "停止一个服务",
-	ServiceStopLongDesc:       "停止全局服务列表中的指定服务。",
-	ServiceStopping:           "正在停止服务 '%s'...",
-	ServiceStopSuccess:        "✅ 服务 '%s' 已成功停止。",
-	ServiceStopFailed:         "❌ 停止服务 '%s' 失败: %v",
-	ServiceStopNotConfigured:  "❌ 服务 '%s' 没有配置停止命令，无法停止。",
-	ServiceStopNotRunning:     "⚠️ 服务 '%s' 未运行。",
-	ServiceNotFound:           "❌ 未找到服务 '%s'。",
-	ServiceIdRequired:         "请指定服务 ID。",
-	ServiceNoReleaseFound:     "❌ 服务 '%s' 未部署任何版本。",
-	ServiceNotConfigured:      "❌ 服务 '%s' 配置不完整，无法执行操作。",
-	ServiceAlreadyRunning:     "⚠️ 服务 '%s' 已在运行，进程ID: %d。",
-	ServiceStalePidFile:       "发现过时的PID文件，启动前将自动删除。",
+	ServiceShortDesc:            "管理 Revlay 服务",
+	ServiceLongDesc:             "管理 Revlay 服务列表，包括添加、删除和列出服务。",
+	ServiceStartShortDesc:       "启动一个服务",
+	ServiceStartLongDesc:        "启动全局服务列表中的指定服务。",
+	ServiceStarting:             "正在启动服务 '%s'...",
+	ServiceStartSuccess:         "✅ 服务 '%s' 已成功启动，进程ID: %d。",
+	ServiceStartFailed:          "❌ 启动服务 '%s' 失败: %v",
+	ServiceStartNotConfigured:   "❌ 服务 '%s' 没有配置启动命令，无法启动。",
+	ServiceStopShortDesc:        "停止一个服务",
+	ServiceStopLongDesc:         "停止全局服务列表中的指定服务。",
+	ServiceStopping:             "正在停止服务 '%s'...",
+	ServiceStopSuccess:          "✅ 服务 '%s' 已成功停止。",
+	ServiceStopFailed:           "❌ 停止服务 '%s' 失败: %v",
+	ServiceStopNotConfigured:    "❌ 服务 '%s' 没有配置停止命令，无法停止。",
+	ServiceStopNotRunning:       "⚠️ 服务 '%s' 未运行。",
+	ServiceNotFound:             "❌ 未找到服务 '%s'。",
+	ServiceIdRequired:           "请指定服务 ID。",
+	ServiceNoReleaseFound:       "❌ 服务 '%s' 未部署任何版本。",
+	ServiceNotConfigured:        "❌ 服务 '%s' 配置不完整，无法执行操作。",
+	ServiceAlreadyRunning:       "⚠️ 服务 '%s' 已在运行，进程ID: %d。",
+	ServiceStalePidFile:         "发现过时的PID文件，启动前将自动删除。",
+	ServiceSupervisorNotRunning: "已配置 service.restart 但没有运行中的 supervisor（请运行 'revlay proxy' 或 'revlay-agent'），服务将在无监管的情况下启动",
+	ServiceSupervisedStart:      "supervisor 已在端口 %[2]d 上启动服务，PID %[1]d（重启策略: %[3]s）",
+	ServiceSupervisedStop:       "supervisor 已停止端口 %d 上的服务（退出码 %d）",
+	ServiceNoProcessFound:       "端口 %d 上没有找到服务进程，服务可能没有运行。",
+	ServiceRunningStopCommand:   "正在执行停止命令: %s",
+	ServiceStopCommandFailed:    "停止命令执行失败，改为发送 SIGTERM: %v",
+	ServiceForceKill:            "进程 %d 在 %v 内没有退出，发送 SIGKILL。",
+	ServiceStoppedBy:            "端口 %d 上的服务已停止（%s）。",
 
 	// Push Command
 	PreflightCheckFailed: "Pre-flight check failed: command '%s' not found. Please install it and ensure it's in your PATH. Error: %v",
@@ -396,6 +487,7 @@ var chineseMessages = Messages{
 	DeployRestartingService:           "重启服务...",
 	DeployHealthCheck:                 "执行健康检查...",
 	DeployHealthAttempt:               "  - 健康检查尝试 #%d 对 %s...",
+	DeployHealthSkipped:               "  - 健康检查类型为 none，跳过健康检查。",
 	DeployHealthFailed:                " ✗",
 	DeployHealthPassed:                " ✓",
 	DeployPostHooks:                   "执行部署后钩子...",
@@ -417,7 +509,6 @@ var chineseMessages = Messages{
 	DeploySwitchProxy:                 "健康检查通过。切换代理流量到端口 %d...",
 	DeployActivateSymlink:             "激活新版本符号链接...",
 	DeployStopOldService:              "在端口 %d 上停止旧服务 (等待 %s)...",
-	DeployErrProcExitedEarly:          "新版本进程在健康检查完成前已正常退出（状态码0），服务应保持在线状态",
 	DeployErrProcExitedEarlyWithError: "新版本进程在启动期间意外退出：%v",
 	DeployCurrentPortInfo:             "  - 当前服务运行于端口: %d",
 	DeployNewPortInfo:                 "  - 新服务将启动于端口: %d",
@@ -458,6 +549,35 @@ var chineseMessages = Messages{
 	DeployOldPidNotFound:              "未找到旧服务的PID。",
 	DeployFindOldProcessFailed:        "通过PID %d 查找旧进程失败: %v",
 	DeployStopOldProcessFailed:        "停止旧进程 %d 失败: %v",
+	DeployDrainWaiting:                "仍有 %d 个连接在旧端口 :%d 上，等待其结束...",
+	DeployDrainComplete:               "旧端口 :%d 上的连接已全部结束。",
+	DeployDrainTimeout:                "等待连接结束超时（%s），仍有 %d 个连接在 :%d 上，将继续停止旧服务。",
+	DeployDrainNoProxy:                "未检测到正在运行的代理，跳过连接排空。",
+	DeploySwitchNoProxy:               "代理未运行，已写入状态文件，代理启动后将使用新端口。",
+	DeploySwitchNotAcknowledged:       "代理未确认切换到端口 %d: %v",
+	DeploySwitchWrongTarget:           "代理切换后的目标为 %s，而不是端口 %d",
+	DeploySwitchAcknowledged:          "代理已确认切换，当前目标: %s",
+	DeployCanaryStart:                 "逐步切换流量到端口 %d，步骤: %s",
+	DeployCanaryStep:                  "将 %d%% 的流量发送到新版本，观察 %s...",
+	DeployCanaryStepPassed:            "%d%% 流量步骤正常（%d 个请求，%d 个错误）。",
+	DeployCanaryNoProxy:               "代理未运行，无法逐步切换流量，将直接切换。",
+	DeployCanaryHealthFailed:          "新版本健康检查失败: %v",
+	DeployCanaryErrorRate:             "新版本错误率 %.1f%%（%d/%d）超过上限 %.1f%%",
+	DeployCanaryProcessExited:         "新版本进程在逐步切换期间退出",
+	DeployCanarySplitFailed:           "代理未接受流量分配: %v",
+	DeployCanaryRolledBack:            "逐步切换失败，流量已全部切回旧版本: %v",
+	DeployCanaryRollbackFailed:        "无法将流量切回旧端口 %d: %v",
+	DeployVerify:                      "验证新版本",
+	DeployRunningHooks:                "  -> 正在执行 %s 钩子...",
+	DeployHookTimedOut:                "钩子 '%s' 在 %s 内没有结束，已终止",
+	DeployHookWarn:                    "钩子执行失败，部署继续: %v",
+	DeployVerifyStart:                 "在 %s 内观察新版本，旧版本保持运行...",
+	DeployVerifyPassed:                "新版本在观察期内运行正常。",
+	DeployVerifyProcessExited:         "新版本进程在观察期内退出",
+	DeployVerifyHealthFailed:          "新版本在观察期内健康检查失败: %v",
+	DeployVerifyReverting:             "验证失败，正在把流量切回端口 %[2]d 上的版本 %[1]s...",
+	DeployVerifyRevertFailed:          "无法把流量切回旧版本，新版本仍在接收流量: %v",
+	DeployVerifyFailed:                "新版本验证失败，已标记为失败版本: %v",
 
 	// SSH Messages
 	SSHRunningRemote: "在远程服务器上运行: %s",
@@ -542,24 +662,43 @@ var englishMessages = Messages{
 	DeployDryRunPlan:  "Deployment Plan:",
 	DeployFromDirFlag: "Deploy from a specific directory instead of an empty one",
 
+	DeployFromArchiveFlag: "Deploy from an archive (.tar.gz, .tar.zst or .zip), extracted into the new release directory",
+	DeployInvalidArchive:  "Error: %s is not a .tar.gz, .tar.zst or .zip archive",
+
 	// releases command
-	ReleasesShortDesc:  "List all deployed releases",
-	ReleasesLongDesc:   "Lists all releases found in the releases directory.",
-	ReleasesListHeader: "📋 Deployed releases:",
-	ReleasesNoReleases: "No releases found.",
-	ReleasesCurrent:    " (current)",
-	ReleasesHeader:     "%-18s %s",
-	ErrorReleasesList:  "Failed to list releases: %v",
+	ReleasesShortDesc:   "List all deployed releases",
+	ReleasesLongDesc:    "Lists all releases found in the releases directory.",
+	ReleasesListHeader:  "📋 Deployed releases:",
+	ReleasesNoReleases:  "No releases found.",
+	ReleasesCurrent:     " (current)",
+	ReleasesTableHeader: "RELEASE\tSTATUS\tDEPLOYED\tBY\tHOST\tGIT\tMODE\tPORT\tSIZE\tDURATION\tERROR",
+	ReleasesHeader:      "%-18s %s",
+	ErrorReleasesList:   "Failed to list releases: %v",
+
+	// History Command
+	HistoryShortDesc:    "Show the deployment history",
+	HistoryLongDesc:     "Shows the deploys, rollbacks, automatic rollbacks and service starts/stops recorded in .revlay/history.jsonl, with their time, actor, release, result and error.",
+	HistoryNoEntries:    "No history recorded.",
+	HistoryTableHeader:  "TIME\tACTOR\tOPERATION\tRELEASE\tLIVE\tRESULT\tERROR",
+	HistoryInvalidSince: "invalid --since '%s': expected a duration (e.g. 24h, 7d), a date (2006-01-02) or an RFC3339 time",
 
 	// rollback command
 	RollbackShortDesc:  "Rollback to a previous release",
-	RollbackLongDesc:   "Rolls back the application to a specified release by switching the 'current' symlink.",
+	RollbackLongDesc:   "Rolls back the application to a specified release by switching the 'current' symlink. Without a release it goes back --steps releases (default 1) in the order they were live according to the deployment history, so repeated rollbacks go further back; --to-previous-live picks the most recent earlier live release that was not marked as failed. The current release and releases marked as failed are refused. In zero_downtime mode the release is started and health-checked on the idle port before traffic is switched.",
 	RollbackStarting:   "Rolling back to release %s...",
 	RollbackSuccess:    "Successfully rolled back to %s.",
 	RollbackFailed:     "Rollback failed: %v",
 	RollbackToRelease:  "🔄 Rolling back to release: %s",
 	RollbackNoReleases: "No releases found to rollback to",
 
+	RollbackStartOnPort:   "Starting release %s on idle port %d",
+	RollbackSwitchTraffic: "Switching traffic to port %d",
+	RollbackStopCurrent:   "Stopping the current release on port %d",
+
+	RollbackIsCurrent:        "release %s is already the current release",
+	RollbackReleaseFailed:    "release %s was marked as failed and cannot be rolled back to: %s",
+	RollbackNotEnoughHistory: "only %d earlier releases have been live, cannot go back %d steps",
+
 	// Status Command
 	StatusShortDesc:        "Show the status of the deployment",
 	StatusLongDesc:         "Displays the current deployed release and other status information.",
@@ -571,29 +710,41 @@ var englishMessages = Messages{
 	StatusActive:           "Active",
 	StatusDirectoryDetails: "Directory Details:",
 	StatusDirFailed:        "  - Could not get directory details: %v",
+	StatusFailover:         "  - Proxy failed over automatically: %s, :%d -> :%d",
+	StatusFailoverReason:   "    Reason: %s",
+	StatusProcess:          "  - Port %d: PID %d, release %s (found by %s)",
+	StatusNoProcess:        "  - Port %d: no process running",
 
 	// Service Command
-	ServiceShortDesc:          "Manage Revlay services",
-	ServiceLongDesc:           "Manage the Revlay services list, including adding, removing, and listing services.",
-	ServiceStartShortDesc:     "Start a service",
-	ServiceStartLongDesc:      "Start a service from the global services list.",
-	ServiceStarting:           "Starting service '%s'...",
-	ServiceStartSuccess:       "✅ Service '%s' started successfully with PID: %d.",
-	ServiceStartFailed:        "❌ Failed to start service '%s': %v",
-	ServiceStartNotConfigured: "❌ Service '%s' has no start command configured.",
-	ServiceStopShortDesc:      "Stop a service",
-	ServiceStopLongDesc:       "Stop a service from the global services list.",
-	ServiceStopping:           "Stopping service '%s'...",
-	ServiceStopSuccess:        "✅ Service '%s' stopped successfully.",
-	ServiceStopFailed:         "❌ Failed to stop service '%s': %v",
-	ServiceStopNotConfigured:  "❌ Service '%s' has no stop command configured.",
-	ServiceStopNotRunning:     "⚠️ Service '%s' is not running.",
-	ServiceNotFound:           "❌ Service '%s' not found.",
-	ServiceIdRequired:         "Please specify a service ID.",
-	ServiceNoReleaseFound:     "❌ No releases found for service '%s'.",
-	ServiceNotConfigured:      "❌ Service '%s' is not properly configured.",
-	ServiceAlreadyRunning:     "⚠️ Service '%s' is already running with PID: %d.",
-	ServiceStalePidFile:       "Stale PID file found and removed.",
+	ServiceShortDesc:            "Manage Revlay services",
+	ServiceLongDesc:             "Manage the Revlay services list, including adding, removing, and listing services.",
+	ServiceStartShortDesc:       "Start a service",
+	ServiceStartLongDesc:        "Start a service from the global services list.",
+	ServiceStarting:             "Starting service '%s'...",
+	ServiceStartSuccess:         "✅ Service '%s' started successfully with PID: %d.",
+	ServiceStartFailed:          "❌ Failed to start service '%s': %v",
+	ServiceStartNotConfigured:   "❌ Service '%s' has no start command configured.",
+	ServiceStopShortDesc:        "Stop a service",
+	ServiceStopLongDesc:         "Stop a service from the global services list.",
+	ServiceStopping:             "Stopping service '%s'...",
+	ServiceStopSuccess:          "✅ Service '%s' stopped successfully.",
+	ServiceStopFailed:           "❌ Failed to stop service '%s': %v",
+	ServiceStopNotConfigured:    "❌ Service '%s' has no stop command configured.",
+	ServiceStopNotRunning:       "⚠️ Service '%s' is not running.",
+	ServiceNotFound:             "❌ Service '%s' not found.",
+	ServiceIdRequired:           "Please specify a service ID.",
+	ServiceNoReleaseFound:       "❌ No releases found for service '%s'.",
+	ServiceNotConfigured:        "❌ Service '%s' is not properly configured.",
+	ServiceAlreadyRunning:       "⚠️ Service '%s' is already running with PID: %d.",
+	ServiceStalePidFile:         "Stale PID file found and removed.",
+	ServiceSupervisorNotRunning: "service.restart is set but no supervisor is running (run 'revlay proxy' or 'revlay-agent'), starting the service unsupervised",
+	ServiceSupervisedStart:      "Supervisor started the service with PID %d on port %d (restart: %s)",
+	ServiceSupervisedStop:       "Supervisor stopped the service on port %d (exit code %d)",
+	ServiceNoProcessFound:       "No service process found on port %d, the service may not be running.",
+	ServiceRunningStopCommand:   "Running stop command: %s",
+	ServiceStopCommandFailed:    "Stop command failed, sending SIGTERM instead: %v",
+	ServiceForceKill:            "Process %d did not exit within %v, sending SIGKILL.",
+	ServiceStoppedBy:            "Service on port %d stopped (%s).",
 
 	// Push Command
 	PreflightCheckFailed: "本地环境预检失败：命令 '%s' 未找到。请安装该命令并确保其位于系统的 PATH 环境变量中。错误: %v",
@@ -639,6 +790,7 @@ var englishMessages = Messages{
 	DeployRestartingService:           "Step 6: Restarting service...",
 	DeployHealthCheck:                 "Step 7: Performing health check...",
 	DeployHealthAttempt:               "  - Health check attempt #%d to %s...",
+	DeployHealthSkipped:               "  - Health check type is none, skipping the health check.",
 	DeployHealthFailed:                " Failed",
 	DeployHealthPassed:                " Passed.",
 	DeployPostHooks:                   "Step 8: Running post-deploy hooks...",
@@ -660,7 +812,6 @@ var englishMessages = Messages{
 	DeploySwitchProxy:                 "Health check passed. Switching proxy traffic to port %d...",
 	DeployActivateSymlink:             "Activating new release symlink...",
 	DeployStopOldService:              "Stopping old service on port %d (after %s grace period)...",
-	DeployErrProcExitedEarly:          "new release process exited cleanly (status 0) before health check passed; a service is expected to stay online",
 	DeployErrProcExitedEarlyWithError: "new release process exited unexpectedly during startup: %v",
 	DeployCurrentPortInfo:             "  - Current service detected on port: %d",
 	DeployNewPortInfo:                 "  - New service will start on port: %d",
@@ -701,6 +852,35 @@ var englishMessages = Messages{
 	DeployOldPidNotFound:              "Could not find PID for the old service.",
 	DeployFindOldProcessFailed:        "Failed to find old process with PID %d: %v",
 	DeployStopOldProcessFailed:        "Failed to stop old process %d: %v",
+	DeployDrainWaiting:                "%d connections still on :%d, waiting for them to finish...",
+	DeployDrainComplete:               "All connections on :%d have drained.",
+	DeployDrainTimeout:                "Drain timed out after %s with %d connections still on :%d, stopping the old service anyway.",
+	DeployDrainNoProxy:                "No running proxy detected, skipping connection draining.",
+	DeploySwitchNoProxy:               "Proxy is not running, wrote the state file instead. The proxy will use the new port when it starts.",
+	DeploySwitchNotAcknowledged:       "Proxy did not acknowledge the switch to port %d: %v",
+	DeploySwitchWrongTarget:           "Proxy reports target %s after switching to port %d",
+	DeploySwitchAcknowledged:          "Proxy acknowledged the switch, now forwarding to %s",
+	DeployCanaryStart:                 "Shifting traffic to port %d gradually, steps: %s",
+	DeployCanaryStep:                  "Sending %d%% of traffic to the new release, observing for %s...",
+	DeployCanaryStepPassed:            "Step at %d%% looks healthy (%d requests, %d errors).",
+	DeployCanaryNoProxy:               "Proxy is not running, cannot shift traffic gradually. Switching in one step instead.",
+	DeployCanaryHealthFailed:          "The new release failed its health check: %v",
+	DeployCanaryErrorRate:             "The new release has an error rate of %.1f%% (%d/%d), above the limit of %.1f%%",
+	DeployCanaryProcessExited:         "The new release exited while traffic was being shifted",
+	DeployCanarySplitFailed:           "The proxy did not accept the traffic split: %v",
+	DeployCanaryRolledBack:            "Gradual rollout failed, all traffic is back on the old release: %v",
+	DeployCanaryRollbackFailed:        "Could not send traffic back to the old port %d: %v",
+	DeployVerify:                      "Verifying the new release",
+	DeployRunningHooks:                "  -> Running %s hooks...",
+	DeployHookTimedOut:                "Hook '%s' did not finish within %s and was killed",
+	DeployHookWarn:                    "Hook failed, the deployment continues: %v",
+	DeployVerifyStart:                 "Observing the new release for %s, the old release keeps running...",
+	DeployVerifyPassed:                "The new release stayed healthy during verification.",
+	DeployVerifyProcessExited:         "The new release exited during verification",
+	DeployVerifyHealthFailed:          "The new release failed its health check during verification: %v",
+	DeployVerifyReverting:             "Verification failed, switching traffic back to release %s on port %d...",
+	DeployVerifyRevertFailed:          "Could not switch traffic back, the new release still receives it: %v",
+	DeployVerifyFailed:                "Verification of the new release failed, it is marked as failed: %v",
 
 	// SSH Messages
 	SSHRunningRemote: "Running on remote server: %s",
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/color"
+)
+
+// ControlSocketName is the unix socket, next to the active port state file,
+// on which a running proxy accepts control commands.
+const ControlSocketName = "proxy.sock"
+
+// Control commands understood by the proxy.
+const (
+	CommandSwitch = "switch"
+	CommandStatus = "status"
+	CommandDrain  = "drain"
+	CommandPause  = "pause"
+	CommandResume = "resume"
+	CommandSplit  = "split"
+)
+
+// ErrProxyNotRunning is returned by ControlClient when no proxy is listening on the socket.
+var ErrProxyNotRunning = errors.New("proxy is not running")
+
+// ControlRequest is a single command sent to the proxy.
+type ControlRequest struct {
+	Command string `json:"command"`
+	// Port is the backend port for switch and drain.
+	Port int `json:"port,omitempty"`
+	// TimeoutMillis bounds how long drain waits, in milliseconds.
+	TimeoutMillis int64 `json:"timeout_ms,omitempty"`
+	// Targets are the weighted backends for split.
+	Targets []Target `json:"targets,omitempty"`
+}
+
+// ControlResponse is the proxy's answer to a ControlRequest.
+type ControlResponse struct {
+	OK     bool    `json:"ok"`
+	Error  string  `json:"error,omitempty"`
+	Status *Status `json:"status,omitempty"`
+}
+
+// Status describes the state of a running proxy.
+type Status struct {
+	// PID is the process serving the proxy, it changes after an upgrade.
+	PID        int                    `json:"pid"`
+	ListenAddr string                 `json:"listen_addr"`
+	Mode       Mode                   `json:"mode"`
+	Target     string                 `json:"target"`
+	Targets    []Target               `json:"targets"`
+	Paused     bool                   `json:"paused"`
+	Active     map[string]int         `json:"active"`
+	Stats      map[string]TargetStats `json:"stats"`
+}
+
+// Split reports whether traffic is currently split between several backends.
+func (s *Status) Split() bool {
+	return len(s.Targets) > 1
+}
+
+// ActiveOn returns the number of connections still open to the backend on the given local port.
+func (s *Status) ActiveOn(port int) int {
+	return s.Active[localAddr(port)]
+}
+
+// startControlServer listens on the control socket and serves commands until the listener is closed.
+func (m *Manager) startControlServer() (net.Listener, error) {
+	socketPath := filepath.Join(filepath.Dir(m.stateFile), ControlSocketName)
+	listener, err := ListenUnix(socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on control socket: %w", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Print(color.Red(fmt.Sprintf("Control socket accept failed: %v", err)))
+				continue
+			}
+			go m.handleControlConn(conn)
+		}
+	}()
+	return listener, nil
+}
+
+func (m *Manager) handleControlConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req ControlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(&ControlResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	resp := m.handleControlRequest(&req)
+	json.NewEncoder(conn).Encode(resp)
+}
+
+func (m *Manager) handleControlRequest(req *ControlRequest) *ControlResponse {
+	var err error
+	switch req.Command {
+	case CommandSwitch:
+		err = m.switchTo(req.Port)
+	case CommandStatus:
+	case CommandDrain:
+		err = m.drain(req.Port, time.Duration(req.TimeoutMillis)*time.Millisecond)
+	case CommandPause:
+		log.Print(color.Yellow("Proxy paused, new connections are held until resume."))
+		m.proxy.Pause()
+	case CommandResume:
+		log.Print(color.Green("Proxy resumed."))
+		m.proxy.Resume()
+	case CommandSplit:
+		// A split is deliberately not persisted: a restarted proxy goes back to the
+		// port in the state file, which is the last fully switched release.
+		err = m.proxy.SetTargets(req.Targets)
+	default:
+		err = fmt.Errorf("unknown command '%s'", req.Command)
+	}
+
+	resp := &ControlResponse{OK: err == nil, Status: m.status()}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+// switchTo points the proxy at the given local port and persists it to the state file.
+func (m *Manager) switchTo(port int) error {
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	m.proxy.SwitchTarget(localAddr(port))
+	// Persist the target so that a restarted proxy comes back on the same port.
+	// The watcher sees this write too, switching again is a no-op.
+	if err := m.writeStateFile(port); err != nil {
+		return fmt.Errorf("switched, but could not persist state file: %w", err)
+	}
+	return nil
+}
+
+// drain waits until no connections are open to the given port, for at most timeout.
+func (m *Manager) drain(port int, timeout time.Duration) error {
+	addr := localAddr(port)
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := m.proxy.ActiveConnections()[addr]
+		if remaining == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d connections still on :%d", remaining, port)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (m *Manager) status() *Status {
+	return &Status{
+		PID:        os.Getpid(),
+		ListenAddr: m.listenAddr,
+		Mode:       m.opts.Mode,
+		Target:     m.proxy.TargetAddr(),
+		Targets:    m.proxy.Targets(),
+		Paused:     m.proxy.Paused(),
+		Active:     m.proxy.ActiveConnections(),
+		Stats:      m.proxy.Stats(),
+	}
+}
+
+// ControlClient sends commands to a running proxy over its control socket.
+type ControlClient struct {
+	socketPath string
+}
+
+// NewControlClient creates a client for the control socket at socketPath.
+func NewControlClient(socketPath string) *ControlClient {
+	return &ControlClient{socketPath: socketPath}
+}
+
+// Switch points the proxy at the given local port. The returned status confirms the new target.
+func (c *ControlClient) Switch(port int) (*Status, error) {
+	return c.do(&ControlRequest{Command: CommandSwitch, Port: port}, 0)
+}
+
+// Status returns the current state of the proxy.
+func (c *ControlClient) Status() (*Status, error) {
+	return c.do(&ControlRequest{Command: CommandStatus}, 0)
+}
+
+// Drain waits until no connections are open to the given port, for at most timeout.
+func (c *ControlClient) Drain(port int, timeout time.Duration) (*Status, error) {
+	return c.do(&ControlRequest{Command: CommandDrain, Port: port, TimeoutMillis: timeout.Milliseconds()}, timeout)
+}
+
+// Split sends new connections to several backends according to their weights,
+// until the next Switch or Split.
+func (c *ControlClient) Split(targets []Target) (*Status, error) {
+	return c.do(&ControlRequest{Command: CommandSplit, Targets: targets}, 0)
+}
+
+// Pause makes the proxy hold new connections until Resume is called.
+func (c *ControlClient) Pause() (*Status, error) {
+	return c.do(&ControlRequest{Command: CommandPause}, 0)
+}
+
+// Resume releases held connections and lets new ones through again.
+func (c *ControlClient) Resume() (*Status, error) {
+	return c.do(&ControlRequest{Command: CommandResume}, 0)
+}
+
+func (c *ControlClient) do(req *ControlRequest, wait time.Duration) (*Status, error) {
+	conn, err := net.DialTimeout("unix", c.socketPath, 2*time.Second)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, ErrProxyNotRunning
+		}
+		return nil, fmt.Errorf("could not connect to proxy control socket: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5*time.Second + wait))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("could not send %s command to proxy: %w", req.Command, err)
+	}
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("no valid answer from proxy to %s command: %w", req.Command, err)
+	}
+	if !resp.OK {
+		return resp.Status, errors.New(resp.Error)
+	}
+	return resp.Status, nil
+}
+
+// gate holds callers while the proxy is paused.
+type gate struct {
+	mu     sync.Mutex
+	resume chan struct{}
+}
+
+func (g *gate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resume == nil {
+		g.resume = make(chan struct{})
+	}
+}
+
+func (g *gate) unpause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resume != nil {
+		close(g.resume)
+		g.resume = nil
+	}
+}
+
+func (g *gate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resume != nil
+}
+
+// wait blocks while the gate is paused, or until done is closed.
+func (g *gate) wait(done <-chan struct{}) bool {
+	g.mu.Lock()
+	resume := g.resume
+	g.mu.Unlock()
+	if resume == nil {
+		return true
+	}
+	select {
+	case <-resume:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func localAddr(port int) string {
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
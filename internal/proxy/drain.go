@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DrainStateFileName is the file, next to the active port state file, where the
+// proxy publishes how many connections are still open to each backend.
+const DrainStateFileName = "connections.json"
+
+// DrainState is the connection state published by a running proxy.
+type DrainState struct {
+	// Target is the backend address new connections are currently sent to.
+	Target string `json:"target"`
+	// Active maps a backend address to the number of connections still open to it.
+	Active map[string]int `json:"active"`
+	// UpdatedAt is refreshed periodically while the proxy is running.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ActiveOn returns the number of connections still open to the backend on the given local port.
+func (s *DrainState) ActiveOn(port int) int {
+	return s.Active[localAddr(port)]
+}
+
+// Stale reports whether the state was not refreshed recently, which means the proxy is not running.
+func (s *DrainState) Stale() bool {
+	return time.Since(s.UpdatedAt) > drainStateStaleAfter
+}
+
+// ReadDrainState reads the drain state published by the proxy.
+func ReadDrainState(path string) (*DrainState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state DrainState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid drain state file: %w", err)
+	}
+	return &state, nil
+}
+
+func writeDrainState(path string, state *DrainState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see a partial file.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+const (
+	drainStateRefreshInterval = 5 * time.Second
+	drainStateStaleAfter      = 3 * drainStateRefreshInterval
+)
+
+// connTracker counts the connections that are open to each backend,
+// and how many were handled by each backend in total.
+type connTracker struct {
+	mu      sync.Mutex
+	active  map[string]int
+	stats   map[string]TargetStats
+	changed chan struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		active:  make(map[string]int),
+		stats:   make(map[string]TargetStats),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// count records one finished dial or request to addr.
+func (t *connTracker) count(addr string, failed bool) {
+	t.update(addr, func(s *TargetStats) {
+		s.Requests++
+		if failed {
+			s.Errors++
+		}
+	})
+}
+
+// dialFailed records that a connection to addr could not be established.
+func (t *connTracker) dialFailed(addr string) {
+	t.update(addr, func(s *TargetStats) { s.DialFailures++ })
+}
+
+// transferred records bytes copied from the client to addr (in) and back (out).
+func (t *connTracker) transferred(addr string, in, out int64) {
+	t.update(addr, func(s *TargetStats) {
+		s.BytesIn += in
+		s.BytesOut += out
+	})
+}
+
+// switched records that addr started receiving new traffic.
+func (t *connTracker) switched(addr string) {
+	t.update(addr, func(s *TargetStats) { s.Switches++ })
+}
+
+func (t *connTracker) update(addr string, f func(s *TargetStats)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.stats[addr]
+	f(&s)
+	t.stats[addr] = s
+}
+
+// statsSnapshot returns a copy of the per-backend counters.
+func (t *connTracker) statsSnapshot() map[string]TargetStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make(map[string]TargetStats, len(t.stats))
+	for addr, s := range t.stats {
+		stats[addr] = s
+	}
+	return stats
+}
+
+func (t *connTracker) add(addr string) {
+	t.mu.Lock()
+	t.active[addr]++
+	t.mu.Unlock()
+	t.notify()
+}
+
+func (t *connTracker) done(addr string) {
+	t.mu.Lock()
+	t.active[addr]--
+	if t.active[addr] <= 0 {
+		delete(t.active, addr)
+	}
+	t.mu.Unlock()
+	t.notify()
+}
+
+func (t *connTracker) notify() {
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+// snapshot returns a copy of the active connection counts.
+func (t *connTracker) snapshot() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := make(map[string]int, len(t.active))
+	for addr, n := range t.active {
+		counts[addr] = n
+	}
+	return counts
+}
+
+// publishDrainState keeps the drain state file up to date until stop is closed.
+func (m *Manager) publishDrainState(stop <-chan struct{}) {
+	path := filepath.Join(filepath.Dir(m.stateFile), DrainStateFileName)
+	ticker := time.NewTicker(drainStateRefreshInterval)
+	defer ticker.Stop()
+
+	write := func() {
+		state := &DrainState{
+			Target:    m.proxy.TargetAddr(),
+			Active:    m.proxy.ActiveConnections(),
+			UpdatedAt: time.Now(),
+		}
+		// A failed write is not fatal for proxying, deployers treat the state as missing.
+		_ = writeDrainState(path, state)
+	}
+
+	write()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-m.proxy.changes():
+			write()
+			// Coalesce bursts of connection changes into one write.
+			time.Sleep(100 * time.Millisecond)
+		case <-ticker.C:
+			write()
+		}
+	}
+}
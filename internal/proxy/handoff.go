@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables used to pass listening sockets to an upgraded proxy process.
+const (
+	// listenersEnv maps inherited file descriptors to listeners, e.g. "tcp::80=3,unix:/app/.revlay/proxy.sock=4".
+	listenersEnv = "REVLAY_PROXY_LISTENERS"
+	// readyEnv is the file descriptor the new process writes to once it serves all listeners.
+	readyEnv = "REVLAY_PROXY_READY_FD"
+)
+
+// listenerRegistry knows every listener of this process, so that Handoff can pass
+// them on, and the listeners inherited from a previous process that are not taken yet.
+var listenerRegistry = struct {
+	sync.Mutex
+	active    map[string]net.Listener
+	inherited map[string]*os.File
+	loaded    bool
+}{active: make(map[string]net.Listener)}
+
+// listen returns a listener for addr, reusing one inherited from the previous
+// proxy process if there is one. Listeners are registered for a later Handoff.
+func listen(network, addr string) (net.Listener, error) {
+	key := network + ":" + addr
+
+	listenerRegistry.Lock()
+	defer listenerRegistry.Unlock()
+	loadInheritedListeners()
+
+	var l net.Listener
+	var err error
+	if f, ok := listenerRegistry.inherited[key]; ok {
+		delete(listenerRegistry.inherited, key)
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not use listener inherited for %s: %w", key, err)
+		}
+		// The socket file is ours now, remove it on close unless we hand it off again.
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+	} else {
+		l, err = net.Listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listenerRegistry.active[key] = l
+	return &registeredListener{Listener: l, key: key}, nil
+}
+
+// ListenUnix listens on the unix socket at path, accessible to the owner only.
+// Like the proxy's own sockets it is handed over to an upgraded process.
+// A socket left behind by a crashed process is replaced, a live one is an error.
+func ListenUnix(path string) (net.Listener, error) {
+	// After a handoff the socket is inherited from the previous process, which is still serving it.
+	if _, err := os.Stat(path); err == nil && !inherited("unix", path) {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another process is already listening on %s", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(path, 0600)
+	return listener, nil
+}
+
+// inherited reports whether a listener for addr was passed on by the previous proxy process.
+func inherited(network, addr string) bool {
+	listenerRegistry.Lock()
+	defer listenerRegistry.Unlock()
+	loadInheritedListeners()
+	_, ok := listenerRegistry.inherited[network+":"+addr]
+	return ok
+}
+
+// loadInheritedListeners parses listenersEnv once. The caller holds the registry lock.
+func loadInheritedListeners() {
+	if listenerRegistry.loaded {
+		return
+	}
+	listenerRegistry.loaded = true
+	listenerRegistry.inherited = make(map[string]*os.File)
+
+	spec := os.Getenv(listenersEnv)
+	os.Unsetenv(listenersEnv)
+	for _, entry := range strings.Split(spec, ",") {
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			continue
+		}
+		fd, err := strconv.Atoi(entry[i+1:])
+		if err != nil {
+			continue
+		}
+		listenerRegistry.inherited[entry[:i]] = os.NewFile(uintptr(fd), entry[:i])
+	}
+}
+
+// registeredListener removes itself from the registry when closed.
+type registeredListener struct {
+	net.Listener
+	key string
+}
+
+func (l *registeredListener) Close() error {
+	listenerRegistry.Lock()
+	if listenerRegistry.active[l.key] == l.Listener {
+		delete(listenerRegistry.active, l.key)
+	}
+	listenerRegistry.Unlock()
+	return l.Listener.Close()
+}
+
+// Handoff starts a new proxy process from the current executable and arguments,
+// passing it every listening socket of this process. It returns once the new
+// process reports that it serves all of them, or fails if it exits or does not
+// become ready within timeout. On success the caller should shut down gracefully:
+// closing its listeners no longer affects clients, the new process keeps accepting.
+func Handoff(timeout time.Duration) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("could not find the proxy executable: %w", err)
+	}
+
+	listenerRegistry.Lock()
+	var files []*os.File
+	var entries []string
+	for key, l := range listenerRegistry.active {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		// Closing our copy must not remove the socket file the new process serves.
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		f, err := fl.File()
+		if err != nil {
+			listenerRegistry.Unlock()
+			closeFiles(files)
+			return nil, fmt.Errorf("could not pass on listener %s: %w", key, err)
+		}
+		// ExtraFiles start at fd 3 in the new process.
+		entries = append(entries, fmt.Sprintf("%s=%d", key, 3+len(files)))
+		files = append(files, f)
+	}
+	listenerRegistry.Unlock()
+	defer closeFiles(files)
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		listenersEnv+"="+strings.Join(entries, ","),
+		fmt.Sprintf("%s=%d", readyEnv, 3+len(files)),
+	)
+	cmd.ExtraFiles = append(files, readyWriter)
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not start new proxy process: %w", err)
+	}
+
+	// The pipe yields a byte once the new process is ready, or EOF if it exits first.
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := ready.Read(buf); err != nil {
+			result <- fmt.Errorf("new proxy process exited before it was ready")
+			return
+		}
+		result <- nil
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			cmd.Wait()
+			return nil, err
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("new proxy process was not ready within %s", timeout)
+	}
+
+	// The new process outlives us, nobody waits for it here.
+	go cmd.Wait()
+	return cmd.Process, nil
+}
+
+// NotifyReady tells the proxy process that started this one through Handoff
+// that all listeners are served. Under a systemd Type=notify unit it also reports
+// readiness to systemd, after a handoff together with this process's PID as the
+// unit's new main process, before the old process exits.
+func NotifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyEnv))
+	if err != nil {
+		sdNotify("READY=1")
+		return
+	}
+	os.Unsetenv(readyEnv)
+	sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+
+	// Inherited listeners nobody asked for belong to apps that no longer exist.
+	listenerRegistry.Lock()
+	for key, f := range listenerRegistry.inherited {
+		f.Close()
+		delete(listenerRegistry.inherited, key)
+	}
+	listenerRegistry.Unlock()
+
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// sdNotify sends state to systemd's notification socket. It does nothing when the
+// process does not run under a Type=notify unit. NOTIFY_SOCKET is kept in the
+// environment, the process started by the next upgrade needs it as well.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
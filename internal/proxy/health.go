@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/color"
+)
+
+// FailoverFileName is the file, next to the active port state file, where the
+// proxy records why it last failed over to another backend.
+const FailoverFileName = "failover.json"
+
+// HealthOptions configures active health checking of the backend.
+type HealthOptions struct {
+	// Path is the HTTP path probed on the backend. Empty only checks that it accepts connections.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// UnhealthyThreshold is the number of failed probes in a row before the backend counts as down.
+	UnhealthyThreshold int
+	// FailoverPorts are the local ports the proxy may switch to when the active backend is down,
+	// usually the other colour of a blue/green pair.
+	FailoverPorts []int
+}
+
+// FailoverRecord describes an automatic failover performed by the proxy.
+type FailoverRecord struct {
+	Time     time.Time `json:"time"`
+	FromPort int       `json:"from_port"`
+	ToPort   int       `json:"to_port"`
+	Reason   string    `json:"reason"`
+}
+
+// ReadFailoverRecord reads the last failover recorded by the proxy.
+func ReadFailoverRecord(path string) (*FailoverRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var record FailoverRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid failover file: %w", err)
+	}
+	return &record, nil
+}
+
+// probeBackend checks a backend once. With a path it must answer with a 2xx or 3xx status.
+func probeBackend(addr, path string, timeout time.Duration) error {
+	if path == "" {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get("http://" + addr + path)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("%s returned status %d", path, resp.StatusCode)
+	}
+	return nil
+}
+
+// monitorHealth probes the active backend until stop is closed and fails over
+// to a healthy backend on one of the failover ports when it goes down.
+func (m *Manager) monitorHealth(stop <-chan struct{}) {
+	opts := m.opts.Health
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	threshold := opts.UnhealthyThreshold
+	if threshold <= 0 {
+		threshold = 3
+	}
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	failures := 0
+	reported := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		// A split belongs to a deployment in progress, which watches the backends itself.
+		// A paused proxy is being worked on by hand.
+		if len(m.proxy.Targets()) > 1 || m.proxy.Paused() {
+			failures = 0
+			continue
+		}
+
+		active := m.proxy.TargetAddr()
+		err := probeBackend(active, opts.Path, timeout)
+		if err == nil {
+			if failures >= threshold {
+				log.Print(color.Green(fmt.Sprintf("Backend %s is healthy again.", active)))
+			}
+			failures, reported = 0, false
+			continue
+		}
+
+		failures++
+		if failures < threshold {
+			continue
+		}
+
+		reason := fmt.Sprintf("%d health checks in a row failed on %s: %v", failures, active, err)
+		if port, ok := m.healthyFailoverPort(active, timeout); ok {
+			m.failover(active, port, reason)
+			failures, reported = 0, false
+			continue
+		}
+		if !reported {
+			log.Print(color.Red(fmt.Sprintf("Backend %s is down and no other backend is healthy: %s", active, reason)))
+			reported = true
+		}
+	}
+}
+
+// healthyFailoverPort returns the first failover port, other than active, whose backend passes a probe.
+func (m *Manager) healthyFailoverPort(active string, timeout time.Duration) (int, bool) {
+	for _, port := range m.opts.Health.FailoverPorts {
+		if localAddr(port) == active {
+			continue
+		}
+		if probeBackend(localAddr(port), m.opts.Health.Path, timeout) == nil {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// failover switches to port and records why in the state directory.
+func (m *Manager) failover(from string, port int, reason string) {
+	log.Print(color.Red(fmt.Sprintf("Failing over from %s to %s: %s", from, localAddr(port), reason)))
+	if err := m.switchTo(port); err != nil {
+		log.Print(color.Red(fmt.Sprintf("Failover: %v", err)))
+	}
+
+	fromPort := 0
+	if _, p, err := net.SplitHostPort(from); err == nil {
+		fmt.Sscan(p, &fromPort)
+	}
+	record := &FailoverRecord{Time: time.Now(), FromPort: fromPort, ToPort: port, Reason: reason}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(filepath.Dir(m.stateFile), FailoverFileName), data, 0644)
+	}
+	if err != nil {
+		log.Print(color.Red(fmt.Sprintf("Could not record failover: %v", err)))
+	}
+}
@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/color"
+)
+
+// HTTPProxy is an HTTP-aware reverse proxy with a switchable target.
+// Unlike TCPProxy it parses requests, which allows it to add forwarding
+// headers, write access logs and answer clients itself when the backend is down.
+type HTTPProxy struct {
+	listener    net.Listener
+	server      *http.Server
+	targets     *targetSet
+	hosts       []string
+	accessLog   *log.Logger
+	transport   *http.Transport
+	reverse     *httputil.ReverseProxy
+	tracker     *connTracker
+	gate        gate
+	retryWindow time.Duration
+}
+
+// NewHTTPProxy creates a new HTTPProxy. A nil accessLog disables access logging.
+func NewHTTPProxy(initialTarget string, hosts []string, accessLog *log.Logger) *HTTPProxy {
+	p := &HTTPProxy{
+		targets:   newTargetSet(initialTarget),
+		hosts:     normalizeHosts(hosts),
+		accessLog: accessLog,
+		tracker:   newConnTracker(),
+	}
+
+	p.transport = http.DefaultTransport.(*http.Transport).Clone()
+	p.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, _, err := dialWithRetry(ctx, func() string { return addr }, p.retryWindow)
+		return conn, err
+	}
+
+	p.reverse = &httputil.ReverseProxy{
+		Rewrite:      p.rewrite,
+		Transport:    p.transport,
+		ErrorHandler: p.handleError,
+		ErrorLog:     log.Default(),
+	}
+	return p
+}
+
+// Start initializes the listener and starts serving HTTP requests.
+func (p *HTTPProxy) Start(listenAddr string) error {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	p.Serve(listener)
+	return nil
+}
+
+// Serve starts serving HTTP requests from listener in the background.
+// A TLS listener makes the proxy report X-Forwarded-Proto: https.
+func (p *HTTPProxy) Serve(listener net.Listener) {
+	p.listener = listener
+	p.server = &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := p.server.Serve(p.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Print(color.Red(fmt.Sprintf("HTTP proxy stopped serving: %v", err)))
+		}
+	}()
+}
+
+// SetRetryWindow makes requests wait for up to window while their backend cannot
+// be dialed, or until the client gives up. Zero fails requests at once.
+// Unlike TCPProxy, a held request stays with the backend it was assigned to.
+func (p *HTTPProxy) SetRetryWindow(window time.Duration) {
+	p.retryWindow = window
+}
+
+// SwitchTarget safely sends all new requests to a single target address.
+func (p *HTTPProxy) SwitchTarget(newTargetAddr string) {
+	old := p.targets.list()
+	if p.targets.set([]Target{{Addr: newTargetAddr, Weight: 100}}) {
+		log.Print(color.Green(fmt.Sprintf("Proxy switching target from %s to %s", describeTargets(old), newTargetAddr)))
+		recordSwitches(p.tracker, old, p.targets.list())
+		// Keep-alive connections to the old backend must not carry new requests.
+		p.transport.CloseIdleConnections()
+	}
+}
+
+// SetTargets splits new requests between several targets according to their weights.
+// The backend is picked per request, so keep-alive clients are split too.
+func (p *HTTPProxy) SetTargets(targets []Target) error {
+	if err := validateTargets(targets); err != nil {
+		return err
+	}
+	old := p.targets.list()
+	if p.targets.set(targets) {
+		log.Print(color.Green(fmt.Sprintf("Proxy splitting traffic: %s", describeTargets(p.targets.list()))))
+		recordSwitches(p.tracker, old, p.targets.list())
+		p.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// Targets returns the targets new requests are split between.
+func (p *HTTPProxy) Targets() []Target {
+	return p.targets.list()
+}
+
+// TargetAddr returns the address that receives the largest share of new requests.
+func (p *HTTPProxy) TargetAddr() string {
+	return p.targets.primary()
+}
+
+// ActiveConnections returns the number of in-flight requests per backend address.
+// Upgraded connections such as websockets count until they are closed.
+func (p *HTTPProxy) ActiveConnections() map[string]int {
+	return p.tracker.snapshot()
+}
+
+// Stats returns how many requests each backend received and how many of them failed
+// with a 5xx status or could not be proxied at all.
+func (p *HTTPProxy) Stats() map[string]TargetStats {
+	return p.tracker.statsSnapshot()
+}
+
+func (p *HTTPProxy) changes() <-chan struct{} {
+	return p.tracker.changed
+}
+
+// Close stops serving. Unlike TCPProxy.Close it also closes open connections.
+func (p *HTTPProxy) Close() error {
+	if p.server == nil {
+		return nil
+	}
+	return p.server.Close()
+}
+
+// Shutdown stops accepting new requests and waits for in-flight ones to finish.
+// Connections still open when ctx is done are closed.
+func (p *HTTPProxy) Shutdown(ctx context.Context) error {
+	if p.server == nil {
+		return nil
+	}
+	// server.Shutdown does not wait for upgraded connections such as websockets, the tracker does.
+	err := p.server.Shutdown(ctx)
+	if err == nil {
+		err = waitIdle(ctx, p)
+	}
+	if err != nil {
+		p.server.Close()
+	}
+	return err
+}
+
+// Pause holds new requests until Resume is called. In-flight requests are not affected.
+func (p *HTTPProxy) Pause() {
+	p.gate.pause()
+}
+
+// Resume releases held requests.
+func (p *HTTPProxy) Resume() {
+	p.gate.unpause()
+}
+
+// Paused reports whether the proxy is holding new requests.
+func (p *HTTPProxy) Paused() bool {
+	return p.gate.paused()
+}
+
+// MatchesHost reports whether a request for the given Host header belongs to this proxy.
+func (p *HTTPProxy) MatchesHost(host string) bool {
+	if len(p.hosts) == 0 {
+		return true
+	}
+	host = stripPort(host)
+	for _, h := range p.hosts {
+		if h == host {
+			return true
+		}
+		// "*.example.com" matches any direct subdomain of example.com
+		if strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) && !strings.Contains(strings.TrimSuffix(host, h[1:]), ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP forwards a single request to the current target.
+func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if !p.gate.wait(r.Context().Done()) {
+		// The client gave up while the proxy was paused.
+		return
+	}
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	target := p.targets.pick()
+
+	if !p.MatchesHost(r.Host) {
+		writeErrorPage(rec, http.StatusMisdirectedRequest, fmt.Sprintf("No application is configured for host %q.", stripPort(r.Host)))
+	} else {
+		ctx := context.WithValue(r.Context(), targetContextKey{}, target)
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		p.tracker.add(target)
+		// ReverseProxy panics with http.ErrAbortHandler when the backend fails in the
+		// middle of the response, the request must still be counted as finished.
+		defer func() {
+			p.tracker.done(target)
+			p.tracker.count(target, rec.status >= http.StatusInternalServerError)
+			p.tracker.transferred(target, body.n, rec.bytes)
+		}()
+		p.reverse.ServeHTTP(rec, r.WithContext(ctx))
+	}
+
+	p.logRequest(r, rec, target, time.Since(start))
+}
+
+type targetContextKey struct{}
+
+func (p *HTTPProxy) rewrite(pr *httputil.ProxyRequest) {
+	// The target is resolved once per request in ServeHTTP so that the
+	// access log and the forwarded request always agree on the backend.
+	target, _ := pr.In.Context().Value(targetContextKey{}).(string)
+	if target == "" {
+		target = p.TargetAddr()
+	}
+	pr.SetURL(&url.URL{Scheme: "http", Host: target})
+	// Backends usually route on the original Host, not on 127.0.0.1:PORT.
+	pr.Out.Host = pr.In.Host
+	pr.SetXForwarded()
+}
+
+func (p *HTTPProxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	target, _ := r.Context().Value(targetContextKey{}).(string)
+	log.Print(color.Red(fmt.Sprintf("Failed to proxy %s %s to %s: %v", r.Method, r.URL.Path, target, err)))
+
+	if errors.Is(err, context.Canceled) {
+		// The client went away, nobody is left to read a response.
+		return
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		p.tracker.dialFailed(target)
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		writeErrorPage(w, http.StatusServiceUnavailable, "The application is not accepting connections right now. Please try again shortly.")
+		return
+	}
+	writeErrorPage(w, http.StatusBadGateway, "The application did not return a valid response.")
+}
+
+func (p *HTTPProxy) logRequest(r *http.Request, rec *responseRecorder, target string, duration time.Duration) {
+	if p.accessLog == nil {
+		return
+	}
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	p.accessLog.Printf("%s - - [%s] %q %d %d %q %q %s %s",
+		clientIP,
+		time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+		fmt.Sprintf("%s %s %s", r.Method, r.RequestURI, r.Proto),
+		rec.status,
+		rec.bytes,
+		r.Referer(),
+		r.UserAgent(),
+		target,
+		duration.Round(time.Millisecond),
+	)
+}
+
+// responseRecorder captures the status code and body size for access logs.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer (flushing, hijacking for websockets).
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func writeErrorPage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "5")
+	}
+	w.WriteHeader(status)
+	fmt.Fprintf(w, errorPageTemplate, status, http.StatusText(status), status, http.StatusText(status), html.EscapeString(message))
+}
+
+const errorPageTemplate = `<!DOCTYPE html>
+<html>
+<head><title>%d %s</title></head>
+<body>
+<h1>%d %s</h1>
+<p>%s</p>
+<hr><p><small>revlay proxy</small></p>
+</body>
+</html>
+`
+
+func normalizeHosts(hosts []string) []string {
+	var normalized []string
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" {
+			normalized = append(normalized, h)
+		}
+	}
+	return normalized
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/color"
+)
+
+// metricsServer serves the metrics of every manager configured with the same
+// metrics address, so that apps fronted by one process share a scrape target.
+type metricsServer struct {
+	server   *http.Server
+	managers []*Manager
+}
+
+var (
+	metricsMu      sync.Mutex
+	metricsServers = make(map[string]*metricsServer)
+)
+
+// registerMetrics adds m to the metrics listener on addr, starting it when needed.
+func registerMetrics(addr string, m *Manager) error {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	s, ok := metricsServers[addr]
+	if !ok {
+		listener, err := listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("could not listen for metrics on %s: %w", addr, err)
+		}
+		s = &metricsServer{}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", s.serveMetrics)
+		s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Print(color.Red(fmt.Sprintf("Metrics listener on %s stopped serving: %v", addr, err)))
+			}
+		}()
+		metricsServers[addr] = s
+		log.Print(color.Green(fmt.Sprintf("Serving proxy metrics on http://%s/metrics", addr)))
+	}
+	s.managers = append(s.managers, m)
+	return nil
+}
+
+// unregisterMetrics removes m from the metrics listener on addr, closing it when the last manager leaves.
+func unregisterMetrics(addr string, m *Manager) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	s, ok := metricsServers[addr]
+	if !ok {
+		return
+	}
+	for i, existing := range s.managers {
+		if existing == m {
+			s.managers = append(s.managers[:i], s.managers[i+1:]...)
+			break
+		}
+	}
+	if len(s.managers) == 0 {
+		s.server.Close()
+		delete(metricsServers, addr)
+	}
+}
+
+func (s *metricsServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	managers := append([]*Manager(nil), s.managers...)
+	metricsMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, managers)
+}
+
+// appMetrics is a snapshot of one manager's counters.
+type appMetrics struct {
+	app     string
+	paused  bool
+	targets []Target
+	active  map[string]int
+	stats   map[string]TargetStats
+}
+
+// addrs returns every backend that has counters or open connections, sorted.
+func (a *appMetrics) addrs() []string {
+	seen := make(map[string]bool)
+	for addr := range a.stats {
+		seen[addr] = true
+	}
+	for addr := range a.active {
+		seen[addr] = true
+	}
+	for _, t := range a.targets {
+		seen[t.Addr] = true
+	}
+	addrs := make([]string, 0, len(seen))
+	for addr := range seen {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (a *appMetrics) weight(addr string) int {
+	for _, t := range a.targets {
+		if t.Addr == addr {
+			return t.Weight
+		}
+	}
+	return 0
+}
+
+// writeMetrics writes the counters of managers in the Prometheus text exposition format.
+func writeMetrics(w io.Writer, managers []*Manager) {
+	apps := make([]*appMetrics, 0, len(managers))
+	for _, m := range managers {
+		apps = append(apps, &appMetrics{
+			app:     m.metricsName(),
+			paused:  m.proxy.Paused(),
+			targets: m.proxy.Targets(),
+			active:  m.proxy.ActiveConnections(),
+			stats:   m.proxy.Stats(),
+		})
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].app < apps[j].app })
+
+	perTarget := []struct {
+		name, kind, help string
+		value            func(a *appMetrics, addr string) int64
+	}{
+		{"revlay_proxy_connections_total", "counter", "Connections (tcp mode) or requests (http mode) forwarded to the target.",
+			func(a *appMetrics, addr string) int64 { return a.stats[addr].Requests }},
+		{"revlay_proxy_active_connections", "gauge", "Connections (tcp mode) or requests (http mode) currently open to the target.",
+			func(a *appMetrics, addr string) int64 { return int64(a.active[addr]) }},
+		{"revlay_proxy_errors_total", "counter", "Failed dials, and in http mode 5xx responses, of the target.",
+			func(a *appMetrics, addr string) int64 { return a.stats[addr].Errors }},
+		{"revlay_proxy_dial_failures_total", "counter", "Connections to the target that could not be established.",
+			func(a *appMetrics, addr string) int64 { return a.stats[addr].DialFailures }},
+		{"revlay_proxy_received_bytes_total", "counter", "Bytes received from clients and forwarded to the target.",
+			func(a *appMetrics, addr string) int64 { return a.stats[addr].BytesIn }},
+		{"revlay_proxy_sent_bytes_total", "counter", "Bytes received from the target and sent to clients.",
+			func(a *appMetrics, addr string) int64 { return a.stats[addr].BytesOut }},
+		{"revlay_proxy_switches_total", "counter", "Times the target started receiving new traffic.",
+			func(a *appMetrics, addr string) int64 { return a.stats[addr].Switches }},
+		{"revlay_proxy_target_weight", "gauge", "Share of new traffic sent to the target, 0 when it receives none.",
+			func(a *appMetrics, addr string) int64 { return int64(a.weight(addr)) }},
+	}
+
+	for _, metric := range perTarget {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, a := range apps {
+			for _, addr := range a.addrs() {
+				fmt.Fprintf(w, "%s{app=%s,target=%s} %d\n", metric.name, quoteLabel(a.app), quoteLabel(addr), metric.value(a, addr))
+			}
+		}
+	}
+
+	fmt.Fprint(w, "# HELP revlay_proxy_paused Whether the proxy is holding new connections.\n# TYPE revlay_proxy_paused gauge\n")
+	for _, a := range apps {
+		paused := 0
+		if a.paused {
+			paused = 1
+		}
+		fmt.Fprintf(w, "revlay_proxy_paused{app=%s} %d\n", quoteLabel(a.app), paused)
+	}
+}
+
+// quoteLabel quotes a label value as required by the exposition format.
+func quoteLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return `"` + v + `"`
+}
+
+// metricsName is the app label of the manager's metrics.
+func (m *Manager) metricsName() string {
+	if m.opts.Name != "" {
+		return m.opts.Name
+	}
+	return m.listenAddr
+}
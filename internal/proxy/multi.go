@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/xukonxe/revlay/internal/color"
+)
+
+// AppSpec describes how one app is fronted by a MultiManager.
+type AppSpec struct {
+	ListenPort  int
+	InitialPort int
+	StateFile   string
+	Options     Options
+}
+
+// AppLoader returns the apps that should currently be proxied, keyed by service ID.
+type AppLoader func() (map[string]AppSpec, error)
+
+// MultiManager runs one proxy per registered app in a single process and
+// reconciles them whenever the services file changes.
+type MultiManager struct {
+	load      AppLoader
+	watchFile string
+	// shutdownTimeout is how long apps stopped by a reload may finish open connections.
+	shutdownTimeout time.Duration
+
+	mu      sync.Mutex
+	apps    map[string]*runningApp
+	routers map[int]*hostRouter
+
+	ready    chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type runningApp struct {
+	spec    AppSpec
+	manager *Manager
+}
+
+// NewMultiManager creates a manager that fronts every app returned by load,
+// reloading them whenever watchFile changes. Apps that a reload removes or
+// changes may finish open connections for up to shutdownTimeout.
+func NewMultiManager(load AppLoader, watchFile string, shutdownTimeout time.Duration) *MultiManager {
+	return &MultiManager{
+		load:            load,
+		watchFile:       watchFile,
+		shutdownTimeout: shutdownTimeout,
+		apps:            make(map[string]*runningApp),
+		routers:         make(map[int]*hostRouter),
+		ready:           make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+}
+
+// Ready is closed once every app loaded at start serves its listeners, or failed to.
+func (mm *MultiManager) Ready() <-chan struct{} {
+	return mm.ready
+}
+
+// Shutdown makes Start return after shutting down every app, letting open
+// connections finish for up to timeout.
+func (mm *MultiManager) Shutdown(timeout time.Duration) {
+	mm.stopOnce.Do(func() { close(mm.done) })
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	var wg sync.WaitGroup
+	for id, app := range mm.apps {
+		wg.Add(1)
+		go func(manager *Manager) {
+			defer wg.Done()
+			manager.Shutdown(timeout)
+		}(app.manager)
+		delete(mm.apps, id)
+	}
+	wg.Wait()
+}
+
+// Start starts all apps and blocks, hot-reloading apps as the services file changes.
+func (mm *MultiManager) Start() error {
+	if err := mm.Reload(); err != nil {
+		return err
+	}
+	go mm.waitReady()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	watchDir := filepath.Dir(mm.watchFile)
+	if err := watcher.Add(watchDir); err != nil {
+		return fmt.Errorf("failed to watch services directory '%s': %w", watchDir, err)
+	}
+
+	// Saving the services file can produce several events, reload once they settle.
+	var reload <-chan time.Time
+	for {
+		select {
+		case <-mm.done:
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Name == mm.watchFile && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				reload = time.After(200 * time.Millisecond)
+			}
+		case <-reload:
+			log.Println(color.Cyan("Services file changed, reloading apps..."))
+			if err := mm.Reload(); err != nil {
+				log.Print(color.Red(fmt.Sprintf("Failed to reload apps: %v", err)))
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Print(color.Red(fmt.Sprintf("File watcher error: %v", err)))
+		}
+	}
+}
+
+// waitReady closes ready once every running app is ready or has stopped.
+func (mm *MultiManager) waitReady() {
+	mm.mu.Lock()
+	managers := make([]*Manager, 0, len(mm.apps))
+	for _, app := range mm.apps {
+		managers = append(managers, app.manager)
+	}
+	mm.mu.Unlock()
+
+	for _, m := range managers {
+		select {
+		case <-m.ready:
+		case <-m.exited:
+		}
+	}
+	close(mm.ready)
+}
+
+// Reload loads the current app list and starts, stops or restarts proxies to match it.
+func (mm *MultiManager) Reload() error {
+	specs, err := mm.load()
+	if err != nil {
+		return err
+	}
+
+	mm.mu.Lock()
+	var stopping []*Manager
+	for id, app := range mm.apps {
+		if spec, ok := specs[id]; !ok || !reflect.DeepEqual(spec, app.spec) {
+			log.Print(color.Yellow(fmt.Sprintf("[%s] Stopping proxy on :%d", id, app.spec.ListenPort)))
+			stopping = append(stopping, app.manager)
+			delete(mm.apps, id)
+		}
+	}
+	mm.mu.Unlock()
+
+	// Let open connections finish like on shutdown, before a changed app binds its listener again.
+	// Not under mu, since the manager's Start goroutine takes it when it returns.
+	var wg sync.WaitGroup
+	for _, manager := range stopping {
+		wg.Add(1)
+		go func(manager *Manager) {
+			defer wg.Done()
+			manager.Shutdown(mm.shutdownTimeout)
+		}(manager)
+	}
+	wg.Wait()
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	ids := make([]string, 0, len(specs))
+	for id := range specs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if _, ok := mm.apps[id]; ok {
+			continue
+		}
+		spec := specs[id]
+		if err := mm.checkPortConflict(id, spec); err != nil {
+			log.Print(color.Red(fmt.Sprintf("[%s] Skipping app: %v", id, err)))
+			continue
+		}
+		manager := NewManagerWithOptions(spec.ListenPort, spec.InitialPort, spec.StateFile, spec.Options)
+		if manager.opts.Mode == ModeHTTP {
+			manager.router = mm.router(spec.ListenPort)
+		}
+		mm.apps[id] = &runningApp{spec: spec, manager: manager}
+
+		log.Print(color.Cyan(fmt.Sprintf("[%s] Starting proxy on :%d", id, spec.ListenPort)))
+		go func(id string, manager *Manager) {
+			if err := manager.Start(); err != nil {
+				log.Print(color.Red(fmt.Sprintf("[%s] Proxy stopped: %v", id, err)))
+			}
+			// Forget the app unless a reload already replaced it, so the next reload starts it again,
+			// e.g. once its listen port is free.
+			mm.mu.Lock()
+			if app, ok := mm.apps[id]; ok && app.manager == manager {
+				delete(mm.apps, id)
+			}
+			mm.mu.Unlock()
+		}(id, manager)
+	}
+	return nil
+}
+
+// checkPortConflict verifies that an app can share its listen port with the apps already running.
+// Only http mode apps can share a port, since requests are routed by their Host header.
+func (mm *MultiManager) checkPortConflict(id string, spec AppSpec) error {
+	for otherID, other := range mm.apps {
+		if other.spec.ListenPort != spec.ListenPort {
+			continue
+		}
+		if spec.Options.Mode != ModeHTTP || other.spec.Options.Mode != ModeHTTP {
+			return fmt.Errorf("proxy_port %d is already used by '%s', only http mode apps can share a port", spec.ListenPort, otherID)
+		}
+		if (len(spec.Options.Certificates) > 0) != (len(other.spec.Options.Certificates) > 0) {
+			return fmt.Errorf("proxy_port %d is shared with '%s', either both or neither must configure TLS", spec.ListenPort, otherID)
+		}
+		if len(spec.Options.Hosts) == 0 && len(other.spec.Options.Hosts) == 0 {
+			return fmt.Errorf("proxy_port %d is shared with '%s', set proxy.hosts on at least one of them", spec.ListenPort, otherID)
+		}
+	}
+	return nil
+}
+
+// router returns the shared HTTP listener for a port, creating it on first use.
+func (mm *MultiManager) router(port int) *hostRouter {
+	if r, ok := mm.routers[port]; ok {
+		return r
+	}
+	r := newHostRouter(fmt.Sprintf(":%d", port))
+	mm.routers[port] = r
+	return r
+}
+
+// hostRouter owns a listener shared by several HTTP proxies and routes
+// each request to the proxy whose hosts match the request's Host header.
+type hostRouter struct {
+	listenAddr string
+
+	mu      sync.RWMutex
+	proxies []*HTTPProxy
+	certs   map[*HTTPProxy]*certStore
+	server  *http.Server
+}
+
+func newHostRouter(listenAddr string) *hostRouter {
+	return &hostRouter{listenAddr: listenAddr, certs: make(map[*HTTPProxy]*certStore)}
+}
+
+// add registers a proxy, starting the listener when the first one arrives.
+// If the proxy has certificates the listener terminates TLS, selecting the
+// certificate by SNI across all registered apps.
+func (r *hostRouter) add(p *HTTPProxy, certs *certStore) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.server == nil {
+		listener, err := listen("tcp", r.listenAddr)
+		if err != nil {
+			return err
+		}
+		if certs != nil {
+			listener = tls.NewListener(listener, tlsConfig(r.certStores))
+		}
+		r.server = &http.Server{Handler: r, ReadHeaderTimeout: 10 * time.Second}
+		go func(server *http.Server) {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Print(color.Red(fmt.Sprintf("Shared listener on %s stopped serving: %v", r.listenAddr, err)))
+			}
+		}(r.server)
+	}
+	r.proxies = append(r.proxies, p)
+	if certs != nil {
+		r.certs[p] = certs
+	}
+	return nil
+}
+
+// certStores returns the certificates of all registered apps.
+func (r *hostRouter) certStores() []*certStore {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	stores := make([]*certStore, 0, len(r.proxies))
+	for _, p := range r.proxies {
+		if s, ok := r.certs[p]; ok {
+			stores = append(stores, s)
+		}
+	}
+	return stores
+}
+
+// remove unregisters a proxy. When the last one leaves the listener is shut
+// down, letting in-flight requests finish until ctx is done.
+func (r *hostRouter) remove(ctx context.Context, p *HTTPProxy) {
+	r.mu.Lock()
+	for i, existing := range r.proxies {
+		if existing == p {
+			r.proxies = append(r.proxies[:i], r.proxies[i+1:]...)
+			delete(r.certs, p)
+			break
+		}
+	}
+	var server *http.Server
+	if len(r.proxies) == 0 {
+		server, r.server = r.server, nil
+	}
+	r.mu.Unlock()
+
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+	}
+}
+
+// match returns the proxy for a Host header. Proxies with explicit hosts win over catch-all ones.
+func (r *hostRouter) match(host string) *HTTPProxy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var fallback *HTTPProxy
+	for _, p := range r.proxies {
+		if len(p.hosts) == 0 {
+			if fallback == nil {
+				fallback = p
+			}
+			continue
+		}
+		if p.MatchesHost(host) {
+			return p
+		}
+	}
+	return fallback
+}
+
+func (r *hostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p := r.match(req.Host)
+	if p == nil {
+		writeErrorPage(w, http.StatusMisdirectedRequest, fmt.Sprintf("No application is configured for host %q.", stripPort(req.Host)))
+		return
+	}
+	p.ServeHTTP(w, req)
+}
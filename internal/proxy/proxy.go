@@ -1,6 +1,9 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,25 +19,136 @@ import (
 	"github.com/xukonxe/revlay/internal/color"
 )
 
+// Mode selects how the proxy handles traffic.
+type Mode string
+
+const (
+	// ModeTCP splices raw TCP streams, suitable for any protocol.
+	ModeTCP Mode = "tcp"
+	// ModeHTTP parses HTTP requests and acts as a reverse proxy.
+	ModeHTTP Mode = "http"
+)
+
+// Options holds the optional settings of a proxy manager.
+type Options struct {
+	// Mode is the proxy mode, defaults to ModeTCP.
+	Mode Mode
+	// AccessLog is the access log path for ModeHTTP. Empty logs to stdout.
+	AccessLog string
+	// Hosts restricts ModeHTTP to the given Host names. Empty accepts any host.
+	Hosts []string
+	// RetryWindow holds new connections for up to this long while the backend
+	// cannot be dialed, e.g. during a restart, instead of failing them at once.
+	RetryWindow time.Duration
+	// Health enables active health checking of the backend and automatic failover. Nil disables it.
+	Health *HealthOptions
+	// Name identifies the app in metrics. Defaults to the listen address.
+	Name string
+	// MetricsAddr serves Prometheus metrics on http://MetricsAddr/metrics. Empty disables it.
+	// Apps with the same MetricsAddr in one process share the listener.
+	MetricsAddr string
+	// Certificates enables TLS termination. The certificate is selected by SNI
+	// and reloaded whenever its files change.
+	Certificates []CertificateFiles
+}
+
+// Proxy forwards traffic from a listener to a switchable target address.
+type Proxy interface {
+	// Serve starts accepting connections from listener in the background.
+	Serve(listener net.Listener)
+	SwitchTarget(newTargetAddr string)
+	// SetTargets splits new connections between several weighted targets.
+	SetTargets(targets []Target) error
+	// Targets returns the targets new connections are split between.
+	Targets() []Target
+	// TargetAddr returns the address that receives the largest share of new connections.
+	TargetAddr() string
+	// ActiveConnections returns the number of open connections per backend address.
+	ActiveConnections() map[string]int
+	// Stats returns the number of connections or requests and errors per backend address.
+	Stats() map[string]TargetStats
+	// Pause holds new connections until Resume is called.
+	Pause()
+	// Resume releases held connections.
+	Resume()
+	// Paused reports whether the proxy is holding new connections.
+	Paused() bool
+	// Close stops accepting new connections. Open connections run to completion.
+	Close() error
+	// Shutdown stops accepting new connections and waits for open ones to finish.
+	// Whatever is still open when ctx is done gets closed.
+	Shutdown(ctx context.Context) error
+
+	// changes signals whenever the active connection counts change.
+	changes() <-chan struct{}
+}
+
 // Manager handles the lifecycle of the proxy and watches for changes.
 type Manager struct {
 	listenAddr  string
 	stateFile   string
-	proxy       *TCPProxy
+	proxy       Proxy
 	initialPort int
+	opts        Options
+	// router is set when the manager shares its listener with other apps.
+	router   *hostRouter
+	certs    *certStore
+	ready    chan struct{}
+	done     chan struct{}
+	exited   chan struct{}
+	stopOnce sync.Once
+	// shutdownTimeout is how long Shutdown lets open connections finish.
+	shutdownTimeout time.Duration
 }
 
-// NewManager creates a new proxy manager.
+// NewManager creates a new proxy manager running in TCP mode.
 func NewManager(listenPort, initialPort int, stateFile string) *Manager {
+	return NewManagerWithOptions(listenPort, initialPort, stateFile, Options{})
+}
+
+// NewManagerWithOptions creates a new proxy manager with the given options.
+func NewManagerWithOptions(listenPort, initialPort int, stateFile string, opts Options) *Manager {
+	if opts.Mode == "" {
+		opts.Mode = ModeTCP
+	}
 	return &Manager{
 		listenAddr:  fmt.Sprintf(":%d", listenPort),
 		stateFile:   stateFile,
 		initialPort: initialPort,
+		opts:        opts,
+		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
+		exited:      make(chan struct{}),
 	}
 }
 
+// Ready is closed once the proxy serves all of its listeners.
+func (m *Manager) Ready() <-chan struct{} {
+	return m.ready
+}
+
+// Stop makes a running Start return and waits until the proxy has stopped
+// accepting new connections.
+func (m *Manager) Stop() {
+	m.stopOnce.Do(func() { close(m.done) })
+	<-m.exited
+}
+
+// Shutdown is like Stop, but also waits up to timeout for open connections to
+// finish before closing them.
+func (m *Manager) Shutdown(timeout time.Duration) {
+	m.stopOnce.Do(func() {
+		m.shutdownTimeout = timeout
+		close(m.done)
+	})
+	<-m.exited
+}
+
 // Start runs the proxy and begins watching the state file for changes.
+// It blocks until Stop is called or the proxy fails.
 func (m *Manager) Start() error {
+	defer close(m.exited)
+
 	// Ensure state directory exists
 	if err := os.MkdirAll(filepath.Dir(m.stateFile), 0755); err != nil {
 		return fmt.Errorf("could not create state directory: %w", err)
@@ -51,15 +165,143 @@ func (m *Manager) Start() error {
 		}
 	}
 
-	m.proxy = NewTCPProxy(fmt.Sprintf("127.0.0.1:%d", targetPort))
-	if err := m.proxy.Start(m.listenAddr); err != nil {
-		return fmt.Errorf("could not start proxy: %w", err)
+	if len(m.opts.Certificates) > 0 {
+		if m.certs, err = newCertStore(m.opts.Certificates); err != nil {
+			return err
+		}
 	}
-	log.Print(color.Green(fmt.Sprintf("Proxy listening on %s, forwarding to 127.0.0.1:%d", m.listenAddr, targetPort)))
 
+	m.proxy, err = m.newProxy(localAddr(targetPort))
+	if err != nil {
+		return err
+	}
+	if m.router != nil {
+		httpProxy, ok := m.proxy.(*HTTPProxy)
+		if !ok {
+			return fmt.Errorf("only http mode proxies can share %s", m.listenAddr)
+		}
+		if err := m.router.add(httpProxy, m.certs); err != nil {
+			return fmt.Errorf("could not start proxy: %w", err)
+		}
+	} else {
+		listener, err := listen("tcp", m.listenAddr)
+		if err != nil {
+			return fmt.Errorf("could not start proxy: %w", err)
+		}
+		if m.certs != nil {
+			listener = tls.NewListener(listener, tlsConfig(func() []*certStore { return []*certStore{m.certs} }))
+		}
+		m.proxy.Serve(listener)
+	}
+	defer m.closeProxy()
+	scheme := "plain"
+	if m.certs != nil {
+		scheme = "TLS"
+	}
+	log.Print(color.Green(fmt.Sprintf("Proxy listening on %s (%s mode, %s), forwarding to 127.0.0.1:%d", m.listenAddr, m.opts.Mode, scheme, targetPort)))
+
+	if m.opts.MetricsAddr != "" {
+		if err := registerMetrics(m.opts.MetricsAddr, m); err != nil {
+			return err
+		}
+		defer unregisterMetrics(m.opts.MetricsAddr, m)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go m.publishDrainState(stop)
+	if m.opts.Health != nil && m.opts.Health.Interval > 0 {
+		go m.monitorHealth(stop)
+	}
+
+	control, err := m.startControlServer()
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	close(m.ready)
 	return m.watchStateFile()
 }
 
+// closeProxy stops accepting new connections. After Shutdown it also lets
+// open connections finish, for at most the shutdown timeout.
+func (m *Manager) closeProxy() {
+	if m.shutdownTimeout <= 0 && m.router == nil {
+		m.proxy.Close()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.shutdownTimeout)
+	defer cancel()
+	if m.shutdownTimeout > 0 {
+		log.Print(color.Yellow(fmt.Sprintf("Proxy on %s shutting down, waiting up to %s for open connections...", m.listenAddr, m.shutdownTimeout)))
+	}
+
+	var err error
+	if m.router != nil {
+		// Other apps may still use the shared listener, only wait for our own requests.
+		m.router.remove(ctx, m.proxy.(*HTTPProxy))
+		err = waitIdle(ctx, m.proxy)
+	} else {
+		err = m.proxy.Shutdown(ctx)
+	}
+	if err != nil && m.shutdownTimeout > 0 {
+		log.Print(color.Yellow(fmt.Sprintf("Proxy on %s closed connections that were still open after %s.", m.listenAddr, m.shutdownTimeout)))
+	}
+}
+
+// waitIdle waits until p has no open connections or ctx is done.
+func waitIdle(ctx context.Context, p Proxy) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if len(p.ActiveConnections()) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// newProxy creates the proxy implementation for the configured mode.
+func (m *Manager) newProxy(initialTarget string) (Proxy, error) {
+	switch m.opts.Mode {
+	case ModeTCP:
+		p := NewTCPProxy(initialTarget)
+		p.SetRetryWindow(m.opts.RetryWindow)
+		return p, nil
+	case ModeHTTP:
+		accessLog, err := openAccessLog(m.opts.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+		p := NewHTTPProxy(initialTarget, m.opts.Hosts, accessLog)
+		p.SetRetryWindow(m.opts.RetryWindow)
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unknown proxy mode '%s'", m.opts.Mode)
+	}
+}
+
+// openAccessLog opens the access log for appending, or logs to stdout if path is empty.
+func openAccessLog(path string) (*log.Logger, error) {
+	if path == "" {
+		return log.New(os.Stdout, "", 0), nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("could not create access log directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open access log: %w", err)
+	}
+	return log.New(f, "", 0), nil
+}
+
 func (m *Manager) watchStateFile() error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -73,12 +315,33 @@ func (m *Manager) watchStateFile() error {
 		return fmt.Errorf("failed to watch state directory '%s': %w", watchDir, err)
 	}
 
+	// Watch the certificate directories too, renewals usually replace files
+	// or symlinks there rather than writing them in place.
+	if m.certs != nil {
+		for _, dir := range m.certs.dirs() {
+			if err := watcher.Add(dir); err != nil {
+				return fmt.Errorf("failed to watch certificate directory '%s': %w", dir, err)
+			}
+		}
+	}
+	var reloadCerts <-chan time.Time
+
 	for {
 		select {
+		case <-m.done:
+			return nil
+		case <-reloadCerts:
+			reloadCerts = nil
+			m.reloadCertificates()
 		case event, ok := <-watcher.Events:
 			if !ok {
 				return nil
 			}
+			// Certificate and key are usually written one after the other, reload once both settled.
+			if m.certs != nil && m.certs.watches(event.Name) {
+				reloadCerts = time.After(500 * time.Millisecond)
+				continue
+			}
 			// We only care about writes to our specific state file
 			if event.Name == m.stateFile && (event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create) {
 				log.Println(color.Cyan("State file changed, attempting to switch proxy target..."))
@@ -87,7 +350,7 @@ func (m *Manager) watchStateFile() error {
 					log.Print(color.Red(fmt.Sprintf("Error reading state file on change: %v", err)))
 					continue
 				}
-				m.proxy.SwitchTarget(fmt.Sprintf("127.0.0.1:%d", newPort))
+				m.proxy.SwitchTarget(localAddr(newPort))
 			}
 		case err, ok := <-watcher.Errors:
 			if !ok {
@@ -116,81 +379,225 @@ func (m *Manager) writeStateFile(port int) error {
 
 // TCPProxy is a thread-safe TCP proxy.
 type TCPProxy struct {
-	listener   net.Listener
-	targetAddr string
-	mu         sync.RWMutex
+	listener    net.Listener
+	targets     *targetSet
+	tracker     *connTracker
+	gate        gate
+	retryWindow time.Duration
+
+	// conns holds both sides of every open connection, so Shutdown can close them.
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
 }
 
 // NewTCPProxy creates a new TCPProxy.
 func NewTCPProxy(initialTarget string) *TCPProxy {
 	return &TCPProxy{
-		targetAddr: initialTarget,
+		targets: newTargetSet(initialTarget),
+		tracker: newConnTracker(),
+		conns:   make(map[net.Conn]struct{}),
 	}
 }
 
 // Start initializes the proxy listener and starts accepting connections.
 func (p *TCPProxy) Start(listenAddr string) error {
-	var err error
-	p.listener, err = net.Listen("tcp", listenAddr)
+	listener, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return err
 	}
-	go p.acceptLoop()
+	p.Serve(listener)
 	return nil
 }
 
+// Serve starts accepting connections from listener in the background.
+func (p *TCPProxy) Serve(listener net.Listener) {
+	p.listener = listener
+	go p.acceptLoop()
+}
+
 func (p *TCPProxy) acceptLoop() {
+	var backoff time.Duration
 	for {
 		conn, err := p.listener.Accept()
 		if err != nil {
-			// TODO: Better error handling for closed listeners.
-			log.Print(color.Red(fmt.Sprintf("Failed to accept connection: %v", err)))
-			time.Sleep(1 * time.Second)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Errors such as running out of file descriptors clear up by themselves,
+			// back off so we do not spin while they last.
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			log.Print(color.Red(fmt.Sprintf("Failed to accept connection, retrying in %s: %v", backoff, err)))
+			time.Sleep(backoff)
 			continue
 		}
+		backoff = 0
 		go p.handleConnection(conn)
 	}
 }
 
-// SwitchTarget safely changes the proxy's target address.
+// SetRetryWindow makes new connections wait for up to window while the target
+// cannot be dialed. Every attempt dials the current target, so connections held
+// during a switch go to the new backend. Zero fails connections at once.
+func (p *TCPProxy) SetRetryWindow(window time.Duration) {
+	p.retryWindow = window
+}
+
+// SwitchTarget safely sends all new connections to a single target address.
 func (p *TCPProxy) SwitchTarget(newTargetAddr string) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	if p.targetAddr != newTargetAddr {
-		log.Print(color.Green(fmt.Sprintf("Proxy switching target from %s to %s", p.targetAddr, newTargetAddr)))
-		p.targetAddr = newTargetAddr
+	old := p.targets.list()
+	if p.targets.set([]Target{{Addr: newTargetAddr, Weight: 100}}) {
+		log.Print(color.Green(fmt.Sprintf("Proxy switching target from %s to %s", describeTargets(old), newTargetAddr)))
+		recordSwitches(p.tracker, old, p.targets.list())
+	}
+}
+
+// SetTargets splits new connections between several targets according to their weights.
+func (p *TCPProxy) SetTargets(targets []Target) error {
+	if err := validateTargets(targets); err != nil {
+		return err
+	}
+	old := p.targets.list()
+	if p.targets.set(targets) {
+		log.Print(color.Green(fmt.Sprintf("Proxy splitting traffic: %s", describeTargets(p.targets.list()))))
+		recordSwitches(p.tracker, old, p.targets.list())
+	}
+	return nil
+}
+
+// Targets returns the targets new connections are split between.
+func (p *TCPProxy) Targets() []Target {
+	return p.targets.list()
+}
+
+// TargetAddr returns the address that receives the largest share of new connections.
+func (p *TCPProxy) TargetAddr() string {
+	return p.targets.primary()
+}
+
+// ActiveConnections returns the number of open connections per backend address.
+// Connections keep counting against the backend they were opened to, even after
+// SwitchTarget, until either side closes them.
+func (p *TCPProxy) ActiveConnections() map[string]int {
+	return p.tracker.snapshot()
+}
+
+// Stats returns how many connections each backend received and how many dials failed.
+func (p *TCPProxy) Stats() map[string]TargetStats {
+	return p.tracker.statsSnapshot()
+}
+
+func (p *TCPProxy) changes() <-chan struct{} {
+	return p.tracker.changed
+}
+
+// Close stops accepting new connections. Open connections run to completion.
+func (p *TCPProxy) Close() error {
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Close()
+}
+
+// Shutdown stops accepting new connections and waits for open ones to finish.
+// Connections still open when ctx is done are closed.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.Close()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		p.connsMu.Lock()
+		open := len(p.conns)
+		p.connsMu.Unlock()
+		if open == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			p.connsMu.Lock()
+			for conn := range p.conns {
+				conn.Close()
+			}
+			p.connsMu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *TCPProxy) trackConn(conn net.Conn, open bool) {
+	p.connsMu.Lock()
+	defer p.connsMu.Unlock()
+	if open {
+		p.conns[conn] = struct{}{}
+	} else {
+		delete(p.conns, conn)
 	}
 }
 
-func (p *TCPProxy) getTargetAddr() string {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
-	return p.targetAddr
+// Pause holds new connections until Resume is called. Open connections are not affected.
+func (p *TCPProxy) Pause() {
+	p.gate.pause()
+}
+
+// Resume releases held connections.
+func (p *TCPProxy) Resume() {
+	p.gate.unpause()
+}
+
+// Paused reports whether the proxy is holding new connections.
+func (p *TCPProxy) Paused() bool {
+	return p.gate.paused()
 }
 
 func (p *TCPProxy) handleConnection(conn net.Conn) {
 	defer conn.Close()
-	targetAddr := p.getTargetAddr()
+	p.trackConn(conn, true)
+	defer p.trackConn(conn, false)
+	p.gate.wait(nil)
 
-	dialer := net.Dialer{Timeout: 5 * time.Second}
-	targetConn, err := dialer.Dial("tcp", targetAddr)
+	targetConn, targetAddr, err := dialWithRetry(context.Background(), p.targets.pick, p.retryWindow)
+	p.tracker.count(targetAddr, err != nil)
 	if err != nil {
+		p.tracker.dialFailed(targetAddr)
 		log.Print(color.Red(fmt.Sprintf("Failed to connect to target %s: %v", targetAddr, err)))
 		return
 	}
 	defer targetConn.Close()
+	p.trackConn(targetConn, true)
+	defer p.trackConn(targetConn, false)
+
+	p.tracker.add(targetAddr)
+	defer p.tracker.done(targetAddr)
 
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 
+	var in, out int64
 	go func() {
 		defer wg.Done()
-		io.Copy(targetConn, conn)
+		in, _ = io.Copy(targetConn, conn)
+		closeWrite(targetConn)
 	}()
 	go func() {
 		defer wg.Done()
-		io.Copy(conn, targetConn)
+		out, _ = io.Copy(conn, targetConn)
+		closeWrite(conn)
 	}()
 
 	wg.Wait()
+	p.tracker.transferred(targetAddr, in, out)
+}
+
+// closeWrite half-closes a connection so the peer sees EOF once one direction
+// is finished, while data can still flow the other way.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
 }
@@ -1,8 +1,18 @@
 package proxy
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -19,15 +29,16 @@ import (
 
 // createMockBackend creates a simple HTTP test server that replies with its port.
 func createMockBackend(t *testing.T) (*httptest.Server, int) {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// The address is 127.0.0.1:PORT, we extract the port
-		port := strings.Split(r.Host, ":")[1]
-		fmt.Fprint(w, port)
-	}))
+	server := httptest.NewUnstartedServer(nil)
 
-	// Get the port
+	// Get the port. The Host header carries the proxy's address, so reply with
+	// the listener's own port instead.
 	addr, ok := server.Listener.Addr().(*net.TCPAddr)
 	require.True(t, ok)
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, addr.Port)
+	})
+	server.Start()
 
 	return server, addr.Port
 }
@@ -95,8 +106,12 @@ func TestManager_Switching(t *testing.T) {
 	// Give the manager a moment to start up
 	time.Sleep(200 * time.Millisecond)
 
+	// Connections that are already open stay on their backend after a switch
+	// until they drain, so every request uses a fresh connection.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
 	// --- Test 1: Forwarding to initial backend ---
-	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d", proxyListenPort))
+	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d", proxyListenPort))
 	require.NoError(t, err)
 	body, err := io.ReadAll(resp.Body)
 	require.NoError(t, err)
@@ -111,10 +126,908 @@ func TestManager_Switching(t *testing.T) {
 	time.Sleep(200 * time.Millisecond)
 
 	// --- Test 3: Forwarding to the new backend ---
-	resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d", proxyListenPort))
+	resp, err = client.Get(fmt.Sprintf("http://127.0.0.1:%d", proxyListenPort))
 	require.NoError(t, err)
 	body, err = io.ReadAll(resp.Body)
 	require.NoError(t, err)
 	resp.Body.Close()
 	assert.Equal(t, strconv.Itoa(port2), string(body), "Should proxy to backend 2 after switch")
 }
+
+func TestHTTPProxy_ForwardedHeadersAndAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", r.Host, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer backend.Close()
+
+	var accessLog strings.Builder
+	proxy := NewHTTPProxy(backend.Listener.Addr().String(), nil, log.New(&accessLog, "", 0))
+	require.NoError(t, proxy.Start("127.0.0.1:0"))
+	defer proxy.listener.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+proxy.listener.Addr().String()+"/hello", nil)
+	require.NoError(t, err)
+	req.Host = "app.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "app.example.com|127.0.0.1|http", string(body))
+	assert.Contains(t, accessLog.String(), `"GET /hello HTTP/1.1" 200`)
+	assert.Contains(t, accessLog.String(), backend.Listener.Addr().String())
+}
+
+func TestHTTPProxy_BackendDown(t *testing.T) {
+	// Reserve a port and release it so that nothing is listening on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	proxy := NewHTTPProxy(deadAddr, nil, nil)
+	require.NoError(t, proxy.Start("127.0.0.1:0"))
+	defer proxy.listener.Close()
+
+	resp, err := http.Get("http://" + proxy.listener.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestHTTPProxy_HostMatching(t *testing.T) {
+	proxy := NewHTTPProxy("127.0.0.1:1", []string{"Example.com", "*.apps.example.com"}, nil)
+
+	assert.True(t, proxy.MatchesHost("example.com"))
+	assert.True(t, proxy.MatchesHost("example.com:8080"))
+	assert.True(t, proxy.MatchesHost("api.apps.example.com"))
+	assert.False(t, proxy.MatchesHost("a.b.apps.example.com"))
+	assert.False(t, proxy.MatchesHost("other.com"))
+}
+
+func TestTCPProxy_TracksConnectionsPerBackend(t *testing.T) {
+	// An echo backend keeps the connection open until the client closes it.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	oldAddr := backend.Addr().String()
+
+	proxy := NewTCPProxy(oldAddr)
+	require.NoError(t, proxy.Start("127.0.0.1:0"))
+	defer proxy.listener.Close()
+
+	conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+
+	// The connection keeps counting against the old backend after a switch.
+	proxy.SwitchTarget("127.0.0.1:1")
+	assert.Equal(t, map[string]int{oldAddr: 1}, proxy.ActiveConnections())
+
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return len(proxy.ActiveConnections()) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestDrainState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), DrainStateFileName)
+	require.NoError(t, writeDrainState(path, &DrainState{
+		Target:    "127.0.0.1:8081",
+		Active:    map[string]int{"127.0.0.1:8080": 3},
+		UpdatedAt: time.Now(),
+	}))
+
+	state, err := ReadDrainState(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, state.ActiveOn(8080))
+	assert.Equal(t, 0, state.ActiveOn(8081))
+	assert.False(t, state.Stale())
+
+	state.UpdatedAt = time.Now().Add(-time.Hour)
+	assert.True(t, state.Stale())
+}
+
+func TestManager_ControlSocket(t *testing.T) {
+	backend1, port1 := createMockBackend(t)
+	defer backend1.Close()
+	backend2, port2 := createMockBackend(t)
+	defer backend2.Close()
+
+	stateFile := filepath.Join(t.TempDir(), "active_port")
+	manager := NewManager(8998, port1, stateFile)
+	go manager.Start()
+
+	client := NewControlClient(filepath.Join(filepath.Dir(stateFile), ControlSocketName))
+	require.Eventually(t, func() bool {
+		_, err := client.Status()
+		return err == nil
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// Switching is acknowledged with the new target and persisted to the state file.
+	status, err := client.Switch(port2)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", port2), status.Target)
+	state, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(port2), string(state))
+
+	// Nothing is connected to the old backend, so draining it finishes at once.
+	_, err = client.Drain(port1, time.Second)
+	assert.NoError(t, err)
+
+	status, err = client.Pause()
+	require.NoError(t, err)
+	assert.True(t, status.Paused)
+	status, err = client.Resume()
+	require.NoError(t, err)
+	assert.False(t, status.Paused)
+
+	_, err = client.Switch(0)
+	assert.Error(t, err)
+}
+
+func TestControlClient_DrainTimeout(t *testing.T) {
+	// A backend that keeps its connections open until the client closes them.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	backendPort := backend.Addr().(*net.TCPAddr).Port
+
+	listenPort := freePort(t)
+	stateFile := filepath.Join(t.TempDir(), "active_port")
+	manager := NewManager(listenPort, backendPort, stateFile)
+	go manager.Start()
+	defer manager.Stop()
+	<-manager.Ready()
+
+	conn, err := net.Dial("tcp", localAddr(listenPort))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return len(manager.proxy.ActiveConnections()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// A timeout below a second is waited for, not truncated to nothing.
+	client := NewControlClient(filepath.Join(filepath.Dir(stateFile), ControlSocketName))
+	start := time.Now()
+	_, err = client.Drain(backendPort, 300*time.Millisecond)
+	assert.Error(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestControlClient_ProxyNotRunning(t *testing.T) {
+	client := NewControlClient(filepath.Join(t.TempDir(), ControlSocketName))
+	_, err := client.Status()
+	assert.ErrorIs(t, err, ErrProxyNotRunning)
+}
+
+// freePort returns a local port that nothing is listening on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestMultiManager_RoutesAndReloads(t *testing.T) {
+	backend1, port1 := createMockBackend(t)
+	defer backend1.Close()
+	backend2, port2 := createMockBackend(t)
+	defer backend2.Close()
+
+	sharedPort := freePort(t)
+	specs := map[string]AppSpec{
+		"app1": {ListenPort: sharedPort, InitialPort: port1, StateFile: filepath.Join(t.TempDir(), "active_port"),
+			Options: Options{Mode: ModeHTTP, Hosts: []string{"one.example.com"}}},
+		"app2": {ListenPort: sharedPort, InitialPort: port2, StateFile: filepath.Join(t.TempDir(), "active_port"),
+			Options: Options{Mode: ModeHTTP, Hosts: []string{"two.example.com"}}},
+	}
+	mm := NewMultiManager(func() (map[string]AppSpec, error) { return specs, nil }, filepath.Join(t.TempDir(), "services.yml"), 0)
+	require.NoError(t, mm.Reload())
+
+	get := func(host string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d", sharedPort), nil)
+		require.NoError(t, err)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	require.Eventually(t, func() bool {
+		_, body := get("one.example.com")
+		return body == strconv.Itoa(port1)
+	}, 2*time.Second, 20*time.Millisecond)
+	_, body := get("two.example.com")
+	assert.Equal(t, strconv.Itoa(port2), body)
+	status, _ := get("three.example.com")
+	assert.Equal(t, http.StatusMisdirectedRequest, status)
+
+	// Removing an app stops routing its host, the other app keeps the listener.
+	delete(specs, "app2")
+	require.NoError(t, mm.Reload())
+	status, _ = get("two.example.com")
+	assert.Equal(t, http.StatusMisdirectedRequest, status)
+	_, body = get("one.example.com")
+	assert.Equal(t, strconv.Itoa(port1), body)
+
+	// A tcp app cannot share the port.
+	specs["app3"] = AppSpec{ListenPort: sharedPort, InitialPort: port2, StateFile: filepath.Join(t.TempDir(), "active_port")}
+	require.NoError(t, mm.Reload())
+	mm.mu.Lock()
+	_, running := mm.apps["app3"]
+	mm.mu.Unlock()
+	assert.False(t, running)
+}
+
+func TestMultiManager_ReloadDrainsChangedApp(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		fmt.Fprint(w, "done")
+	}))
+	defer backend.Close()
+	backendPort := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	listenPort := freePort(t)
+	specs := map[string]AppSpec{
+		"app1": {ListenPort: listenPort, InitialPort: backendPort, StateFile: filepath.Join(t.TempDir(), "active_port"),
+			Options: Options{Mode: ModeHTTP}},
+	}
+	mm := NewMultiManager(func() (map[string]AppSpec, error) { return specs, nil }, filepath.Join(t.TempDir(), "services.yml"), 5*time.Second)
+	defer mm.Shutdown(time.Second)
+	require.NoError(t, mm.Reload())
+	url := fmt.Sprintf("http://127.0.0.1:%d", listenPort)
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// A slow request is in flight when the app's spec changes.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	result := make(chan string, 1)
+	go func() {
+		resp, err := client.Get(url + "/slow")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		result <- string(body)
+	}()
+	mm.mu.Lock()
+	old := mm.apps["app1"].manager
+	mm.mu.Unlock()
+	require.Eventually(t, func() bool { return len(old.proxy.ActiveConnections()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	spec := specs["app1"]
+	spec.Options.Name = "renamed"
+	specs["app1"] = spec
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- mm.Reload() }()
+
+	select {
+	case <-reloaded:
+		t.Fatal("reload returned before the open request finished")
+	case <-time.After(200 * time.Millisecond):
+	}
+	release <- struct{}{}
+	assert.Equal(t, "done", <-result)
+	require.NoError(t, <-reloaded)
+
+	// The replacement serves the port again.
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 20*time.Millisecond)
+}
+
+func TestMultiManager_RetriesAppThatFailedToStart(t *testing.T) {
+	backend, port := createMockBackend(t)
+	defer backend.Close()
+
+	// Something else holds the listen port, so the proxy cannot start.
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listenPort := occupied.Addr().(*net.TCPAddr).Port
+	specs := map[string]AppSpec{
+		"app1": {ListenPort: listenPort, InitialPort: port, StateFile: filepath.Join(t.TempDir(), "active_port")},
+	}
+	mm := NewMultiManager(func() (map[string]AppSpec, error) { return specs, nil }, filepath.Join(t.TempDir(), "services.yml"), 0)
+	defer mm.Shutdown(time.Second)
+	require.NoError(t, mm.Reload())
+
+	running := func() bool {
+		mm.mu.Lock()
+		defer mm.mu.Unlock()
+		_, ok := mm.apps["app1"]
+		return ok
+	}
+	require.Eventually(t, func() bool { return !running() }, 2*time.Second, 20*time.Millisecond)
+
+	// Once the port is free, the next reload starts the app, although its spec did not change.
+	occupied.Close()
+	require.NoError(t, mm.Reload())
+	require.Eventually(t, func() bool {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d", listenPort))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}, 2*time.Second, 20*time.Millisecond)
+	assert.True(t, running())
+}
+
+// writeCertificate writes a self-signed certificate for the given names to dir.
+func writeCertificate(t *testing.T, dir, name string, serial int64, dnsNames ...string) CertificateFiles {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	files := CertificateFiles{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	require.NoError(t, os.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	require.NoError(t, os.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	return files
+}
+
+func TestManager_TLSTermination(t *testing.T) {
+	backend, backendPort := createMockBackend(t)
+	defer backend.Close()
+
+	certDir := t.TempDir()
+	certA := writeCertificate(t, certDir, "a", 1, "a.example.com")
+	certB := writeCertificate(t, certDir, "b", 2, "b.example.com")
+
+	listenPort := freePort(t)
+	manager := NewManagerWithOptions(listenPort, backendPort, filepath.Join(t.TempDir(), "active_port"), Options{
+		Mode:         ModeHTTP,
+		Certificates: []CertificateFiles{certA, certB},
+	})
+	go manager.Start()
+	defer manager.Stop()
+
+	// serial connects with the given SNI and returns the serial of the certificate served.
+	serial := func(serverName string) int64 {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", listenPort), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			return 0
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	require.Eventually(t, func() bool { return serial("a.example.com") != 0 }, 2*time.Second, 20*time.Millisecond)
+
+	assert.Equal(t, int64(1), serial("a.example.com"))
+	assert.Equal(t, int64(2), serial("b.example.com"))
+	// Unknown names get the first certificate.
+	assert.Equal(t, int64(1), serial("other.example.com"))
+
+	// Requests are decrypted and forwarded to the backend as plain HTTP.
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d", listenPort))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, strconv.Itoa(backendPort), string(body))
+
+	// A renewed certificate is picked up without restarting.
+	writeCertificate(t, certDir, "a", 3, "a.example.com")
+	assert.Eventually(t, func() bool { return serial("a.example.com") == 3 }, 5*time.Second, 50*time.Millisecond)
+
+	// A broken renewal keeps the previous certificate in use.
+	require.NoError(t, os.WriteFile(certA.CertFile, []byte("not a certificate"), 0644))
+	time.Sleep(time.Second)
+	assert.Equal(t, int64(3), serial("a.example.com"))
+}
+
+func TestTargetSet_SplitsByWeight(t *testing.T) {
+	set := newTargetSet("127.0.0.1:8080")
+	assert.Equal(t, "127.0.0.1:8080", set.pick())
+
+	assert.True(t, set.set([]Target{{Addr: "127.0.0.1:8080", Weight: 80}, {Addr: "127.0.0.1:8081", Weight: 20}}))
+	assert.False(t, set.set([]Target{{Addr: "127.0.0.1:8080", Weight: 80}, {Addr: "127.0.0.1:8081", Weight: 20}}))
+	assert.Equal(t, "127.0.0.1:8080", set.primary())
+
+	picks := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		picks[set.pick()]++
+	}
+	assert.InDelta(t, 2000, picks["127.0.0.1:8081"], 300)
+
+	// Targets without weight get no traffic.
+	set.set([]Target{{Addr: "127.0.0.1:8080", Weight: 0}, {Addr: "127.0.0.1:8081", Weight: 1}})
+	assert.Equal(t, []Target{{Addr: "127.0.0.1:8081", Weight: 1}}, set.list())
+
+	assert.Error(t, validateTargets(nil))
+	assert.Error(t, validateTargets([]Target{{Addr: "127.0.0.1:8080", Weight: 0}}))
+	assert.Error(t, validateTargets([]Target{{Addr: "127.0.0.1:8080", Weight: 1}, {Addr: "127.0.0.1:8080", Weight: 1}}))
+}
+
+func TestManager_SplitTraffic(t *testing.T) {
+	backend1, port1 := createMockBackend(t)
+	defer backend1.Close()
+	backend2, port2 := createMockBackend(t)
+	defer backend2.Close()
+
+	listenPort := freePort(t)
+	stateFile := filepath.Join(t.TempDir(), "active_port")
+	manager := NewManager(listenPort, port1, stateFile)
+	go manager.Start()
+	defer manager.Stop()
+
+	client := NewControlClient(filepath.Join(filepath.Dir(stateFile), ControlSocketName))
+	require.Eventually(t, func() bool {
+		_, err := client.Status()
+		return err == nil
+	}, 2*time.Second, 20*time.Millisecond)
+
+	status, err := client.Split([]Target{LocalTarget(port1, 50), LocalTarget(port2, 50)})
+	require.NoError(t, err)
+	assert.True(t, status.Split())
+
+	httpClient := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	seen := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		resp, err := httpClient.Get(fmt.Sprintf("http://127.0.0.1:%d", listenPort))
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		seen[string(body)]++
+	}
+	assert.Greater(t, seen[strconv.Itoa(port1)], 0)
+	assert.Greater(t, seen[strconv.Itoa(port2)], 0)
+
+	status, err = client.Status()
+	require.NoError(t, err)
+	assert.Equal(t, int64(40), status.Stats[localAddr(port1)].Requests+status.Stats[localAddr(port2)].Requests)
+
+	// A split is not persisted, the state file still holds the last switched port.
+	state, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(port1), string(state))
+
+	// Switching ends the split.
+	status, err = client.Switch(port2)
+	require.NoError(t, err)
+	assert.False(t, status.Split())
+	assert.Equal(t, localAddr(port2), status.Target)
+
+	_, err = client.Split([]Target{LocalTarget(port1, 0)})
+	assert.Error(t, err)
+}
+
+func TestManager_Metrics(t *testing.T) {
+	backend, backendPort := createMockBackend(t)
+	defer backend.Close()
+	downPort := freePort(t)
+
+	listenPort := freePort(t)
+	metricsAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	stateFile := filepath.Join(t.TempDir(), "active_port")
+	manager := NewManagerWithOptions(listenPort, backendPort, stateFile, Options{Name: "api", MetricsAddr: metricsAddr})
+	go manager.Start()
+	defer manager.Stop()
+
+	scrape := func() string {
+		resp, err := http.Get("http://" + metricsAddr + "/metrics")
+		if err != nil {
+			return ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	require.Eventually(t, func() bool { return scrape() != "" }, 2*time.Second, 20*time.Millisecond)
+
+	httpClient := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for i := 0; i < 3; i++ {
+		resp, err := httpClient.Get(fmt.Sprintf("http://127.0.0.1:%d", listenPort))
+		require.NoError(t, err)
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// Switch to a port nothing listens on, the next connection fails to dial.
+	client := NewControlClient(filepath.Join(filepath.Dir(stateFile), ControlSocketName))
+	_, err := client.Switch(downPort)
+	require.NoError(t, err)
+	_, err = httpClient.Get(fmt.Sprintf("http://127.0.0.1:%d", listenPort))
+	require.Error(t, err)
+
+	up := quoteLabel(localAddr(backendPort))
+	down := quoteLabel(localAddr(downPort))
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrape(), fmt.Sprintf(`revlay_proxy_connections_total{app="api",target=%s} 3`, up))
+	}, 2*time.Second, 20*time.Millisecond)
+
+	metrics := scrape()
+	assert.Contains(t, metrics, "# TYPE revlay_proxy_connections_total counter")
+	assert.Contains(t, metrics, fmt.Sprintf(`revlay_proxy_active_connections{app="api",target=%s} 0`, up))
+	assert.Contains(t, metrics, fmt.Sprintf(`revlay_proxy_dial_failures_total{app="api",target=%s} 1`, down))
+	assert.Contains(t, metrics, fmt.Sprintf(`revlay_proxy_switches_total{app="api",target=%s} 1`, down))
+	assert.Contains(t, metrics, fmt.Sprintf(`revlay_proxy_target_weight{app="api",target=%s} 100`, down))
+	assert.Contains(t, metrics, fmt.Sprintf(`revlay_proxy_target_weight{app="api",target=%s} 0`, up))
+	assert.Contains(t, metrics, `revlay_proxy_paused{app="api"} 0`)
+	assert.NotContains(t, metrics, fmt.Sprintf(`revlay_proxy_sent_bytes_total{app="api",target=%s} 0`, up))
+}
+
+// startBackendLater starts a backend that replies "late" on port after delay.
+func startBackendLater(t *testing.T, port int, delay time.Duration) {
+	go func() {
+		time.Sleep(delay)
+		l, err := net.Listen("tcp", localAddr(port))
+		if err != nil {
+			return
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "late")
+		})}
+		t.Cleanup(func() { server.Close() })
+		server.Serve(l)
+	}()
+}
+
+func TestProxy_HoldsConnectionsWhileBackendStarts(t *testing.T) {
+	for _, mode := range []Mode{ModeTCP, ModeHTTP} {
+		t.Run(string(mode), func(t *testing.T) {
+			backendPort := freePort(t)
+			listenPort := freePort(t)
+			manager := NewManagerWithOptions(listenPort, backendPort, filepath.Join(t.TempDir(), "active_port"), Options{
+				Mode:        mode,
+				RetryWindow: 3 * time.Second,
+			})
+			go manager.Start()
+			defer manager.Stop()
+			require.Eventually(t, func() bool {
+				conn, err := net.Dial("tcp", localAddr(listenPort))
+				if err == nil {
+					conn.Close()
+				}
+				return err == nil
+			}, 2*time.Second, 20*time.Millisecond)
+
+			startBackendLater(t, backendPort, 500*time.Millisecond)
+
+			start := time.Now()
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d", listenPort))
+			require.NoError(t, err)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, "late", string(body))
+			assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+		})
+	}
+}
+
+func TestDialWithRetry_GivesUpAfterWindow(t *testing.T) {
+	addr := localAddr(freePort(t))
+	start := time.Now()
+	_, got, err := dialWithRetry(context.Background(), func() string { return addr }, 300*time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, addr, got)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// Without a window the first failure is returned.
+	_, _, err = dialWithRetry(context.Background(), func() string { return addr }, 0)
+	assert.Error(t, err)
+}
+
+func TestManager_ShutdownDrainsOpenConnections(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, "done")
+	}))
+	defer backend.Close()
+	backendPort := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	for _, mode := range []Mode{ModeTCP, ModeHTTP} {
+		t.Run(string(mode), func(t *testing.T) {
+			listenPort := freePort(t)
+			manager := NewManagerWithOptions(listenPort, backendPort, filepath.Join(t.TempDir(), "active_port"), Options{Mode: mode})
+			go manager.Start()
+			<-manager.Ready()
+
+			// A slow request is in flight when the shutdown starts. In tcp mode the proxy
+			// cannot see requests, so the client must close its connection afterwards.
+			client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+			result := make(chan string, 1)
+			go func() {
+				resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d", listenPort))
+				if err != nil {
+					result <- err.Error()
+					return
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				result <- string(body)
+			}()
+			require.Eventually(t, func() bool { return len(manager.proxy.ActiveConnections()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+			stopped := make(chan struct{})
+			go func() {
+				manager.Shutdown(5 * time.Second)
+				close(stopped)
+			}()
+
+			// New connections are refused while the open one finishes.
+			require.Eventually(t, func() bool {
+				conn, err := net.Dial("tcp", localAddr(listenPort))
+				if err == nil {
+					conn.Close()
+				}
+				return err != nil
+			}, 2*time.Second, 10*time.Millisecond)
+			select {
+			case <-stopped:
+				t.Fatal("shutdown returned before the open request finished")
+			default:
+			}
+
+			release <- struct{}{}
+			assert.Equal(t, "done", <-result)
+			select {
+			case <-stopped:
+			case <-time.After(2 * time.Second):
+				t.Fatal("shutdown did not return after the open request finished")
+			}
+		})
+	}
+}
+
+func TestTCPProxy_ShutdownClosesConnectionsAfterTimeout(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer backend.Close()
+	go func() {
+		// Accept and hold the connection open without ever answering.
+		conn, err := backend.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	p := NewTCPProxy(backend.Addr().String())
+	require.NoError(t, p.Start("127.0.0.1:0"))
+	conn, err := net.Dial("tcp", p.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return len(p.ActiveConnections()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, p.Shutdown(ctx), context.DeadlineExceeded)
+
+	// The client sees its connection closed.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestListen_UsesInheritedListener(t *testing.T) {
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer original.Close()
+	addr := original.Addr().String()
+	f, err := original.(*net.TCPListener).File()
+	require.NoError(t, err)
+
+	// Pretend the listener was passed on by a previous proxy process.
+	listenerRegistry.Lock()
+	listenerRegistry.loaded = false
+	listenerRegistry.Unlock()
+	t.Setenv(listenersEnv, fmt.Sprintf("tcp:%s=%d", addr, f.Fd()))
+
+	assert.True(t, inherited("tcp", addr))
+	l, err := listen("tcp", addr)
+	require.NoError(t, err, "the address is in use, only the inherited socket can be used")
+	defer l.Close()
+	assert.False(t, inherited("tcp", addr))
+
+	go func() {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestNotifyReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	t.Setenv(readyEnv, strconv.Itoa(int(w.Fd())))
+
+	NotifyReady()
+	buf := make([]byte, 1)
+	_, err = r.Read(buf)
+	assert.NoError(t, err)
+	assert.Empty(t, os.Getenv(readyEnv))
+}
+
+func TestManager_FailsOverToHealthyBackend(t *testing.T) {
+	backend1, port1 := createMockBackend(t)
+	backend2, port2 := createMockBackend(t)
+	defer backend2.Close()
+
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "active_port")
+	listenPort := freePort(t)
+	manager := NewManagerWithOptions(listenPort, port1, stateFile, Options{
+		Mode: ModeHTTP,
+		Health: &HealthOptions{
+			Path:               "/health",
+			Interval:           50 * time.Millisecond,
+			Timeout:            time.Second,
+			UnhealthyThreshold: 2,
+			FailoverPorts:      []int{port1, port2},
+		},
+	})
+	go manager.Start()
+	defer manager.Stop()
+	<-manager.Ready()
+
+	// A healthy backend is left alone.
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, localAddr(port1), manager.proxy.TargetAddr())
+	_, err := ReadFailoverRecord(filepath.Join(dir, FailoverFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	backend1.Close()
+	require.Eventually(t, func() bool {
+		return manager.proxy.TargetAddr() == localAddr(port2)
+	}, 3*time.Second, 20*time.Millisecond)
+
+	content, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(port2), strings.TrimSpace(string(content)))
+
+	record, err := ReadFailoverRecord(filepath.Join(dir, FailoverFileName))
+	require.NoError(t, err)
+	assert.Equal(t, port1, record.FromPort)
+	assert.Equal(t, port2, record.ToPort)
+	assert.Contains(t, record.Reason, localAddr(port1))
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d", listenPort))
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, strconv.Itoa(port2), string(body))
+}
+
+func TestProbeBackend(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	addr := backend.Listener.Addr().String()
+
+	assert.NoError(t, probeBackend(addr, "/health", time.Second))
+	assert.NoError(t, probeBackend(addr, "health", time.Second))
+	assert.Error(t, probeBackend(addr, "/other", time.Second))
+	assert.NoError(t, probeBackend(addr, "", time.Second), "without a path accepting connections is enough")
+	assert.Error(t, probeBackend(localAddr(freePort(t)), "", time.Second))
+}
+
+func TestHTTPProxy_BackendDropsConnectionMidBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		// Drop the connection before the promised body is sent.
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer backend.Close()
+	target := backend.Listener.Addr().String()
+
+	proxy := NewHTTPProxy(target, nil, nil)
+	require.NoError(t, proxy.Start("127.0.0.1:0"))
+	defer proxy.listener.Close()
+
+	// The proxy aborts the response, before or after its headers reach the client.
+	resp, err := http.Get("http://" + proxy.listener.Addr().String())
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	assert.Error(t, err)
+
+	// The aborted request no longer counts as open, so draining does not wait for it.
+	assert.Eventually(t, func() bool {
+		return proxy.tracker.snapshot()[target] == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestNotifyReady_ReportsToSystemd(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+	read := func() string {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 256)
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		return string(buf[:n])
+	}
+
+	// A proxy started by systemd only reports readiness.
+	t.Setenv(readyEnv, "")
+	NotifyReady()
+	assert.Equal(t, "READY=1", read())
+
+	// After a handoff the new process takes over as the unit's main process.
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	t.Setenv(readyEnv, strconv.Itoa(int(w.Fd())))
+	NotifyReady()
+	assert.Equal(t, fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()), read())
+	assert.Equal(t, socket, os.Getenv("NOTIFY_SOCKET"))
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/color"
+)
+
+// retryInterval is the pause between dial attempts while a backend is coming up.
+const retryInterval = 100 * time.Millisecond
+
+// dialTimeout bounds a single dial attempt.
+const dialTimeout = 5 * time.Second
+
+// dialWithRetry dials the address returned by next until it succeeds, window
+// has passed or ctx is done. next is called again for every attempt, so a
+// switch that happens while a connection is held is picked up.
+// It returns the address of the last attempt along with its result.
+func dialWithRetry(ctx context.Context, next func() string, window time.Duration) (net.Conn, string, error) {
+	dialer := net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+	deadline := time.Now().Add(window)
+	held := false
+	for {
+		addr := next()
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			if held {
+				log.Print(color.Green(fmt.Sprintf("Target %s is reachable again, releasing held connection.", addr)))
+			}
+			return conn, addr, nil
+		}
+		if window <= 0 || time.Now().Add(retryInterval).After(deadline) {
+			return nil, addr, err
+		}
+		if !held {
+			log.Print(color.Yellow(fmt.Sprintf("Target %s is not reachable, holding connection for up to %s: %v", addr, window, err)))
+			held = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, addr, err
+		case <-time.After(retryInterval):
+		}
+	}
+}
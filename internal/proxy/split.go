@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// Target is a backend address and its share of new connections.
+type Target struct {
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+}
+
+// LocalTarget returns a target for the backend on the given local port.
+func LocalTarget(port, weight int) Target {
+	return Target{Addr: localAddr(port), Weight: weight}
+}
+
+// TargetStats counts the connections or requests handled by one backend.
+type TargetStats struct {
+	Requests int64 `json:"requests"`
+	// Errors counts failed dials, and in http mode also 5xx responses.
+	Errors       int64 `json:"errors"`
+	DialFailures int64 `json:"dial_failures"`
+	// BytesIn is what clients sent to the backend, BytesOut what the backend sent back.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// Switches counts how often the backend started receiving new traffic.
+	Switches int64 `json:"switches"`
+}
+
+// validateTargets checks that targets can be used to split traffic.
+func validateTargets(targets []Target) error {
+	if len(targets) == 0 {
+		return fmt.Errorf("at least one target is required")
+	}
+	total := 0
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		if t.Addr == "" {
+			return fmt.Errorf("target address must not be empty")
+		}
+		if seen[t.Addr] {
+			return fmt.Errorf("target %s is listed twice", t.Addr)
+		}
+		seen[t.Addr] = true
+		if t.Weight < 0 {
+			return fmt.Errorf("weight of %s must not be negative", t.Addr)
+		}
+		total += t.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("at least one target needs a positive weight")
+	}
+	return nil
+}
+
+// targetSet picks the backend for each new connection according to the target weights.
+type targetSet struct {
+	mu      sync.RWMutex
+	targets []Target
+}
+
+func newTargetSet(addr string) *targetSet {
+	return &targetSet{targets: []Target{{Addr: addr, Weight: 100}}}
+}
+
+// set replaces the targets and reports whether they changed. Targets without weight are dropped.
+func (s *targetSet) set(targets []Target) bool {
+	kept := make([]Target, 0, len(targets))
+	for _, t := range targets {
+		if t.Weight > 0 {
+			kept = append(kept, t)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sameTargets(s.targets, kept) {
+		return false
+	}
+	s.targets = kept
+	return true
+}
+
+func (s *targetSet) list() []Target {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Target(nil), s.targets...)
+}
+
+// primary returns the target with the largest share, the first one on a tie.
+func (s *targetSet) primary() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	best := s.targets[0]
+	for _, t := range s.targets[1:] {
+		if t.Weight > best.Weight {
+			best = t
+		}
+	}
+	return best.Addr
+}
+
+// pick returns the backend for a new connection.
+func (s *targetSet) pick() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.targets) == 1 {
+		return s.targets[0].Addr
+	}
+	total := 0
+	for _, t := range s.targets {
+		total += t.Weight
+	}
+	n := rand.Intn(total)
+	for _, t := range s.targets {
+		if n < t.Weight {
+			return t.Addr
+		}
+		n -= t.Weight
+	}
+	return s.targets[len(s.targets)-1].Addr
+}
+
+// recordSwitches counts a switch for every backend in targets that was not receiving traffic before.
+func recordSwitches(tracker *connTracker, before, targets []Target) {
+	for _, t := range targets {
+		known := false
+		for _, b := range before {
+			if b.Addr == t.Addr {
+				known = true
+				break
+			}
+		}
+		if !known && t.Weight > 0 {
+			tracker.switched(t.Addr)
+		}
+	}
+}
+
+func sameTargets(a, b []Target) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// describeTargets formats targets for log messages, e.g. "127.0.0.1:8080 (95%), 127.0.0.1:8081 (5%)".
+func describeTargets(targets []Target) string {
+	total := 0
+	for _, t := range targets {
+		total += t.Weight
+	}
+	desc := ""
+	for i, t := range targets {
+		if i > 0 {
+			desc += ", "
+		}
+		desc += fmt.Sprintf("%s (%d%%)", t.Addr, t.Weight*100/total)
+	}
+	return desc
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/xukonxe/revlay/internal/color"
+)
+
+// CertificateFiles is a certificate and its private key, both PEM encoded.
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// certStore holds the certificates of one app and selects one by SNI.
+type certStore struct {
+	files []CertificateFiles
+
+	mu    sync.RWMutex
+	certs []*tls.Certificate
+}
+
+// newCertStore loads the given certificate files. It fails if any of them cannot be loaded.
+func newCertStore(files []CertificateFiles) (*certStore, error) {
+	s := &certStore{files: files}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads all certificate files again. On error the previously loaded
+// certificates stay in use, so a half-written renewal never breaks TLS.
+func (s *certStore) reload() error {
+	certs := make([]*tls.Certificate, 0, len(s.files))
+	for _, f := range s.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load certificate %s: %w", f.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("could not parse certificate %s: %w", f.CertFile, err)
+			}
+		}
+		certs = append(certs, &cert)
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.mu.Unlock()
+	return nil
+}
+
+// watches reports whether path is one of the store's certificate or key files.
+func (s *certStore) watches(path string) bool {
+	for _, f := range s.files {
+		if filepath.Clean(path) == filepath.Clean(f.CertFile) || filepath.Clean(path) == filepath.Clean(f.KeyFile) {
+			return true
+		}
+	}
+	return false
+}
+
+// dirs returns the directories containing the certificate files, for watching.
+func (s *certStore) dirs() []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, f := range s.files {
+		for _, p := range []string{f.CertFile, f.KeyFile} {
+			dir := filepath.Dir(p)
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs
+}
+
+// match returns the certificate whose names cover serverName.
+func (s *certStore) match(serverName string) *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, cert := range s.certs {
+		if cert.Leaf != nil && cert.Leaf.VerifyHostname(serverName) == nil {
+			return cert
+		}
+	}
+	return nil
+}
+
+// fallback returns the first certificate, used for clients without SNI.
+func (s *certStore) fallback() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.certs) == 0 {
+		return nil
+	}
+	return s.certs[0]
+}
+
+// tlsConfig returns a server config that selects certificates from stores by SNI.
+// stores is called on every handshake so that apps can come and go.
+func tlsConfig(stores func() []*certStore) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			all := stores()
+			serverName := strings.ToLower(hello.ServerName)
+			if serverName != "" {
+				for _, s := range all {
+					if cert := s.match(serverName); cert != nil {
+						return cert, nil
+					}
+				}
+			}
+			for _, s := range all {
+				if cert := s.fallback(); cert != nil {
+					return cert, nil
+				}
+			}
+			return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+		},
+	}
+}
+
+// reloadCertificates reloads the store after one of its files changed.
+func (m *Manager) reloadCertificates() {
+	if err := m.certs.reload(); err != nil {
+		log.Print(color.Red(fmt.Sprintf("Failed to reload TLS certificates, keeping the previous ones: %v", err)))
+		return
+	}
+	log.Print(color.Green("TLS certificates reloaded."))
+}
@@ -0,0 +1,155 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/color"
+)
+
+// Control commands understood by the supervisor.
+const (
+	CommandStart  = "start"
+	CommandStop   = "stop"
+	CommandStatus = "status"
+)
+
+// ErrNotRunning is returned by Client when no supervisor is listening on the socket.
+var ErrNotRunning = errors.New("supervisor is not running")
+
+// Request is a single command sent to the supervisor.
+type Request struct {
+	Command string `json:"command"`
+	// Spec is the process to start.
+	Spec *Spec `json:"spec,omitempty"`
+	// Port selects the process to stop.
+	Port int `json:"port,omitempty"`
+}
+
+// Response is the supervisor's answer to a Request.
+type Response struct {
+	OK        bool            `json:"ok"`
+	Error     string          `json:"error,omitempty"`
+	Processes []ProcessStatus `json:"processes"`
+}
+
+// Serve accepts commands on listener until it is closed.
+func (s *Supervisor) Serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Print(color.Red(fmt.Sprintf("Supervisor socket accept failed: %v", err)))
+			continue
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Supervisor) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(&Response{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	var err error
+	switch req.Command {
+	case CommandStart:
+		if req.Spec == nil {
+			err = errors.New("start requires a process spec")
+		} else {
+			_, err = s.Start(*req.Spec)
+		}
+	case CommandStop:
+		_, err = s.Stop(req.Port)
+	case CommandStatus:
+	default:
+		err = fmt.Errorf("unknown command '%s'", req.Command)
+	}
+
+	resp := &Response{OK: err == nil, Processes: s.Status()}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// Client sends commands to a running supervisor over its socket.
+type Client struct {
+	socketPath string
+}
+
+// NewClient creates a client for the supervisor socket at socketPath.
+func NewClient(socketPath string) *Client {
+	return &Client{socketPath: socketPath}
+}
+
+// Start makes the supervisor start and watch a process.
+func (c *Client) Start(spec Spec) (*ProcessStatus, error) {
+	return c.process(&Request{Command: CommandStart, Spec: &spec}, spec.Port, 0)
+}
+
+// Stop stops the process on port. wait should be the supervisor's stop timeout, which
+// covers the stop command and the wait for the process before it is killed. The client
+// waits 10s longer, so it does not give up while the supervisor is still stopping.
+func (c *Client) Stop(port int, wait time.Duration) (*ProcessStatus, error) {
+	return c.process(&Request{Command: CommandStop, Port: port}, port, wait)
+}
+
+// Status returns the state of every supervised process.
+func (c *Client) Status() ([]ProcessStatus, error) {
+	resp, err := c.do(&Request{Command: CommandStatus}, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Processes, nil
+}
+
+// process sends req and returns the resulting state of the process on port.
+func (c *Client) process(req *Request, port int, wait time.Duration) (*ProcessStatus, error) {
+	resp, err := c.do(req, wait)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range resp.Processes {
+		if p.Port == port {
+			return &p, nil
+		}
+	}
+	return nil, fmt.Errorf("supervisor reports no process on port %d", port)
+}
+
+func (c *Client) do(req *Request, wait time.Duration) (*Response, error) {
+	conn, err := net.DialTimeout("unix", c.socketPath, 2*time.Second)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, ErrNotRunning
+		}
+		return nil, fmt.Errorf("could not connect to supervisor socket: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10*time.Second + wait))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("could not send %s command to supervisor: %w", req.Command, err)
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("no valid answer from supervisor to %s command: %w", req.Command, err)
+	}
+	if !resp.OK {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,559 @@
+// Package supervisor runs an app's processes from a long-lived revlay process
+// and restarts them according to the app's restart policy.
+package supervisor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/xukonxe/revlay/internal/color"
+)
+
+// Policy decides whether a process is restarted after it exits.
+type Policy string
+
+const (
+	// RestartAlways restarts the process whenever it exits.
+	RestartAlways Policy = "always"
+	// RestartOnFailure restarts the process when it exits with a non-zero code or is killed.
+	RestartOnFailure Policy = "on-failure"
+	// RestartNever only records how the process exited.
+	RestartNever Policy = "never"
+)
+
+// Process states reported in ProcessStatus.
+const (
+	StateRunning   = "running"
+	StateBackoff   = "backoff"
+	StateCrashLoop = "crash-loop"
+	StateExited    = "exited"
+	StateStopped   = "stopped"
+)
+
+const (
+	defaultBackoff = time.Second
+	maxBackoff     = time.Minute
+
+	defaultMaxRestarts   = 5
+	defaultRestartWindow = 5 * time.Minute
+	defaultStopTimeout   = 10 * time.Second
+
+	// adoptPollInterval is how often a process started by a previous supervisor is checked.
+	adoptPollInterval = time.Second
+)
+
+// Spec describes one supervised process, one colour of an app.
+type Spec struct {
+	Release string `json:"release"`
+	// Port identifies the process, there is at most one per port.
+	Port int `json:"port"`
+	// Command is run with sh -c.
+	Command string `json:"command"`
+	Dir     string `json:"dir"`
+	// Env is added to the supervisor's own environment.
+	Env       []string `json:"env,omitempty"`
+	StdoutLog string   `json:"stdout_log,omitempty"`
+	StderrLog string   `json:"stderr_log,omitempty"`
+	// PidFile, if set, holds the PID of the running process.
+	PidFile string `json:"pid_file,omitempty"`
+	// StopCommand, if set, is run with sh -c to stop the process instead of SIGTERM.
+	StopCommand string `json:"stop_command,omitempty"`
+}
+
+// Options configures how processes are restarted and stopped.
+type Options struct {
+	Restart Policy
+	// Backoff is the delay before the first restart, it doubles with every restart in RestartWindow.
+	Backoff time.Duration
+	// MaxRestarts within RestartWindow make the process count as crash looping, it is not restarted again.
+	MaxRestarts   int
+	RestartWindow time.Duration
+	// StopTimeout is how long Stop waits after SIGTERM before sending SIGKILL.
+	StopTimeout time.Duration
+}
+
+// ProcessStatus is the state of a supervised process.
+type ProcessStatus struct {
+	Spec
+	PID       int       `json:"pid"`
+	State     string    `json:"state"`
+	StartedAt time.Time `json:"started_at"`
+	Restarts  int       `json:"restarts"`
+	// ExitCode is the code of the last exit, -1 if the process was killed by a signal or its code is unknown.
+	ExitCode int       `json:"exit_code"`
+	ExitedAt time.Time `json:"exited_at"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Alive reports whether the recorded process still exists. A state file left behind
+// by a supervisor that is no longer running can list processes that died since.
+func (p ProcessStatus) Alive() bool {
+	return alive(p.PID)
+}
+
+// Supervisor owns the processes of one app. Its state is persisted to a file so
+// that a supervisor started later, for example after an upgrade, adopts them.
+type Supervisor struct {
+	opts      Options
+	stateFile string
+
+	mu     sync.Mutex
+	procs  map[int]*process
+	done   chan struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type process struct {
+	status ProcessStatus
+	// exited is closed when the current run of the process ends, exitCode is set before.
+	exited   chan struct{}
+	exitCode int
+	// stop is closed by Stop, the process is not restarted afterwards.
+	stop     chan struct{}
+	stopping bool
+	// restarts holds the times of recent restarts, for backoff and crash-loop detection.
+	restarts []time.Time
+}
+
+// New creates a supervisor persisting its state to stateFile and adopts the
+// processes recorded there. Processes that died meanwhile are restarted per policy.
+func New(stateFile string, opts Options) *Supervisor {
+	if opts.Restart == "" {
+		opts.Restart = RestartNever
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+	if opts.MaxRestarts <= 0 {
+		opts.MaxRestarts = defaultMaxRestarts
+	}
+	if opts.RestartWindow <= 0 {
+		opts.RestartWindow = defaultRestartWindow
+	}
+	if opts.StopTimeout <= 0 {
+		opts.StopTimeout = defaultStopTimeout
+	}
+	s := &Supervisor{
+		opts:      opts,
+		stateFile: stateFile,
+		procs:     make(map[int]*process),
+		done:      make(chan struct{}),
+	}
+	s.adopt()
+	return s
+}
+
+// adopt takes over the processes recorded in the state file.
+func (s *Supervisor) adopt() {
+	statuses, err := ReadState(s.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(color.Yellow(fmt.Sprintf("Ignoring supervisor state: %v", err)))
+		}
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, status := range statuses {
+		p := &process{status: status, stop: make(chan struct{})}
+		s.procs[status.Port] = p
+		if status.State != StateRunning && status.State != StateBackoff {
+			continue
+		}
+		p.exited = make(chan struct{})
+		if status.State == StateRunning && alive(status.PID) {
+			log.Print(color.Cyan(fmt.Sprintf("Supervising process %d on :%d again.", status.PID, status.Port)))
+			go s.poll(p, status.PID)
+		} else {
+			// It died while nobody was watching, its exit code is unknown.
+			p.exitCode = -1
+			close(p.exited)
+		}
+		s.wg.Add(1)
+		go s.supervise(p)
+	}
+	s.save()
+}
+
+// Start starts a process and restarts it according to the policy until Stop is called.
+func (s *Supervisor) Start(spec Spec) (*ProcessStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("supervisor is shutting down")
+	}
+	if p, ok := s.procs[spec.Port]; ok && (p.status.State == StateRunning || p.status.State == StateBackoff) {
+		return nil, fmt.Errorf("a process for release %s is already supervised on port %d", p.status.Release, spec.Port)
+	}
+
+	p := &process{status: ProcessStatus{Spec: spec}, stop: make(chan struct{})}
+	if err := s.spawn(p); err != nil {
+		return nil, err
+	}
+	s.procs[spec.Port] = p
+	s.save()
+
+	s.wg.Add(1)
+	go s.supervise(p)
+	status := p.status
+	return &status, nil
+}
+
+// spawn starts a run of the process. The caller holds s.mu.
+func (s *Supervisor) spawn(p *process) error {
+	spec := p.status.Spec
+	cmd := exec.Command("sh", "-c", spec.Command)
+	cmd.Dir = spec.Dir
+	cmd.Env = append(os.Environ(), spec.Env...)
+	// Its own process group lets Stop signal everything the command started.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	var logs []*os.File
+	openLog := func(path string) (*os.File, error) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err == nil {
+			logs = append(logs, f)
+		}
+		return f, err
+	}
+	closeLogs := func() {
+		for _, f := range logs {
+			f.Close()
+		}
+	}
+	if spec.StdoutLog != "" {
+		f, err := openLog(spec.StdoutLog)
+		if err != nil {
+			return fmt.Errorf("could not open log file: %w", err)
+		}
+		cmd.Stdout, cmd.Stderr = f, f
+	}
+	if spec.StderrLog != "" && spec.StderrLog != spec.StdoutLog {
+		f, err := openLog(spec.StderrLog)
+		if err != nil {
+			closeLogs()
+			return fmt.Errorf("could not open log file: %w", err)
+		}
+		cmd.Stderr = f
+	}
+
+	if err := cmd.Start(); err != nil {
+		closeLogs()
+		return fmt.Errorf("failed to start '%s': %w", spec.Command, err)
+	}
+	closeLogs() // The child has its own copies.
+
+	pid := cmd.Process.Pid
+	if spec.PidFile != "" {
+		os.MkdirAll(filepath.Dir(spec.PidFile), 0755)
+		if err := os.WriteFile(spec.PidFile, []byte(strconv.Itoa(pid)), 0644); err != nil {
+			log.Print(color.Yellow(fmt.Sprintf("Could not write PID file %s: %v", spec.PidFile, err)))
+		}
+	}
+
+	p.status.PID = pid
+	p.status.State = StateRunning
+	p.status.StartedAt = time.Now()
+	p.status.Error = ""
+	p.exited = make(chan struct{})
+	go func(exited chan struct{}) {
+		err := cmd.Wait()
+		// Kill whatever the command left behind, so that a restart does not find its port taken.
+		syscall.Kill(-pid, syscall.SIGKILL)
+		code := 0
+		if err != nil {
+			code = -1
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				code = exitErr.ExitCode()
+			}
+		}
+		s.mu.Lock()
+		p.exitCode = code
+		s.mu.Unlock()
+		close(exited)
+	}(p.exited)
+
+	log.Print(color.Green(fmt.Sprintf("Started release %s on :%d with PID %d.", spec.Release, spec.Port, pid)))
+	return nil
+}
+
+// poll waits for a process that is not our child to exit.
+func (s *Supervisor) poll(p *process, pid int) {
+	for alive(pid) {
+		time.Sleep(adoptPollInterval)
+	}
+	syscall.Kill(-pid, syscall.SIGKILL)
+	s.mu.Lock()
+	p.exitCode = -1
+	s.mu.Unlock()
+	close(p.exited)
+}
+
+// supervise restarts the process whenever a run ends, until it is stopped,
+// should not be restarted or the supervisor is closed.
+func (s *Supervisor) supervise(p *process) {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		exited := p.exited
+		s.mu.Unlock()
+		select {
+		case <-exited:
+		case <-s.done:
+			return
+		}
+
+		s.mu.Lock()
+		spec := p.status.Spec
+		p.status.PID = 0
+		p.status.ExitCode = p.exitCode
+		p.status.ExitedAt = time.Now()
+		if spec.PidFile != "" {
+			os.Remove(spec.PidFile)
+		}
+		if p.stopping {
+			p.status.State = StateStopped
+			s.save()
+			s.mu.Unlock()
+			return
+		}
+
+		log.Print(color.Yellow(fmt.Sprintf("Release %s on :%d exited with code %d.", spec.Release, spec.Port, p.exitCode)))
+		if !s.shouldRestart(p.exitCode) {
+			p.status.State = StateExited
+			s.save()
+			s.mu.Unlock()
+			return
+		}
+
+		now := time.Now()
+		recent := p.restarts[:0]
+		for _, t := range p.restarts {
+			if now.Sub(t) < s.opts.RestartWindow {
+				recent = append(recent, t)
+			}
+		}
+		p.restarts = recent
+		if len(p.restarts) >= s.opts.MaxRestarts {
+			p.status.State = StateCrashLoop
+			p.status.Error = fmt.Sprintf("restarted %d times within %s, giving up", len(p.restarts), s.opts.RestartWindow)
+			log.Print(color.Red(fmt.Sprintf("Release %s on :%d is crash looping: %s", spec.Release, spec.Port, p.status.Error)))
+			s.save()
+			s.mu.Unlock()
+			return
+		}
+		delay := s.backoff(len(p.restarts))
+		p.status.State = StateBackoff
+		s.save()
+		s.mu.Unlock()
+
+		log.Print(color.Yellow(fmt.Sprintf("Restarting release %s on :%d in %s...", spec.Release, spec.Port, delay)))
+		select {
+		case <-time.After(delay):
+		case <-p.stop:
+			s.mu.Lock()
+			p.status.State = StateStopped
+			s.save()
+			s.mu.Unlock()
+			return
+		case <-s.done:
+			return
+		}
+
+		s.mu.Lock()
+		p.restarts = append(p.restarts, time.Now())
+		p.status.Restarts++
+		if err := s.spawn(p); err != nil {
+			// A failed start counts like a run that failed at once.
+			log.Print(color.Red(fmt.Sprintf("Could not restart release %s on :%d: %v", spec.Release, spec.Port, err)))
+			p.status.Error = err.Error()
+			p.exitCode = -1
+			p.exited = make(chan struct{})
+			close(p.exited)
+		}
+		s.save()
+		s.mu.Unlock()
+	}
+}
+
+func (s *Supervisor) shouldRestart(exitCode int) bool {
+	switch s.opts.Restart {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+// backoff returns the delay before the next restart, given the number of recent restarts.
+func (s *Supervisor) backoff(restarts int) time.Duration {
+	delay := s.opts.Backoff
+	for i := 0; i < restarts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// Stop stops the process on port and keeps it from being restarted. It runs the stop
+// command or sends SIGTERM to the process group, and SIGKILL if the process is still
+// running after the stop timeout. The stop command counts against the same timeout,
+// so Stop returns shortly after it even when the stop command hangs.
+func (s *Supervisor) Stop(port int) (*ProcessStatus, error) {
+	s.mu.Lock()
+	p, ok := s.procs[port]
+	if !ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("no process is supervised on port %d", port)
+	}
+	if !p.stopping {
+		p.stopping = true
+		close(p.stop)
+	}
+	pid, exited, running, spec := p.status.PID, p.exited, p.status.State == StateRunning, p.status.Spec
+	s.mu.Unlock()
+
+	if running && pid > 0 {
+		log.Print(color.Yellow(fmt.Sprintf("Stopping release %s on :%d (PID %d)...", p.status.Release, port, pid)))
+		deadline := time.Now().Add(s.opts.StopTimeout)
+		if err := s.runStopCommand(spec, pid, deadline); err != nil {
+			if spec.StopCommand != "" {
+				log.Print(color.Yellow(fmt.Sprintf("Stop command for :%d failed, sending SIGTERM: %v", port, err)))
+			}
+			syscall.Kill(-pid, syscall.SIGTERM)
+		}
+		select {
+		case <-exited:
+		case <-time.After(time.Until(deadline)):
+			log.Print(color.Red(fmt.Sprintf("PID %d did not stop within %s, killing it.", pid, s.opts.StopTimeout)))
+			syscall.Kill(-pid, syscall.SIGKILL)
+			<-exited
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.status.State != StateStopped {
+		p.status.PID = 0
+		p.status.State = StateStopped
+		if p.status.PidFile != "" {
+			os.Remove(p.status.PidFile)
+		}
+		s.save()
+	}
+	status := p.status
+	return &status, nil
+}
+
+// runStopCommand runs the spec's stop command with PID set, it is killed at deadline.
+// It returns an error if there is no stop command.
+func (s *Supervisor) runStopCommand(spec Spec, pid int, deadline time.Time) error {
+	if spec.StopCommand == "" {
+		return errors.New("no stop command")
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", spec.StopCommand)
+	// Children of the shell may keep its output open after it was killed.
+	cmd.WaitDelay = time.Second
+	cmd.Dir = spec.Dir
+	cmd.Env = append(os.Environ(), spec.Env...)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("PID=%d", pid))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Status returns the state of every process, ordered by port.
+func (s *Supervisor) Status() []ProcessStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.statuses()
+}
+
+func (s *Supervisor) statuses() []ProcessStatus {
+	statuses := make([]ProcessStatus, 0, len(s.procs))
+	for _, p := range s.procs {
+		statuses = append(statuses, p.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Port < statuses[j].Port })
+	return statuses
+}
+
+// Close stops supervising. The processes keep running and are adopted by the
+// next supervisor using the same state file.
+func (s *Supervisor) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// save writes the state file. The caller holds s.mu.
+func (s *Supervisor) save() {
+	data, err := json.MarshalIndent(s.statuses(), "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.stateFile), 0755)
+	}
+	if err == nil {
+		// Write to a temporary file first so readers never see a partial file.
+		tmp := s.stateFile + ".tmp"
+		// The environment may hold secrets.
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, s.stateFile)
+		}
+	}
+	if err != nil {
+		log.Print(color.Red(fmt.Sprintf("Could not save supervisor state: %v", err)))
+	}
+}
+
+// ReadState reads the process states persisted by a supervisor.
+func ReadState(path string) ([]ProcessStatus, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []ProcessStatus
+	if err := json.Unmarshal(data, &statuses); err != nil {
+		return nil, fmt.Errorf("invalid supervisor state file: %w", err)
+	}
+	return statuses, nil
+}
+
+// alive reports whether a process with the given PID exists.
+func alive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,192 @@
+package supervisor
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSupervisor(t *testing.T, dir string, opts Options) *Supervisor {
+	opts.Backoff = 10 * time.Millisecond
+	s := New(filepath.Join(dir, "supervisor.json"), opts)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testSpec(dir, command string) Spec {
+	return Spec{
+		Release:   "20250101-000000",
+		Port:      8080,
+		Command:   command,
+		Dir:       dir,
+		StdoutLog: filepath.Join(dir, "logs", "out.log"),
+		PidFile:   filepath.Join(dir, "pids", "app.pid"),
+	}
+}
+
+// waitForState waits until the process on port reaches state.
+func waitForState(t *testing.T, s *Supervisor, port int, state string) ProcessStatus {
+	var status ProcessStatus
+	require.Eventually(t, func() bool {
+		for _, p := range s.Status() {
+			if p.Port == port {
+				status = p
+			}
+		}
+		return status.State == state
+	}, 5*time.Second, 10*time.Millisecond, "process never became %s", state)
+	return status
+}
+
+func TestSupervisor_RestartsOnFailureUntilCrashLoop(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSupervisor(t, dir, Options{Restart: RestartOnFailure, MaxRestarts: 3, RestartWindow: time.Minute})
+
+	_, err := s.Start(testSpec(dir, "echo started; exit 3"))
+	require.NoError(t, err)
+
+	status := waitForState(t, s, 8080, StateCrashLoop)
+	assert.Equal(t, 3, status.Restarts)
+	assert.Equal(t, 3, status.ExitCode)
+	assert.NotEmpty(t, status.Error)
+
+	out, err := os.ReadFile(filepath.Join(dir, "logs", "out.log"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(out), "started"), "the first run and three restarts")
+
+	// The state survives for revlay ps.
+	statuses, err := ReadState(filepath.Join(dir, "supervisor.json"))
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	assert.Equal(t, StateCrashLoop, statuses[0].State)
+	assert.Equal(t, 3, statuses[0].Restarts)
+}
+
+func TestSupervisor_RestartPolicies(t *testing.T) {
+	for _, tc := range []struct {
+		policy  Policy
+		command string
+		state   string
+	}{
+		{RestartNever, "exit 1", StateExited},
+		{RestartOnFailure, "exit 0", StateExited},
+		{RestartAlways, "exit 0", StateCrashLoop},
+	} {
+		t.Run(string(tc.policy)+" "+tc.command, func(t *testing.T) {
+			dir := t.TempDir()
+			s := newTestSupervisor(t, dir, Options{Restart: tc.policy, MaxRestarts: 1})
+			_, err := s.Start(testSpec(dir, tc.command))
+			require.NoError(t, err)
+			waitForState(t, s, 8080, tc.state)
+		})
+	}
+}
+
+func TestSupervisor_StopDoesNotRestart(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSupervisor(t, dir, Options{Restart: RestartAlways})
+
+	started, err := s.Start(testSpec(dir, "sleep 30"))
+	require.NoError(t, err)
+	assert.Equal(t, StateRunning, started.State)
+	pid, err := os.ReadFile(filepath.Join(dir, "pids", "app.pid"))
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(started.PID), string(pid))
+
+	_, err = s.Start(testSpec(dir, "sleep 30"))
+	assert.Error(t, err, "only one process per port")
+
+	stopped, err := s.Stop(8080)
+	require.NoError(t, err)
+	assert.Equal(t, StateStopped, stopped.State)
+	assert.False(t, alive(started.PID))
+	assert.NoFileExists(t, filepath.Join(dir, "pids", "app.pid"))
+
+	// Give a restart that should not happen the time to happen.
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, StateStopped, s.Status()[0].State)
+}
+
+func TestSupervisor_StopCommandCountsAgainstStopTimeout(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSupervisor(t, dir, Options{Restart: RestartAlways, StopTimeout: time.Second})
+
+	// The process ignores SIGTERM and the stop command hangs, so only SIGKILL ends it.
+	spec := testSpec(dir, "trap '' TERM; while true; do sleep 0.1; done")
+	spec.StopCommand = "exec sleep 30"
+	started, err := s.Start(spec)
+	require.NoError(t, err)
+
+	start := time.Now()
+	stopped, err := s.Stop(8080)
+	require.NoError(t, err)
+	elapsed := time.Since(start)
+	assert.Equal(t, StateStopped, stopped.State)
+	assert.False(t, alive(started.PID))
+	assert.GreaterOrEqual(t, elapsed, time.Second)
+	assert.Less(t, elapsed, 1800*time.Millisecond, "the stop command and the wait share one timeout")
+}
+
+func TestSupervisor_AdoptsProcessesOfPreviousSupervisor(t *testing.T) {
+	dir := t.TempDir()
+	first := New(filepath.Join(dir, "supervisor.json"), Options{Restart: RestartAlways})
+	started, err := first.Start(testSpec(dir, "sleep 30"))
+	require.NoError(t, err)
+	first.Close()
+	require.True(t, alive(started.PID), "closing the supervisor leaves the process running")
+
+	second := newTestSupervisor(t, dir, Options{Restart: RestartAlways})
+	status := waitForState(t, second, 8080, StateRunning)
+	assert.Equal(t, started.PID, status.PID)
+
+	// Once the adopted process dies it is restarted like our own.
+	require.NoError(t, syscall.Kill(started.PID, syscall.SIGKILL))
+	require.Eventually(t, func() bool {
+		s := second.Status()[0]
+		return s.State == StateRunning && s.PID != started.PID
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, 1, second.Status()[0].Restarts)
+	assert.Equal(t, -1, second.Status()[0].ExitCode)
+
+	_, err = second.Stop(8080)
+	require.NoError(t, err)
+}
+
+func TestClient(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestSupervisor(t, dir, Options{Restart: RestartOnFailure})
+	socketPath := filepath.Join(dir, "supervisor.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	defer listener.Close()
+	go s.Serve(listener)
+
+	client := NewClient(socketPath)
+	status, err := client.Start(testSpec(dir, "sleep 30"))
+	require.NoError(t, err)
+	assert.Equal(t, StateRunning, status.State)
+	assert.Positive(t, status.PID)
+
+	processes, err := client.Status()
+	require.NoError(t, err)
+	require.Len(t, processes, 1)
+	assert.Equal(t, status.PID, processes[0].PID)
+
+	status, err = client.Stop(8080, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, StateStopped, status.State)
+
+	_, err = client.Stop(9999, time.Second)
+	assert.Error(t, err)
+
+	_, err = NewClient(filepath.Join(dir, "missing.sock")).Status()
+	assert.ErrorIs(t, err, ErrNotRunning)
+}
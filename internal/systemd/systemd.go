@@ -0,0 +1,208 @@
+// Package systemd renders systemd unit files for an app and its proxy from revlay.yml.
+package systemd
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/xukonxe/revlay/internal/config"
+)
+
+// Options configures how the units are rendered.
+type Options struct {
+	// Binary is the revlay executable run by the proxy unit.
+	Binary string
+	// RunAs sets User= in both units, empty keeps systemd's default.
+	RunAs string
+	// UserUnit renders units for a user's systemd instance instead of the system one.
+	UserUnit bool
+}
+
+// Unit is a rendered unit file.
+type Unit struct {
+	Name    string
+	Content string
+}
+
+// AppUnitName returns the name of the unit running the app of the service with ID id.
+func AppUnitName(id string) string {
+	return fmt.Sprintf("revlay-%s.service", id)
+}
+
+// ProxyUnitName returns the name of the unit running the proxy of the service with ID id.
+func ProxyUnitName(id string) string {
+	return fmt.Sprintf("revlay-%s-proxy.service", id)
+}
+
+// Units renders the units of the service with ID id: the app, and the proxy if
+// service.proxy_port is set.
+func Units(cfg *config.Config, id string, opts Options) []Unit {
+	units := []Unit{{Name: AppUnitName(id), Content: AppUnit(cfg, id, opts)}}
+	if cfg.Service.ProxyPort > 0 {
+		units = append(units, Unit{Name: ProxyUnitName(id), Content: ProxyUnit(cfg, id, opts)})
+	}
+	return units
+}
+
+// AppUnit renders the unit running service.start_command from the current release.
+// In zero_downtime mode the app starts on the port recorded as active, so that a
+// restart lands on the colour the proxy forwards to.
+func AppUnit(cfg *config.Config, id string, opts Options) string {
+	var script strings.Builder
+	if cfg.Deploy.Mode == config.ZeroDowntimeMode {
+		activePort := cfg.GetActivePortPath()
+		fmt.Fprintf(&script, "[ -s %s ] && export PORT=$(cat %s); ", shellQuote(activePort), shellQuote(activePort))
+	}
+	script.WriteString(resolveTemplate(cfg, cfg.Service.StartCommand))
+
+	var u unitWriter
+	u.section("Unit")
+	u.set("Description", fmt.Sprintf("Revlay app %s", cfg.App.Name))
+	u.set("After", "network.target")
+	if cfg.Service.RestartWindow > 0 && cfg.Service.MaxRestarts > 0 {
+		u.set("StartLimitIntervalSec", fmt.Sprint(cfg.Service.RestartWindow))
+		u.set("StartLimitBurst", fmt.Sprint(cfg.Service.MaxRestarts))
+	}
+
+	u.section("Service")
+	u.set("Type", "simple")
+	u.runAs(opts)
+	u.set("WorkingDirectory", escape(cfg.GetCurrentPath()))
+	u.set("Environment", quote(fmt.Sprintf("PORT=%d", cfg.Service.Port)))
+	keys := make([]string, 0, len(cfg.Deploy.Environment))
+	for key := range cfg.Deploy.Environment {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		u.set("Environment", quote(fmt.Sprintf("%s=%s", key, cfg.Deploy.Environment[key])))
+	}
+	u.set("ExecStart", "/bin/sh -c "+quote(script.String()))
+	if cfg.Service.StopCommand != "" {
+		u.set("ExecStop", "/bin/sh -c "+quote(resolveTemplate(cfg, cfg.Service.StopCommand)))
+	}
+	u.set("Restart", restartPolicy(cfg.Service.Restart))
+	u.set("RestartSec", "1")
+	if cfg.Service.GracefulTimeout > 0 {
+		u.set("TimeoutStopSec", fmt.Sprint(cfg.Service.GracefulTimeout))
+	}
+	u.logs("StandardOutput", cfg, cfg.Service.StdoutLog)
+	u.logs("StandardError", cfg, cfg.Service.StderrLog)
+
+	u.install(opts)
+	return u.String()
+}
+
+// ProxyUnit renders the unit running `revlay proxy` for the app.
+func ProxyUnit(cfg *config.Config, id string, opts Options) string {
+	var u unitWriter
+	u.section("Unit")
+	u.set("Description", fmt.Sprintf("Revlay proxy for %s", cfg.App.Name))
+	u.set("After", "network.target")
+
+	u.section("Service")
+	// An upgrade (SIGUSR2) hands the listeners to a new process and the old one exits.
+	// The new process reports itself as MAINPID through sd_notify before that happens,
+	// so systemd keeps the service running instead of killing and restarting it.
+	u.set("Type", "notify")
+	u.set("NotifyAccess", "all")
+	u.runAs(opts)
+	u.set("WorkingDirectory", escape(cfg.RootPath))
+	u.set("ExecStart", fmt.Sprintf("%s proxy --config %s", quote(opts.Binary), quote(filepath.Join(cfg.RootPath, "revlay.yml"))))
+	u.set("ExecReload", "/bin/kill -USR2 $MAINPID")
+	u.set("Restart", "always")
+	u.set("RestartSec", "1")
+	// Leave the proxy time to let open connections finish, see --shutdown-timeout.
+	u.set("TimeoutStopSec", "35")
+
+	u.install(opts)
+	return u.String()
+}
+
+// restartPolicy maps service.restart to systemd's Restart=. An unset policy
+// restarts on failure, which is what a unit is usually installed for.
+func restartPolicy(policy string) string {
+	switch policy {
+	case "always":
+		return "always"
+	case "never":
+		return "no"
+	default:
+		return "on-failure"
+	}
+}
+
+// resolveTemplate fills in the command templates known at install time. The
+// release name changes with every deployment, the shell looks it up when the unit starts.
+func resolveTemplate(cfg *config.Config, template string) string {
+	release := fmt.Sprintf(`$(basename "$(readlink %s)")`, shellQuote(cfg.GetCurrentPath()))
+	template = strings.ReplaceAll(template, "{{.AppName}}", cfg.App.Name)
+	template = strings.ReplaceAll(template, "{{.ReleaseName}}", release)
+	template = strings.ReplaceAll(template, "{{release}}", release)
+	template = strings.ReplaceAll(template, "{{current_path}}", cfg.GetCurrentPath())
+	template = strings.ReplaceAll(template, "{{.Date}}", "$(date +%Y-%m-%d)")
+	return template
+}
+
+type unitWriter struct {
+	strings.Builder
+}
+
+func (u *unitWriter) section(name string) {
+	if u.Len() > 0 {
+		u.WriteString("\n")
+	}
+	fmt.Fprintf(u, "[%s]\n", name)
+}
+
+func (u *unitWriter) set(key, value string) {
+	fmt.Fprintf(u, "%s=%s\n", key, value)
+}
+
+func (u *unitWriter) runAs(opts Options) {
+	if opts.RunAs != "" && !opts.UserUnit {
+		u.set("User", escape(opts.RunAs))
+	}
+}
+
+// logs appends the output to the configured log file. Paths depending on the
+// release cannot be known in advance, their output goes to the journal.
+func (u *unitWriter) logs(key string, cfg *config.Config, path string) {
+	path = strings.ReplaceAll(path, "{{.AppName}}", cfg.App.Name)
+	if path == "" || strings.Contains(path, "{{") {
+		u.set(key, "journal")
+		return
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cfg.RootPath, path)
+	}
+	u.set(key, "append:"+escape(path))
+}
+
+func (u *unitWriter) install(opts Options) {
+	u.section("Install")
+	if opts.UserUnit {
+		u.set("WantedBy", "default.target")
+	} else {
+		u.set("WantedBy", "multi-user.target")
+	}
+}
+
+// escape protects the specifiers systemd expands in unit file values.
+func escape(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+// quote turns s into a single double-quoted argument of a unit file command line.
+// Dollar signs are doubled so that variables are expanded by the shell, not by systemd.
+func quote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", "$$", "\n", " ").Replace(escape(s))
+	return `"` + s + `"`
+}
+
+// shellQuote quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
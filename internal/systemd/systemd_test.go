@@ -0,0 +1,115 @@
+package systemd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xukonxe/revlay/internal/config"
+)
+
+func testConfig() *config.Config {
+	cfg := config.DefaultConfig()
+	cfg.RootPath = "/srv/myapp"
+	cfg.Deploy.Mode = config.ShortDowntimeMode
+	cfg.Deploy.Environment = map[string]string{"NODE_ENV": "production", "GREETING": `say "hi"`}
+	cfg.Service.StartCommand = "./server --port $PORT --name {{.AppName}}"
+	cfg.Service.ProxyPort = 0
+	cfg.Service.GracefulTimeout = 20
+	return cfg
+}
+
+func TestAppUnit(t *testing.T) {
+	cfg := testConfig()
+	cfg.Service.Restart = "always"
+
+	expected := `[Unit]
+Description=Revlay app myapp
+After=network.target
+StartLimitIntervalSec=300
+StartLimitBurst=5
+
+[Service]
+Type=simple
+WorkingDirectory=/srv/myapp/current
+Environment="PORT=8080"
+Environment="GREETING=say \"hi\""
+Environment="NODE_ENV=production"
+ExecStart=/bin/sh -c "./server --port $$PORT --name myapp"
+Restart=always
+RestartSec=1
+TimeoutStopSec=20
+StandardOutput=append:/srv/myapp/logs/myapp-output.log
+StandardError=append:/srv/myapp/logs/myapp-error.log
+
+[Install]
+WantedBy=multi-user.target
+`
+	assert.Equal(t, expected, AppUnit(cfg, "web", Options{}))
+}
+
+func TestAppUnit_ZeroDowntimeStartsOnActivePort(t *testing.T) {
+	cfg := testConfig()
+	cfg.Deploy.Mode = config.ZeroDowntimeMode
+	cfg.Service.StopCommand = "kill -TERM $MAINPID"
+
+	unit := AppUnit(cfg, "web", Options{RunAs: "deploy"})
+	assert.Contains(t, unit, `ExecStart=/bin/sh -c "[ -s '/srv/myapp/.revlay/active_port' ] && export PORT=$$(cat '/srv/myapp/.revlay/active_port'); ./server --port $$PORT --name myapp"`)
+	assert.Contains(t, unit, `ExecStop=/bin/sh -c "kill -TERM $$MAINPID"`)
+	assert.Contains(t, unit, "User=deploy\n")
+	// No restart policy configured means restarting on failure.
+	assert.Contains(t, unit, "Restart=on-failure\n")
+}
+
+func TestAppUnit_ResolvesReleaseAtStart(t *testing.T) {
+	cfg := testConfig()
+	cfg.Service.StartCommand = "bin/app-{{.ReleaseName}} --date {{.Date}}"
+	cfg.Service.StdoutLog = "logs/{{.ReleaseName}}.log"
+	cfg.Service.StderrLog = ""
+	cfg.Service.Restart = "never"
+
+	unit := AppUnit(cfg, "web", Options{UserUnit: true, RunAs: "deploy"})
+	assert.Contains(t, unit, `ExecStart=/bin/sh -c "bin/app-$$(basename \"$$(readlink '/srv/myapp/current')\") --date $$(date +%%Y-%%m-%%d)"`)
+	assert.Contains(t, unit, "Restart=no\n")
+	assert.Contains(t, unit, "StandardOutput=journal\n")
+	assert.Contains(t, unit, "StandardError=journal\n")
+	assert.Contains(t, unit, "WantedBy=default.target\n")
+	// User units always run as the user owning the systemd instance.
+	assert.NotContains(t, unit, "User=")
+}
+
+func TestProxyUnit(t *testing.T) {
+	cfg := testConfig()
+	cfg.Service.ProxyPort = 80
+
+	expected := `[Unit]
+Description=Revlay proxy for myapp
+After=network.target
+
+[Service]
+Type=notify
+NotifyAccess=all
+WorkingDirectory=/srv/myapp
+ExecStart="/usr/local/bin/revlay" proxy --config "/srv/myapp/revlay.yml"
+ExecReload=/bin/kill -USR2 $MAINPID
+Restart=always
+RestartSec=1
+TimeoutStopSec=35
+
+[Install]
+WantedBy=multi-user.target
+`
+	assert.Equal(t, expected, ProxyUnit(cfg, "web", Options{Binary: "/usr/local/bin/revlay"}))
+}
+
+func TestUnits(t *testing.T) {
+	cfg := testConfig()
+	units := Units(cfg, "web", Options{})
+	require.Len(t, units, 1)
+	assert.Equal(t, "revlay-web.service", units[0].Name)
+
+	cfg.Service.ProxyPort = 80
+	units = Units(cfg, "web", Options{})
+	require.Len(t, units, 2)
+	assert.Equal(t, "revlay-web-proxy.service", units[1].Name)
+}